@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
@@ -11,7 +13,10 @@ import (
 	"strconv"
 	"syscall"
 
+	httpauth "github.com/abbot/go-http-auth"
 	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	prom "github.com/prometheus/client_golang/prometheus"
 
 	"github.com/awslabs/aws-servicebroker/pkg/broker"
@@ -87,6 +92,11 @@ func runWithContext(ctx context.Context) error {
 		NewSts: broker.AwsStsClientGetter,
 		NewDdb: broker.AwsDdbClientGetter,
 		NewIam: broker.AwsIamClientGetter,
+		NewSqs: broker.AwsSqsClientGetter,
+		NewSns: broker.AwsSnsClientGetter,
+		NewKms: broker.AwsKmsClientGetter,
+
+		NewSecretsManager: broker.AwsSecretsManagerClientGetter,
 	}
 
 	awsBroker, err := broker.NewAWSBroker(options.Options, broker.AwsSessionGetter, clients, broker.GetCallerId, broker.UpdateCatalog, broker.PollUpdate)
@@ -111,6 +121,22 @@ func runWithContext(ctx context.Context) error {
 	}
 	auth := server.BasicAuth{User: options.BasicAuthUser, Pass: options.BasicAuthPassword}
 	s := server.New(api, reg, options.EnableBasicAuth, auth.Secret)
+	s.Router.Use(broker.CatalogMiddleware)
+	s.Router.Use(broker.MaintenanceInfoMiddleware)
+	s.Router.Use(broker.BindingRotationMiddleware)
+
+	getInstance := getInstanceHandler(awsBroker)
+	// the admin endpoint is only exposed when it can be protected by basic auth
+	if options.EnableBasicAuth {
+		authenticator := httpauth.NewBasicAuthenticator("aws-service-broker", auth.Secret)
+		getInstance = httpauth.JustCheck(authenticator, getInstance)
+		s.Router.HandleFunc("/admin/catalog/refresh", httpauth.JustCheck(authenticator, refreshCatalogHandler(awsBroker))).Methods("POST")
+		s.Router.HandleFunc("/admin/bindings/{binding_id}/credentials", httpauth.JustCheck(authenticator, refreshBindingCredentialsHandler(awsBroker))).Methods("POST")
+	} else {
+		glog.Warningln("Basic auth is disabled, the /admin endpoints will not be available")
+	}
+	s.Router.HandleFunc("/v2/service_instances/{instance_id}", getInstance).Methods("GET")
+	go refreshOnHangup(ctx, awsBroker)
 
 	glog.Infof("Starting broker!")
 
@@ -147,3 +173,87 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 		}
 	}
 }
+
+// refreshCatalogHandler updates the catalog on demand and responds with a summary of the changes
+func refreshCatalogHandler(b *broker.AwsBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		summary, err := b.RefreshCatalog()
+		if summary == nil {
+			glog.Errorln(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+// refreshBindingCredentialsHandler responds with new temporary credentials for a binding
+func refreshBindingCredentialsHandler(b *broker.AwsBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		credentials, err := b.RefreshBindingCredentials(mux.Vars(r)["binding_id"])
+		if err != nil {
+			status := http.StatusInternalServerError
+			if herr, ok := err.(osb.HTTPStatusCodeError); ok {
+				status = herr.StatusCode
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"credentials": credentials})
+	}
+}
+
+func refreshOnHangup(ctx context.Context, b *broker.AwsBroker) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-hup:
+			glog.Infof("Received SIGHUP, refreshing catalog...")
+			if _, err := b.RefreshCatalog(); err != nil {
+				glog.Errorln(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// getInstanceHandler responds with a service instance, the vendored broker library has no handler for fetching
+// instances
+func getInstanceHandler(b *broker.AwsBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := b.ValidateBrokerAPIVersion(r.Header.Get(osb.APIVersionHeader)); err != nil {
+			writeOSBError(w, err, http.StatusPreconditionFailed)
+			return
+		}
+		instance, err := b.GetInstance(mux.Vars(r)["instance_id"])
+		if err != nil {
+			writeOSBError(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(instance)
+	}
+}
+
+// writeOSBError responds with an error in the format of the OSB API, with the status code of the error or the given
+// default
+func writeOSBError(w http.ResponseWriter, err error, status int) {
+	body := map[string]string{"description": err.Error()}
+	if herr, ok := err.(osb.HTTPStatusCodeError); ok {
+		status = herr.StatusCode
+		if herr.ErrorMessage != nil {
+			body["error"] = *herr.ErrorMessage
+		}
+		if herr.Description != nil {
+			body["description"] = *herr.Description
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -3,12 +3,15 @@ package broker
 import (
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
 	"github.com/golang/glog"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
@@ -39,7 +42,7 @@ func (b *AwsBroker) GetCatalog(c *broker.RequestContext) (*broker.CatalogRespons
 			}
 		}
 	}
-	osbResponse := &osb.CatalogResponse{Services: prescribeOverrides(*b, services)}
+	osbResponse := &osb.CatalogResponse{Services: prescribeOverrides(b, services)}
 
 	//glog.Infof("catalog response: %#+v", osbResponse)
 
@@ -71,6 +74,16 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
+	// Services removed from the catalog keep serving their existing instances, but can't be provisioned anymore
+	tombstoned, err := b.db.DataStorePort.IsServiceDefinitionTombstoned(request.ServiceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service %s: %v", request.ServiceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if tombstoned {
+		desc := fmt.Sprintf("The service %s was removed from the catalog.", request.ServiceID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
 	// Get the plan
 	plan := getPlan(service, request.PlanID)
 	glog.V(10).Infof("plan=%v", plan)
@@ -79,6 +92,12 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
+	// Verify that the platform isn't expecting a different version of the plan
+	planMaintenanceInfo := getPlanMaintenanceInfo(plan)
+	if mi := getRequestMaintenanceInfo(c); mi != nil && (planMaintenanceInfo == nil || mi.Version != planMaintenanceInfo.Version) {
+		return nil, newMaintenanceInfoConflictError(mi, planMaintenanceInfo)
+	}
+
 	// Get the parameters and verify that all required parameters are set
 	params := getPlanDefaults(plan)
 	glog.V(10).Infof("params=%v", params)
@@ -89,7 +108,7 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 	}
 	glog.V(10).Infof("params=%v", params)
 	for k, v := range getPlanPrescribedParams(plan.Schemas.ServiceInstance.Create.Parameters) {
-		params[k] = paramValue(v)
+		params[k], _ = toCfnParamValue(nil, v)
 	}
 	glog.V(10).Infof("params=%v", params)
 	for k, v := range request.Parameters {
@@ -97,7 +116,12 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 			desc := fmt.Sprintf("The parameter %s is not available.", k)
 			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 		}
-		params[k] = paramValue(v)
+		value, err := toCfnParamValue(getParamSchema(plan.Schemas.ServiceInstance.Create.Parameters, k), v)
+		if err != nil {
+			desc := fmt.Sprintf("The parameter %s is invalid: %v.", k, err)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+		params[k] = value
 	}
 	for _, p := range getRequiredParams(plan) {
 		if _, ok := params[p]; !ok {
@@ -106,6 +130,16 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		}
 	}
 	glog.V(10).Infof("params=%v", params)
+	if violations := validateParameters(plan.Schemas.ServiceInstance.Create.Parameters, requestValues(params, request.Parameters)); len(violations) > 0 {
+		return nil, newInvalidParametersError(violations)
+	}
+	failed, err := evaluateCfnRules(service.Metadata["cfnRules"], params, plan.Schemas.ServiceInstance.Create.Parameters)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to check the rules of service %q: %v", service.Name, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if len(failed) > 0 {
+		return nil, newInvalidParametersError(failed)
+	}
 
 	instance := &serviceinstance.ServiceInstance{
 		ID:        request.InstanceID,
@@ -143,6 +177,16 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
+	templateURL, templateBody, templateVersion, err := b.getTemplateLocation(service.Name)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the template for service %s: %v", service.Name, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	instance.TemplateVersion = templateVersion
+	if planMaintenanceInfo != nil {
+		instance.MaintenanceVersion = planMaintenanceInfo.Version
+	}
+
 	// Create the CFN stack
 	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, params))
 	resp, err := cfnSvc.Client.CreateStack(&cloudformation.CreateStackInput{
@@ -150,7 +194,8 @@ func (b *AwsBroker) Provision(request *osb.ProvisionRequest, c *broker.RequestCo
 		Parameters:   toCFNParams(params),
 		StackName:    aws.String(getStackName(service.Name, instance.ID)),
 		Tags:         tags,
-		TemplateURL:  b.generateS3HTTPUrl(service.Name),
+		TemplateBody: templateBody,
+		TemplateURL:  templateURL,
 	})
 	if err != nil {
 		desc := fmt.Sprintf("Failed to create the CloudFormation stack: %v", err)
@@ -277,23 +322,120 @@ func (b *AwsBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*b
 
 	// Get the binding params
 	for k, v := range request.Parameters {
+		value, err := toCfnParamValue(nil, v)
+		if err != nil {
+			desc := fmt.Sprintf("The parameter %s is invalid: %v.", k, err)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
 		if strings.EqualFold(k, bindParamRoleName) {
-			binding.RoleName = paramValue(v)
+			binding.RoleName = value
 		} else if strings.EqualFold(k, bindParamScope) {
-			binding.Scope = paramValue(v)
+			binding.Scope = value
+		} else if strings.EqualFold(k, bindParamServiceAccount) {
+			// service accounts are in the namespace the binding is created in, unless one is given
+			if !strings.Contains(value, ":") {
+				namespace := getNamespace(request.Context)
+				if namespace == "unknown" {
+					desc := fmt.Sprintf("The namespace of service account %s is unknown, pass it as namespace:name.", value)
+					return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+				}
+				value = namespace + ":" + value
+			}
+			binding.ServiceAccount = value
+		} else if strings.EqualFold(k, bindParamPrincipalType) {
+			principalType := strings.ToLower(value)
+			if principalType != principalTypeRole && principalType != principalTypeUser && principalType != principalTypeGroup {
+				desc := fmt.Sprintf("The parameter %s must be %s, %s or %s.", k, principalTypeRole, principalTypeUser, principalTypeGroup)
+				return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+			}
+			binding.PrincipalType = principalType
+		} else if strings.EqualFold(k, bindParamPrincipalName) {
+			binding.PrincipalName = value
+		} else if strings.EqualFold(k, bindParamPrincipalArn) {
+			if !principalArnRegex.MatchString(value) {
+				desc := fmt.Sprintf("The parameter %s must be the ARN of an AWS account, IAM user or IAM role.", k)
+				return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+			}
+			binding.PrincipalArn = value
+		} else if strings.EqualFold(k, bindParamCredentialsType) {
+			if strings.EqualFold(value, credentialsTypeTemporary) {
+				binding.CredentialsType = credentialsTypeTemporary
+			} else if !strings.EqualFold(value, credentialsTypeStatic) {
+				desc := fmt.Sprintf("The parameter %s must be %s or %s.", k, credentialsTypeStatic, credentialsTypeTemporary)
+				return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+			}
 		} else {
 			desc := fmt.Sprintf("The parameter %s is not supported.", k)
 			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 		}
 	}
 
-	// Verify that the binding doesn't already exist
+	if (binding.PrincipalType == "") != (binding.PrincipalName == "") {
+		desc := fmt.Sprintf("The parameters %s and %s must be passed together.", bindParamPrincipalType, bindParamPrincipalName)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+	if binding.PrincipalName != "" && binding.RoleName != "" {
+		desc := fmt.Sprintf("The parameter %s can't be combined with %s.", bindParamRoleName, bindParamPrincipalName)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+	// Roles are kept in RoleName, the same as when they are passed as RoleName
+	if binding.PrincipalType == principalTypeRole {
+		binding.RoleName = binding.PrincipalName
+		binding.PrincipalType = ""
+		binding.PrincipalName = ""
+	}
+	if binding.ServiceAccount != "" && (binding.RoleName != "" || binding.PrincipalName != "" || binding.CredentialsType != "") {
+		desc := fmt.Sprintf("The parameter %s can't be combined with %s, %s or %s.", bindParamServiceAccount, bindParamRoleName, bindParamPrincipalName, bindParamCredentialsType)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+	if binding.PrincipalArn != "" && (binding.RoleName != "" || binding.PrincipalName != "" || binding.ServiceAccount != "" || binding.CredentialsType != "") {
+		desc := fmt.Sprintf("The parameter %s can't be combined with %s, %s, %s or %s.", bindParamPrincipalArn, bindParamRoleName, bindParamPrincipalName, bindParamServiceAccount, bindParamCredentialsType)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+	// Temporary credentials are only created for a role of the binding, which only trusts the broker
+	if principalType, principalName := bindingPrincipal(binding); binding.CredentialsType == credentialsTypeTemporary && principalName != "" {
+		desc := fmt.Sprintf("Temporary credentials can't be created for %s %s, the broker creates a role for them.", principalType, principalName)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	// A rotated binding gets the configuration of its predecessor, which stays bound. A binding is only rotated once
+	var predecessor *serviceinstance.ServiceBinding
+	if predecessorID := getPredecessorBindingID(c); predecessorID != "" {
+		if len(request.Parameters) > 0 {
+			desc := "Parameters can't be sent with a predecessor_binding_id, the binding gets the parameters of its predecessor."
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+		var err error
+		predecessor, err = b.db.DataStorePort.GetServiceBinding(predecessorID)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to get the service binding %s: %v", predecessorID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		} else if predecessor == nil || predecessor.InstanceID != binding.InstanceID {
+			desc := fmt.Sprintf("The predecessor service binding %s was not found for service instance %s.", predecessorID, binding.InstanceID)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		} else if predecessor.SuccessorBindingID != "" && predecessor.SuccessorBindingID != binding.ID {
+			desc := fmt.Sprintf("The service binding %s was already rotated by service binding %s.", predecessorID, predecessor.SuccessorBindingID)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+		binding = rotateBinding(binding, predecessor)
+	}
+
+	// Verify that the binding doesn't already exist. A binding whose asynchronous bind failed is created again
+	var failed *serviceinstance.ServiceBinding
 	sb, err := b.db.DataStorePort.GetServiceBinding(binding.ID)
 	if err != nil {
 		desc := fmt.Sprintf("Failed to get the service binding %s: %v", binding.ID, err)
 		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if sb != nil && sb.Match(binding) && sb.State == string(osb.StateFailed) {
+		glog.Infof("Service binding %s failed, creating it again.", binding.ID)
+		failed = sb
 	} else if sb != nil {
-		if sb.Match(binding) {
+		if sb.Match(binding) && sb.State == string(osb.StateInProgress) {
+			glog.Infof("Service binding %s is still being created.", binding.ID)
+			response := broker.BindResponse{}
+			response.Async = true
+			return &response, nil
+		} else if sb.Match(binding) {
 			glog.Infof("Service binding %s already exists.", binding.ID)
 			response := broker.BindResponse{}
 			response.Exists = true
@@ -327,6 +469,11 @@ func (b *AwsBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*b
 
 	sess := b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params)
 
+	// Delete whatever is left of the failed binding
+	if failed != nil {
+		b.deleteBindingResources(sess, failed)
+	}
+
 	// Get the CFN stack outputs
 	resp, err := b.Clients.NewCfn(sess).Client.DescribeStacks(&cloudformation.DescribeStacksInput{
 		StackName: aws.String(instance.StackID),
@@ -336,38 +483,84 @@ func (b *AwsBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*b
 		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 	}
 
+	spec, err := getBindingSpec(service)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the bindings of service %s: %v", service.ID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
 	// Get the credentials from the CFN stack outputs
-	credentials, err := getCredentials(service, resp.Stacks[0].Outputs, b.Clients.NewSsm(sess))
+	credentials, err := getCredentials(service, filterOutputs(resp.Stacks[0].Outputs, spec), sess, b.Clients)
 	if err != nil {
 		desc := fmt.Sprintf("Failed to get the credentials from CloudFormation stack %s: %v", instance.StackID, err)
 		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 	}
 
-	if binding.RoleName != "" {
+	// Bindings with a principal get the scoped policy attached to it. Bindings without one get a role for their service
+	// account, temporary credentials, or an access key of their own when the stack outputs one, scoped by the same policy
+	_, principalName := bindingPrincipal(binding)
+	temporary := binding.CredentialsType == credentialsTypeTemporary
+	webIdentity := binding.ServiceAccount != ""
+	crossAccount := binding.PrincipalArn != ""
+	if principalName != "" || (!crossAccount && (webIdentity || temporary || hasBindingKeys(credentials))) {
 		policyArn, err := getPolicyArn(resp.Stacks[0].Outputs, binding.Scope)
 		if err != nil {
 			desc := fmt.Sprintf("The CloudFormation stack %s does not support binding with scope '%s': %v", instance.StackID, binding.Scope, err)
 			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 		}
+		binding.PolicyArn = policyArn
+	}
+
+	// Roles for service accounts are trusted by the OIDC provider of the cluster
+	issuer := ""
+	if webIdentity {
+		cluster := getCluster(request.Context)
+		var ok bool
+		issuer, ok = b.oidcIssuers[cluster]
+		if !ok {
+			desc := fmt.Sprintf("No OIDC issuer is configured for cluster %s.", cluster)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+	}
+
+	var policies []ResourcePolicySpec
+	if crossAccount {
+		policies = getResourcePolicies(spec, binding.Scope)
+		if len(policies) == 0 {
+			desc := fmt.Sprintf("The service %s does not support cross-account binding with scope '%s'.", service.Name, binding.Scope)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+	}
 
-		// Attach the scoped policy to the role
-		_, err = b.Clients.NewIam(sess).AttachRolePolicy(&iam.AttachRolePolicyInput{
-			PolicyArn: aws.String(policyArn),
-			RoleName:  aws.String(binding.RoleName),
-		})
+	// Creating an IAM role takes a while to become usable, so the binding is completed in the background when the
+	// platform accepts that
+	if acceptsIncomplete(request, c) && (webIdentity || temporary) {
+		binding.State = string(osb.StateInProgress)
+		err = b.db.DataStorePort.PutServiceBinding(*binding)
 		if err != nil {
-			desc := fmt.Sprintf("Failed to attach the policy %s to role %s: %v", policyArn, binding.RoleName, err)
+			desc := fmt.Sprintf("Failed to store the service binding %s: %v", binding.ID, err)
 			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 		}
-
-		binding.PolicyArn = policyArn
+		go func() {
+			if _, err := b.createBinding(sess, service, spec, binding, predecessor, resp.Stacks[0].Outputs, credentials, issuer, policies); err != nil {
+				binding.State = string(osb.StateFailed)
+				binding.StateDescription = err.Error()
+				if serr, ok := err.(osb.HTTPStatusCodeError); ok && serr.Description != nil {
+					binding.StateDescription = *serr.Description
+				}
+				if err := b.db.DataStorePort.PutServiceBinding(*binding); err != nil {
+					glog.Errorf("Failed to store the service binding %s: %v", binding.ID, err)
+				}
+			}
+		}()
+		response := broker.BindResponse{}
+		response.Async = true
+		return &response, nil
 	}
 
-	// Store the binding
-	err = b.db.DataStorePort.PutServiceBinding(*binding)
+	credentials, err = b.createBinding(sess, service, spec, binding, predecessor, resp.Stacks[0].Outputs, credentials, issuer, policies)
 	if err != nil {
-		desc := fmt.Sprintf("Failed to store the service binding %s: %v", binding.ID, err)
-		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		return nil, err
 	}
 
 	return &broker.BindResponse{
@@ -377,6 +570,136 @@ func (b *AwsBroker) Bind(request *osb.BindRequest, c *broker.RequestContext) (*b
 	}, nil
 }
 
+// createBinding creates the IAM resources and resource policy grants of a binding, stores it and returns its
+// credentials. Whatever was created is deleted again when a later step fails
+func (b *AwsBroker) createBinding(sess *session.Session, service *osb.Service, spec *BindingSpec, binding *serviceinstance.ServiceBinding, predecessor *serviceinstance.ServiceBinding, outputs []*cloudformation.Output, credentials map[string]interface{}, issuer string, policies []ResourcePolicySpec) (map[string]interface{}, error) {
+	principalType, principalName := bindingPrincipal(binding)
+	if principalName != "" {
+		// Attach the scoped policy to the role, user or group
+		err := attachPrincipalPolicy(b.Clients.NewIam(sess), principalType, principalName, binding.PolicyArn)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to attach the policy %s to %s %s: %v", binding.PolicyArn, principalType, principalName, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+	}
+
+	// Create an IAM user with its own access key for the binding
+	temporary := binding.CredentialsType == credentialsTypeTemporary
+	webIdentity := binding.ServiceAccount != ""
+	crossAccount := binding.PrincipalArn != ""
+	secretAccessKey := ""
+	if createsBindingUser(spec, binding) {
+		userName := bindingIAMName(binding.ID)
+		userPolicyArn := ""
+		if principalName == "" {
+			userPolicyArn = binding.PolicyArn
+		}
+		accessKey, err := createBindingUser(b.Clients.NewIam(sess), userName, userPolicyArn, spec, outputs)
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to create the IAM user %s: %v", userName, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		glog.Infof("Created access key %s for service binding %s.", aws.StringValue(accessKey.AccessKeyId), binding.ID)
+		binding.UserName = userName
+		binding.AccessKeyID = aws.StringValue(accessKey.AccessKeyId)
+		secretAccessKey = aws.StringValue(accessKey.SecretAccessKey)
+
+		// Keep the secret, so that the binding can be fetched again
+		secretName := bindingSecretName(binding.ID, binding.AccessKeyID)
+		if err := putBindingSecret(b.Clients.NewSecretsManager(sess), secretName, secretAccessKey); err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to store the secret access key of service binding %s: %v", binding.ID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		binding.SecretName = secretName
+	}
+
+	// Create a role for the service account, trusted by the OIDC provider of the cluster
+	if webIdentity {
+		identity, err := b.Clients.NewSts(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to get the caller identity: %v", err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		roleName := bindingIAMName(binding.ID)
+		trustPolicy := webIdentityTrustPolicy(arnPartition(aws.StringValue(identity.Arn)), aws.StringValue(identity.Account), issuer, binding.ServiceAccount)
+		_, err = createBindingRole(b.Clients.NewIam(sess), roleName, trustPolicy, binding.PolicyArn)
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to create the IAM role %s: %v", roleName, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		binding.CreatedRoleName = roleName
+	}
+
+	// Grant the principal of another account access through the policies of the resources
+	if crossAccount {
+		err := b.grantResourcePolicies(sess, binding, policies, outputs)
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to grant %s access for service binding %s: %v", binding.PrincipalArn, binding.ID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+	}
+
+	// Create a role trusted by the broker for temporary credentials
+	if temporary {
+		identity, err := b.Clients.NewSts(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to get the caller identity: %v", err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		principalArn, err := brokerPrincipalArn(b.Clients.NewIam(sess), aws.StringValue(identity.Arn))
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to get the IAM role of the caller %s: %v", aws.StringValue(identity.Arn), err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		roleName := bindingIAMName(binding.ID)
+		_, err = createBindingRole(b.Clients.NewIam(sess), roleName, brokerTrustPolicy(principalArn), binding.PolicyArn)
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to create the IAM role %s: %v", roleName, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		binding.CreatedRoleName = roleName
+	}
+
+	// Getting the credentials also waits for a new role to be assumable
+	credentials, err := b.bindingCredentials(sess, service, spec, binding, secretAccessKey, credentials)
+	if err != nil {
+		b.deleteBindingResources(sess, binding)
+		return nil, err
+	}
+
+	// Link the predecessor to the binding, so unbinding either leaves the policy they share attached
+	if predecessor != nil {
+		predecessor.SuccessorBindingID = binding.ID
+		err = b.db.DataStorePort.PutServiceBinding(*predecessor)
+		if err != nil {
+			b.deleteBindingResources(sess, binding)
+			desc := fmt.Sprintf("Failed to store the service binding %s: %v", predecessor.ID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+	}
+
+	// Store the binding
+	if binding.State == string(osb.StateInProgress) {
+		binding.State = string(osb.StateSucceeded)
+	}
+	err = b.db.DataStorePort.PutServiceBinding(*binding)
+	if err != nil {
+		b.deleteBindingResources(sess, binding)
+		desc := fmt.Sprintf("Failed to store the service binding %s: %v", binding.ID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
+	return credentials, nil
+}
+
 // Unbind is executed when the OSB API receives `DELETE /v2/service_instances/:instance_id/service_bindings/:binding_id`
 // (https://github.com/openservicebrokerapi/servicebroker/blob/v2.13/spec.md#request-5).
 func (b *AwsBroker) Unbind(request *osb.UnbindRequest, c *broker.RequestContext) (*broker.UnbindResponse, error) {
@@ -390,9 +713,12 @@ func (b *AwsBroker) Unbind(request *osb.UnbindRequest, c *broker.RequestContext)
 	} else if binding == nil {
 		desc := fmt.Sprintf("The service binding %s was not found.", request.BindingID)
 		return nil, newHTTPStatusCodeError(http.StatusGone, "", desc)
+	} else if binding.State == string(osb.StateInProgress) {
+		desc := fmt.Sprintf("The service binding %s is still being created.", request.BindingID)
+		return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, "ConcurrencyError", desc)
 	}
 
-	if binding.PolicyArn != "" {
+	if binding.PolicyArn != "" || binding.UserName != "" || binding.SecretName != "" || binding.CreatedRoleName != "" || len(binding.ResourceGrants) > 0 {
 		instance, err := b.db.DataStorePort.GetServiceInstance(binding.InstanceID)
 		if err != nil {
 			desc := fmt.Sprintf("Failed to get the service instance %s: %v", binding.InstanceID, err)
@@ -404,16 +730,55 @@ func (b *AwsBroker) Unbind(request *osb.UnbindRequest, c *broker.RequestContext)
 
 		sess := b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params)
 
-		// Detach the scoped policy from the role
-		_, err = b.Clients.NewIam(sess).DetachRolePolicy(&iam.DetachRolePolicyInput{
-			PolicyArn: aws.String(binding.PolicyArn),
-			RoleName:  aws.String(binding.RoleName),
-		})
+		sharedWith, err := b.sharedPrincipalPolicy(binding)
 		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
-				glog.Infof("The policy %s was already detached from role %s.", binding.PolicyArn, binding.RoleName)
-			} else {
-				desc := fmt.Sprintf("Failed to detach the policy %s from role %s: %v", binding.PolicyArn, binding.RoleName, err)
+			desc := fmt.Sprintf("Failed to get the rotated service bindings of %s: %v", binding.ID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+
+		if principalType, principalName := bindingPrincipal(binding); sharedWith != "" {
+			glog.Infof("The policy %s stays attached to %s %s for service binding %s.", binding.PolicyArn, principalType, principalName, sharedWith)
+		} else if principalName != "" {
+			// Detach the scoped policy from the role, user or group
+			err = detachPrincipalPolicy(b.Clients.NewIam(sess), principalType, principalName, binding.PolicyArn)
+			if err != nil {
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+					glog.Infof("The policy %s was already detached from %s %s.", binding.PolicyArn, principalType, principalName)
+				} else {
+					desc := fmt.Sprintf("Failed to detach the policy %s from %s %s: %v", binding.PolicyArn, principalType, principalName, err)
+					return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+				}
+			}
+		}
+
+		// Delete the IAM user created for the binding, along with its access key
+		if binding.UserName != "" {
+			if err := deleteBindingUser(b.Clients.NewIam(sess), binding.UserName); err != nil {
+				desc := fmt.Sprintf("Failed to delete the IAM user %s: %v", binding.UserName, err)
+				return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+			}
+		}
+
+		// Delete the secret holding the secret access key of the user
+		if binding.SecretName != "" {
+			if err := deleteBindingSecret(b.Clients.NewSecretsManager(sess), binding.SecretName); err != nil {
+				desc := fmt.Sprintf("Failed to delete the secret %s: %v", binding.SecretName, err)
+				return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+			}
+		}
+
+		// Delete the IAM role created for the binding, which also invalidates its temporary credentials
+		if binding.CreatedRoleName != "" {
+			if err := deleteBindingRole(b.Clients.NewIam(sess), binding.CreatedRoleName); err != nil {
+				desc := fmt.Sprintf("Failed to delete the IAM role %s: %v", binding.CreatedRoleName, err)
+				return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+			}
+		}
+
+		// Remove the statements and grants added to the resource policies for the binding
+		for _, grant := range binding.ResourceGrants {
+			if err := b.revokeResourceAccess(sess, grant, resourceStatementID(binding.ID)); err != nil {
+				desc := fmt.Sprintf("Failed to revoke the access of service binding %s to %s %s: %v", binding.ID, grant.Type, grant.Resource, err)
 				return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 			}
 		}
@@ -472,6 +837,51 @@ func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.Request
 		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
 	}
 
+	// The template is only upgraded when explicitly requested, either with the upgrade_template parameter or by the
+	// platform sending the plan's current maintenance_info
+	upgradeTemplate := false
+	maintenanceVersion := instance.MaintenanceVersion
+	planMaintenanceInfo := getPlanMaintenanceInfo(plan)
+	if mi := getRequestMaintenanceInfo(c); mi != nil && mi.Version != instance.MaintenanceVersion {
+		if planMaintenanceInfo == nil || mi.Version != planMaintenanceInfo.Version {
+			return nil, newMaintenanceInfoConflictError(mi, planMaintenanceInfo)
+		}
+		if instance.MaintenanceVersion == "" {
+			// instances provisioned before maintenance_info was recorded run an unknown version, which isn't upgraded
+			maintenanceVersion = mi.Version
+		} else {
+			upgradeTemplate = true
+		}
+	}
+	if v, ok := request.Parameters[updateParamUpgradeTemplate]; ok {
+		if upgradeTemplate, err = strconv.ParseBool(fmt.Sprint(v)); err != nil {
+			desc := fmt.Sprintf("The parameter %q must be a boolean.", updateParamUpgradeTemplate)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
+	}
+	if upgradeTemplate && planMaintenanceInfo != nil {
+		maintenanceVersion = planMaintenanceInfo.Version
+	}
+
+	// Unless upgrading, the stack stays on the template version it was created with, which can have other parameters
+	// than the latest version in the catalog. The parameters are built and checked against the stack's version then
+	rules := service.Metadata["cfnRules"]
+	if !upgradeTemplate {
+		stackCfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+		stackService, err := b.stackServiceDefinition(stackCfnSvc, instance.StackID)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to get the template of the CloudFormation stack %q: %v", instance.StackID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		// plan ids are derived from the plan names
+		plan = getPlanByName(stackService, plan.Name)
+		if plan == nil {
+			desc := fmt.Sprintf("The service plan %q was not found in the template of the CloudFormation stack %q.", instance.PlanID, instance.StackID)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		rules = stackService.Metadata["cfnRules"]
+	}
+
 	// Get the parameters
 	params := getPlanDefaults(plan)
 	paramsUpdated := false
@@ -480,7 +890,18 @@ func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.Request
 		params[k] = v
 	}
 	for k, v := range request.Parameters {
-		newValue := paramValue(v)
+		if k == updateParamUpgradeTemplate {
+			continue
+		}
+		var updateParameters interface{}
+		if plan.Schemas.ServiceInstance.Update != nil {
+			updateParameters = plan.Schemas.ServiceInstance.Update.Parameters
+		}
+		newValue, err := toCfnParamValue(getParamSchema(updateParameters, k), v)
+		if err != nil {
+			desc := fmt.Sprintf("The parameter %q is invalid: %v.", k, err)
+			return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+		}
 		if params[k] != newValue {
 			if !stringInSlice(k, updatableParams) {
 				desc := fmt.Sprintf("The parameter %q is not updatable.", k)
@@ -490,27 +911,63 @@ func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.Request
 			paramsUpdated = true
 		}
 	}
-	if !paramsUpdated {
-		// Nothing to do, so return success (if we try a CFN update, it'll fail)
+	if !paramsUpdated && !upgradeTemplate {
+		// Nothing to do but record the maintenance version, so return success (if we try a CFN update, it'll fail)
+		if maintenanceVersion != instance.MaintenanceVersion {
+			instance.MaintenanceVersion = maintenanceVersion
+			if err := b.db.DataStorePort.PutServiceInstance(*instance); err != nil {
+				desc := fmt.Sprintf("Failed to update the service instance %q: %v", instance.ID, err)
+				return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+			}
+		}
 		return &broker.UpdateInstanceResponse{}, nil
 	}
 	glog.V(10).Infof("params=%v", params)
+	if plan.Schemas.ServiceInstance.Update != nil {
+		values := requestValues(params, request.Parameters)
+		delete(values, updateParamUpgradeTemplate)
+		if violations := validateParameters(plan.Schemas.ServiceInstance.Update.Parameters, values); len(violations) > 0 {
+			return nil, newInvalidParametersError(violations)
+		}
+	}
+	failed, err := evaluateCfnRules(rules, params, plan.Schemas.ServiceInstance.Create.Parameters)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to check the rules of service %q: %v", service.Name, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if len(failed) > 0 {
+		return nil, newInvalidParametersError(failed)
+	}
+
+	// Keep the stack on the template version it was created with, unless upgrading
+	input := &cloudformation.UpdateStackInput{
+		Capabilities:        aws.StringSlice([]string{cloudformation.CapabilityCapabilityNamedIam}),
+		Parameters:          toCFNParams(params),
+		StackName:           aws.String(instance.StackID),
+		UsePreviousTemplate: aws.Bool(true),
+	}
+	templateVersion := instance.TemplateVersion
+	if upgradeTemplate {
+		input.UsePreviousTemplate = nil
+		input.TemplateURL, input.TemplateBody, templateVersion, err = b.getTemplateLocation(service.Name)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to get the template for service %q: %v", service.Name, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		glog.Infof("Upgrading service instance %q from template version %q to %q", instance.ID, instance.TemplateVersion, templateVersion)
+	}
 
 	// Update the CFN stack
 	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, params))
-	_, err = cfnSvc.Client.UpdateStack(&cloudformation.UpdateStackInput{
-		Capabilities: aws.StringSlice([]string{cloudformation.CapabilityCapabilityNamedIam}),
-		Parameters:   toCFNParams(params),
-		StackName:    aws.String(instance.StackID),
-		TemplateURL:  b.generateS3HTTPUrl(service.Name),
-	})
+	_, err = cfnSvc.Client.UpdateStack(input)
 	if err != nil {
 		desc := fmt.Sprintf("Failed to update the CloudFormation stack %q: %v", instance.StackID, err)
 		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
 	}
 
-	// Update the params in the DB
+	// Update the params and template version in the DB
 	instance.Params = params
+	instance.TemplateVersion = templateVersion
+	instance.MaintenanceVersion = maintenanceVersion
 	err = b.db.DataStorePort.PutServiceInstance(*instance)
 	if err != nil {
 		// Try to cancel the update
@@ -528,12 +985,106 @@ func (b *AwsBroker) Update(request *osb.UpdateInstanceRequest, c *broker.Request
 	return &response, nil
 }
 
-// BindingLastOperation is not implemented, as async binding is not supported.
+// BindingLastOperation is executed when the OSB API receives
+// `GET /v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation`
+// (https://github.com/openservicebrokerapi/servicebroker/blob/v2.14/spec.md#polling-last-operation-for-service-bindings).
 func (b *AwsBroker) BindingLastOperation(request *osb.BindingLastOperationRequest, c *broker.RequestContext) (*broker.LastOperationResponse, error) {
-	panic("not implemented")
+	glog.V(10).Infof("request=%+v", *request)
+
+	// Get the binding
+	binding, err := b.db.DataStorePort.GetServiceBinding(request.BindingID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service binding %s: %v", request.BindingID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if binding == nil || binding.InstanceID != request.InstanceID {
+		desc := fmt.Sprintf("The service binding %s was not found.", request.BindingID)
+		return nil, newHTTPStatusCodeError(http.StatusGone, "", desc)
+	}
+
+	// Bindings that were created synchronously have succeeded
+	response := broker.LastOperationResponse{}
+	switch binding.State {
+	case string(osb.StateInProgress):
+		response.State = osb.StateInProgress
+	case string(osb.StateFailed):
+		response.State = osb.StateFailed
+		response.Description = aws.String(binding.StateDescription)
+	default:
+		response.State = osb.StateSucceeded
+	}
+	return &response, nil
 }
 
-// GetBinding is not implemented, as async binding is not supported.
+// GetBinding is executed when the OSB API receives `GET /v2/service_instances/:instance_id/service_bindings/:binding_id`
+// (https://github.com/openservicebrokerapi/servicebroker/blob/v2.14/spec.md#fetching-a-service-binding).
 func (b *AwsBroker) GetBinding(request *osb.GetBindingRequest, c *broker.RequestContext) (*broker.GetBindingResponse, error) {
-	panic("not implemented")
+	glog.V(10).Infof("request=%+v", *request)
+
+	// Get the binding, which can't be fetched before it is created
+	binding, err := b.db.DataStorePort.GetServiceBinding(request.BindingID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service binding %s: %v", request.BindingID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if binding == nil || binding.InstanceID != request.InstanceID {
+		desc := fmt.Sprintf("The service binding %s was not found.", request.BindingID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	} else if binding.State == string(osb.StateInProgress) || binding.State == string(osb.StateFailed) {
+		desc := fmt.Sprintf("The service binding %s was not created, its state is %s.", request.BindingID, binding.State)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+
+	// Get the instance
+	instance, err := b.db.DataStorePort.GetServiceInstance(binding.InstanceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service instance %s: %v", binding.InstanceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if instance == nil {
+		desc := fmt.Sprintf("The service instance %s was not found.", binding.InstanceID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+
+	// Get the service
+	service, err := b.db.DataStorePort.GetServiceDefinition(instance.ServiceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service %s: %v", instance.ServiceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if service == nil {
+		desc := fmt.Sprintf("The service %s was not found.", instance.ServiceID)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
+	sess := b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params)
+
+	// Get the CFN stack outputs
+	resp, err := b.Clients.NewCfn(sess).Client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(instance.StackID),
+	})
+	if err != nil {
+		desc := fmt.Sprintf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
+	spec, err := getBindingSpec(service)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the bindings of service %s: %v", service.ID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
+	// Get the current credentials from the CFN stack outputs and the binding
+	credentials, err := getCredentials(service, filterOutputs(resp.Stacks[0].Outputs, spec), sess, b.Clients)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the credentials from CloudFormation stack %s: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	credentials, err = b.bindingCredentials(sess, service, spec, binding, "", credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return &broker.GetBindingResponse{
+		GetBindingResponse: osb.GetBindingResponse{
+			Credentials: credentials,
+			Parameters:  bindingParameters(binding),
+		},
+	}, nil
 }
@@ -1,17 +1,26 @@
 package broker
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
 	"github.com/pmorie/osb-broker-lib/pkg/broker"
 	"github.com/stretchr/testify/assert"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestGetCatalog(t *testing.T) {
@@ -56,7 +65,9 @@ func TestGetCatalog(t *testing.T) {
 
 type mockDataStoreProvision struct{}
 
-func (db mockDataStoreProvision) PutServiceDefinition(sd osb.Service) error { return nil }
+func (db mockDataStoreProvision) PutServiceDefinition(sd osb.Service, definitionHash string) error {
+	return nil
+}
 func (db mockDataStoreProvision) GetParam(paramname string) (value string, err error) {
 	return "some-value", nil
 }
@@ -74,8 +85,16 @@ func (db mockDataStoreProvision) GetServiceDefinition(serviceuuid string) (*osb.
 		return &osb.Service{
 			ID:   "test-service-id",
 			Name: "test-service-name",
+			Metadata: map[string]interface{}{"cfnRules": map[string]interface{}{
+				"NotForbidden": map[string]interface{}{"Assertions": []interface{}{map[string]interface{}{
+					"Assert":            map[string]interface{}{"Fn::Not": []interface{}{map[string]interface{}{"Fn::Equals": []interface{}{map[string]interface{}{"Ref": "req_param"}, "forbidden"}}}},
+					"AssertDescription": "req_param can't be forbidden",
+				}}},
+			}},
 			Plans: []osb.Plan{
-				{ID: "test-plan-id", Name: "test-plan-name", Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{
+				{ID: "test-plan-id", Name: "test-plan-name", Metadata: map[string]interface{}{
+					"maintenance_info": map[string]interface{}{"version": "2.0.0"},
+				}, Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{
 					Create: &osb.InputParametersSchema{
 						Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
 							"req_param":      map[string]interface{}{"type": "string"},
@@ -91,6 +110,8 @@ func (db mockDataStoreProvision) GetServiceDefinition(serviceuuid string) (*osb.
 							"type": "object",
 							"properties": map[string]interface{}{
 								"req_param": map[string]interface{}{"type": "string"},
+								// only in the latest template version
+								"new_param": map[string]interface{}{"type": "string"},
 							},
 							"$schema":  "http://json-schema.org/draft-06/schema#",
 							"required": []string{"req_param"},
@@ -99,23 +120,71 @@ func (db mockDataStoreProvision) GetServiceDefinition(serviceuuid string) (*osb.
 				}}},
 			},
 		}, nil
+	} else if serviceuuid == "test-bindings-service-id" {
+		return &osb.Service{
+			ID:   "test-bindings-service-id",
+			Name: "test-bindings-service-name",
+			Metadata: map[string]interface{}{"bindings": map[string]interface{}{
+				"addKeypair": true,
+				"policies": []interface{}{map[string]interface{}{
+					"Version": "2012-10-17",
+					"Statement": []interface{}{map[string]interface{}{
+						"Effect":   "Allow",
+						"Action":   "sqs:SendMessage",
+						"Resource": "${QueueArn}",
+					}},
+				}},
+				"cfnOutputs": []interface{}{"QueueURL"},
+			}},
+		}, nil
+	} else if serviceuuid == "test-cross-account-service-id" {
+		return &osb.Service{
+			ID:   "test-cross-account-service-id",
+			Name: "test-cross-account-service-name",
+			Metadata: map[string]interface{}{"bindings": map[string]interface{}{
+				"resourcePolicies": []interface{}{
+					map[string]interface{}{"type": "SQS", "resource": "QueueURL", "actions": []interface{}{"sqs:SendMessage"}},
+					map[string]interface{}{"type": "SNS", "resource": "TopicARN", "actions": []interface{}{"sns:Publish"}},
+					map[string]interface{}{"type": "KMS", "resource": "KeyId", "actions": []interface{}{"kms:Decrypt"}},
+				},
+			}},
+		}, nil
 	} else if serviceuuid == "err" {
 		return nil, errors.New("test failure")
 	} else if serviceuuid == "noplan" {
 		return &osb.Service{}, nil
+	} else if serviceuuid == "tombstoned" || serviceuuid == "err-tombstone" {
+		return &osb.Service{ID: serviceuuid}, nil
 	}
 	return nil, nil
 }
+func (db mockDataStoreProvision) GetServiceDefinitionHash(serviceuuid string) (string, error) {
+	return "", nil
+}
+func (db mockDataStoreProvision) IsServiceDefinitionTombstoned(serviceuuid string) (bool, error) {
+	if serviceuuid == "err-tombstone" {
+		return false, errors.New("test failure")
+	}
+	return serviceuuid == "tombstoned", nil
+}
+func (db mockDataStoreProvision) GetServiceDefinitions() ([]osb.Service, error) { return nil, nil }
+func (db mockDataStoreProvision) TombstoneServiceDefinition(serviceuuid string) error {
+	return nil
+}
 func (db mockDataStoreProvision) GetServiceInstance(sid string) (*serviceinstance.ServiceInstance, error) {
 	switch sid {
 	case "err":
 		return nil, errors.New("test failure")
 	case "err-stack":
-		return &serviceinstance.ServiceInstance{ID: "err-stack", StackID: "err", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
+		return &serviceinstance.ServiceInstance{ID: "err-stack", ServiceID: "test-service-id", StackID: "err", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
 	case "exists":
-		return &serviceinstance.ServiceInstance{ID: "exists", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
+		return &serviceinstance.ServiceInstance{ID: "exists", ServiceID: "test-service-id", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}, MaintenanceVersion: "1.0.0"}, nil
+	case "unversioned":
+		return &serviceinstance.ServiceInstance{ID: "unversioned", ServiceID: "test-service-id", StackID: "an-id", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
 	case "foo-plan":
-		return &serviceinstance.ServiceInstance{ID: "foo-plan", StackID: "an-id", PlanID: "foo"}, nil
+		return &serviceinstance.ServiceInstance{ID: "foo-plan", ServiceID: "test-service-id", StackID: "an-id", PlanID: "foo"}, nil
+	case "err-template":
+		return &serviceinstance.ServiceInstance{ID: "err-template", ServiceID: "test-service-id", StackID: "err-template", PlanID: "test-plan-id", Params: map[string]string{"req_param": "a-value"}}, nil
 	default:
 		return nil, nil
 	}
@@ -151,6 +220,43 @@ func (db mockDataStoreProvision) GetServiceBinding(id string) (*serviceinstance.
 			PolicyArn:  "exists",
 			RoleName:   "exists",
 		}, nil
+	case "err-user-name":
+		return &serviceinstance.ServiceBinding{
+			ID:         "err-user-name",
+			InstanceID: "exists",
+			UserName:   "asb-err",
+		}, nil
+	case "exists-user-name":
+		return &serviceinstance.ServiceBinding{
+			ID:          "exists-user-name",
+			InstanceID:  "exists",
+			PolicyArn:   "exists",
+			UserName:    "asb-exists-user-name",
+			AccessKeyID: "key-id",
+			SecretName:  bindingSecretPrefix + "asb-exists-user-name/key-id",
+		}, nil
+	case "foo-user-name":
+		return &serviceinstance.ServiceBinding{
+			ID:         "foo-user-name",
+			InstanceID: "exists",
+			UserName:   "asb-foo",
+		}, nil
+	case "err-created-role":
+		return &serviceinstance.ServiceBinding{
+			ID:              "err-created-role",
+			InstanceID:      "exists",
+			PolicyArn:       "exists",
+			CredentialsType: "Temporary",
+			CreatedRoleName: "asb-err",
+		}, nil
+	case "exists-temporary":
+		return &serviceinstance.ServiceBinding{
+			ID:              "exists-temporary",
+			InstanceID:      "exists",
+			PolicyArn:       "exists",
+			CredentialsType: "Temporary",
+			CreatedRoleName: "asb-exists-temporary",
+		}, nil
 	case "foo-instance":
 		return &serviceinstance.ServiceBinding{
 			ID:         "foo-instance",
@@ -165,6 +271,86 @@ func (db mockDataStoreProvision) GetServiceBinding(id string) (*serviceinstance.
 			PolicyArn:  "exists",
 			RoleName:   "foo",
 		}, nil
+	case "exists-user-principal":
+		return &serviceinstance.ServiceBinding{
+			ID:            "exists-user-principal",
+			InstanceID:    "exists",
+			PolicyArn:     "exists",
+			PrincipalType: "user",
+			PrincipalName: "exists",
+		}, nil
+	case "err-group-principal":
+		return &serviceinstance.ServiceBinding{
+			ID:            "err-group-principal",
+			InstanceID:    "exists",
+			PolicyArn:     "exists",
+			PrincipalType: "group",
+			PrincipalName: "err",
+		}, nil
+	case "exists-cross-account":
+		return &serviceinstance.ServiceBinding{
+			ID:           "exists-cross-account",
+			InstanceID:   "exists",
+			PrincipalArn: "arn:aws:iam::210987654321:root",
+			ResourceGrants: []serviceinstance.ResourceGrant{
+				{Type: "SNS", Resource: "arn:aws:sns:us-east-1:123456789012:mytopic"},
+				{Type: "KMS", Resource: "mykey"},
+			},
+		}, nil
+	case "err-cross-account":
+		return &serviceinstance.ServiceBinding{
+			ID:             "err-cross-account",
+			InstanceID:     "exists",
+			PrincipalArn:   "arn:aws:iam::210987654321:root",
+			ResourceGrants: []serviceinstance.ResourceGrant{{Type: "SNS", Resource: "err"}},
+		}, nil
+	case "err-policy-rotated":
+		return &serviceinstance.ServiceBinding{
+			ID:                 "err-policy-rotated",
+			InstanceID:         "exists",
+			PolicyArn:          "err",
+			RoleName:           "exists",
+			SuccessorBindingID: "err-policy-successor",
+		}, nil
+	case "err-policy-successor":
+		return &serviceinstance.ServiceBinding{
+			ID:                   "err-policy-successor",
+			InstanceID:           "exists",
+			PolicyArn:            "err",
+			RoleName:             "exists",
+			PredecessorBindingID: "err-policy-rotated",
+		}, nil
+	case "err-policy-unbound-successor":
+		return &serviceinstance.ServiceBinding{
+			ID:                 "err-policy-unbound-successor",
+			InstanceID:         "exists",
+			PolicyArn:          "err",
+			RoleName:           "exists",
+			SuccessorBindingID: "foo",
+		}, nil
+	case "in-progress":
+		return &serviceinstance.ServiceBinding{
+			ID:              "in-progress",
+			InstanceID:      "exists",
+			CredentialsType: "Temporary",
+			State:           "in progress",
+		}, nil
+	case "failed":
+		return &serviceinstance.ServiceBinding{
+			ID:               "failed",
+			InstanceID:       "exists",
+			CredentialsType:  "Temporary",
+			State:            "failed",
+			StateDescription: "Failed to create the IAM role asb-failed: test failure",
+		}, nil
+	case "foo-group-principal":
+		return &serviceinstance.ServiceBinding{
+			ID:            "foo-group-principal",
+			InstanceID:    "exists",
+			PolicyArn:     "exists",
+			PrincipalType: "group",
+			PrincipalName: "foo",
+		}, nil
 	default:
 		return nil, nil
 	}
@@ -213,6 +399,30 @@ func TestProvision(t *testing.T) {
 	_, err = bl.Provision(provReq, reqContext)
 	assertor.Equal(expectedErr, err, "should fail with required parameter error")
 
+	provReq.Parameters = map[string]interface{}{
+		"region":    "us-east-1",
+		"req_param": map[string]interface{}{"a": "b"},
+	}
+	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter req_param is invalid: objects are not supported.")
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should fail with unsupported parameter value error")
+
+	provReq.Parameters = map[string]interface{}{
+		"region":    "us-east-1",
+		"req_param": []interface{}{"pval"},
+	}
+	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameters are invalid: req_param: must be of type string")
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should fail with invalid parameter error")
+
+	provReq.Parameters = map[string]interface{}{
+		"region":    "us-east-1",
+		"req_param": "forbidden",
+	}
+	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameters are invalid: NotForbidden: req_param can't be forbidden")
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should fail with the assertion description of the failed rule")
+
 	provReq.Parameters = map[string]interface{}{
 		"region":    "us-east-1",
 		"req_param": "pval",
@@ -245,6 +455,16 @@ func TestProvision(t *testing.T) {
 	_, err = bl.Provision(provReq, reqContext)
 	assertor.Equal(expectedErr, err, "should fail with 500 error")
 
+	expectedErr = newHTTPStatusCodeError(http.StatusBadRequest, "", "The service tombstoned was removed from the catalog.")
+	provReq.ServiceID = "tombstoned"
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should not provision services removed from the catalog")
+
+	expectedErr = newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service err-tombstone: test failure")
+	provReq.ServiceID = "err-tombstone"
+	_, err = bl.Provision(provReq, reqContext)
+	assertor.Equal(expectedErr, err, "should fail with 500 test error")
+
 	expectedErr = newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance err: test failure")
 	provReq.ServiceID = "test-service-id"
 	provReq.InstanceID = "err"
@@ -472,10 +692,12 @@ func TestBind(t *testing.T) {
 	tests := []struct {
 		name           string
 		request        *osb.BindRequest
+		predecessorID  string
 		cfnOutputs     map[string]string
 		ssmParams      map[string]string
 		expectedCreds  map[string]interface{}
 		expectedExists bool
+		expectedAsync  bool
 		expectedErr    error
 	}{
 		{
@@ -599,6 +821,20 @@ func TestBind(t *testing.T) {
 				"BUCKET_SECRET_ACCESS_KEY": "bar",
 			},
 		},
+		{
+			name: "get_credentials_with_s3_url",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			cfnOutputs: map[string]string{
+				"OutputLocation": "s3://mystack-outputbucket-kdwwxmddtr2g/",
+			},
+			expectedCreds: map[string]interface{}{
+				"OUTPUT_LOCATION": "s3://mystack-outputbucket-kdwwxmddtr2g/",
+			},
+		},
 		{
 			name: "get_legacy_credentials",
 			request: &osb.BindRequest{
@@ -665,170 +901,1093 @@ func TestBind(t *testing.T) {
 			},
 			expectedCreds: make(map[string]interface{}),
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			clients := AwsClients{
-				NewCfn: func(sess *session.Session) CfnClient {
-					return CfnClient{
-						Client: mockCfn{
-							DescribeStacksResponse: toDescribeStacksOutput(tt.cfnOutputs),
-						},
-					}
-				},
-				NewDdb: mockAwsDdbClientGetter,
-				NewIam: mockAwsIamClientGetter,
-				NewS3:  mockAwsS3ClientGetter,
-				NewSsm: func(sess *session.Session) ssmiface.SSMAPI {
-					return &mockSSM{
-						params: tt.ssmParams,
-					}
-				},
-				NewSts: mockAwsStsClientGetter,
-			}
-
-			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
-			b.db.DataStorePort = mockDataStoreProvision{}
-
-			resp, err := b.Bind(tt.request, &broker.RequestContext{})
-			if tt.expectedErr != nil {
-				assert.EqualError(t, err, tt.expectedErr.Error())
-			} else if assert.NoError(t, err) {
-				assert.Equal(t, tt.expectedExists, resp.Exists)
-				assert.Equal(t, tt.expectedCreds, resp.Credentials)
-			}
-		})
-	}
-}
-
-func TestUnbind(t *testing.T) {
-	tests := []struct {
-		name        string
-		request     *osb.UnbindRequest
-		expectedErr error
-	}{
 		{
-			name: "error_getting_binding",
-			request: &osb.UnbindRequest{
-				BindingID: "err",
+			name: "attach_user_policy",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"PrincipalType": "User", "PrincipalName": "exists"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service binding err: test failure"),
+			cfnOutputs: map[string]string{
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: make(map[string]interface{}),
 		},
 		{
-			name: "binding_not_found",
-			request: &osb.UnbindRequest{
-				BindingID: "foo",
+			name: "attach_role_policy_by_principal",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"PrincipalType": "role", "PrincipalName": "exists"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusGone, "", "The service binding foo was not found."),
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedCreds: make(map[string]interface{}),
 		},
 		{
-			name: "success",
-			request: &osb.UnbindRequest{
-				BindingID: "exists",
+			name: "error_attaching_group_policy",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"PrincipalType": "group", "PrincipalName": "err"},
 			},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to attach the policy exists to group err: test failure"),
 		},
 		{
-			name: "error_getting_instance",
-			request: &osb.UnbindRequest{
-				BindingID: "err-instance",
+			name: "invalid_principal_type",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"PrincipalType": "account", "PrincipalName": "exists"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance err: test failure"),
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter PrincipalType must be role, user or group."),
 		},
 		{
-			name: "instance_not_found",
-			request: &osb.UnbindRequest{
-				BindingID: "foo-instance",
+			name: "principal_name_without_type",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"PrincipalName": "exists"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service instance foo was not found."),
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameters PrincipalType and PrincipalName must be passed together."),
 		},
 		{
-			name: "error_detaching_role_policy",
-			request: &osb.UnbindRequest{
-				BindingID: "err-role-name",
+			name: "principal_with_role_name",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"RoleName": "exists", "PrincipalType": "user", "PrincipalName": "exists"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to detach the policy exists from role err: test failure"),
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter RoleName can't be combined with PrincipalName."),
 		},
 		{
-			name: "detach_role_policy",
-			request: &osb.UnbindRequest{
-				BindingID: "exists-role-name",
+			name: "temporary_credentials_for_user",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary", "PrincipalType": "user", "PrincipalName": "exists"},
 			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "Temporary credentials can't be created for user exists, the broker creates a role for them."),
 		},
 		{
-			name: "role_not_found",
-			request: &osb.UnbindRequest{
-				BindingID: "foo-role-name",
+			name: "invalid_principal_arn",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-cross-account-service-id",
+				Parameters: map[string]interface{}{"PrincipalArn": "210987654321"},
 			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter PrincipalArn must be the ARN of an AWS account, IAM user or IAM role."),
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
-			b.db.DataStorePort = mockDataStoreProvision{}
-
-			_, err := b.Unbind(tt.request, &broker.RequestContext{})
-			if tt.expectedErr != nil {
-				assert.EqualError(t, err, tt.expectedErr.Error())
-			} else {
-				assert.NoError(t, err)
-			}
-		})
-	}
-}
-
-func TestUpdate(t *testing.T) {
-	tests := []struct {
-		name          string
-		request       *osb.UpdateInstanceRequest
-		expectedAsync bool
-		expectedErr   error
-	}{
 		{
-			name: "async_required",
-			request: &osb.UpdateInstanceRequest{
-				AcceptsIncomplete: false,
-				InstanceID:        "exists",
-				ServiceID:         "test-service-id",
+			name: "principal_arn_with_role_name",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-cross-account-service-id",
+				Parameters: map[string]interface{}{"PrincipalArn": "arn:aws:iam::210987654321:root", "RoleName": "exists"},
 			},
-			expectedErr: newAsyncError(),
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter PrincipalArn can't be combined with RoleName, PrincipalName, ServiceAccount or CredentialsType."),
 		},
 		{
-			name: "error_getting_instance",
-			request: &osb.UpdateInstanceRequest{
-				AcceptsIncomplete: true,
-				InstanceID:        "err",
-				ServiceID:         "test-service-id",
+			name: "cross_account_unsupported",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-cross-account-service-id",
+				Parameters: map[string]interface{}{"PrincipalArn": "arn:aws:iam::210987654321:root", "Scope": "ReadOnly"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance \"err\": test failure"),
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service test-cross-account-service-name does not support cross-account binding with scope 'ReadOnly'."),
 		},
 		{
-			name: "instance_not_found",
-			request: &osb.UpdateInstanceRequest{
-				AcceptsIncomplete: true,
-				InstanceID:        "foo",
-				ServiceID:         "test-service-id",
+			name: "error_granting_cross_account_access",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-cross-account-service-id",
+				Parameters: map[string]interface{}{"PrincipalArn": "arn:aws:iam::210987654321:root"},
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service instance \"foo\" was not found."),
+			cfnOutputs: map[string]string{
+				"QueueURL": "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"TopicARN": "arn:aws:sns:us-east-1:123456789012:mytopic",
+				"KeyId":    "err",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to grant arn:aws:iam::210987654321:root access for service binding test-binding-id: failed to grant access to KMS err: test failure"),
 		},
 		{
-			name: "change_plan",
-			request: &osb.UpdateInstanceRequest{
-				AcceptsIncomplete: true,
-				InstanceID:        "exists",
-				ServiceID:         "test-service-id",
-				PlanID:            aws.String("new-plan-id"),
+			name: "grant_cross_account_access",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-cross-account-service-id",
+				Parameters: map[string]interface{}{"PrincipalArn": "arn:aws:iam::210987654321:role/app"},
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL":              "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"TopicARN":              "arn:aws:sns:us-east-1:123456789012:mytopic",
+				"KeyId":                 "mykey",
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"QUEUE_URL": "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"TOPIC_ARN": "arn:aws:sns:us-east-1:123456789012:mytopic",
+				"KEY_ID":    "mykey",
 			},
-			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service plan cannot be changed from \"test-plan-id\" to \"new-plan-id\"."),
 		},
 		{
-			name: "error_getting_service",
-			request: &osb.UpdateInstanceRequest{
-				AcceptsIncomplete: true,
-				InstanceID:        "exists",
-				ServiceID:         "err",
-			},
+			name: "predecessor_not_found",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			predecessorID: "foo-instance",
+			expectedErr:   newHTTPStatusCodeError(http.StatusBadRequest, "", "The predecessor service binding foo-instance was not found for service instance exists."),
+		},
+		{
+			name: "rotate_binding",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			predecessorID: "exists-role-name",
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedCreds: make(map[string]interface{}),
+		},
+		{
+			name: "rotate_binding_with_parameters",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"RoleName": "other"},
+			},
+			predecessorID: "exists-role-name",
+			expectedErr:   newHTTPStatusCodeError(http.StatusBadRequest, "", "Parameters can't be sent with a predecessor_binding_id, the binding gets the parameters of its predecessor."),
+		},
+		{
+			name: "rotate_rotated_binding",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			predecessorID: "err-policy-rotated",
+			expectedErr:   newHTTPStatusCodeError(http.StatusBadRequest, "", "The service binding err-policy-rotated was already rotated by service binding err-policy-successor."),
+		},
+		{
+			name: "create_scoped_user",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL":              "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"QUEUE_URL":                 "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"SQS_AWS_ACCESS_KEY_ID":     "key-id",
+				"SQS_AWS_SECRET_ACCESS_KEY": "secret-key",
+			},
+		},
+		{
+			name: "error_storing_secret",
+			request: &osb.BindRequest{
+				BindingID:  "fail-secret",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			cfnOutputs: map[string]string{
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to store the secret access key of service binding fail-secret: test failure"),
+		},
+		{
+			name: "unsupported_user_scope",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"Scope": "ReadOnly"},
+			},
+			cfnOutputs: map[string]string{
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The CloudFormation stack an-id does not support binding with scope 'ReadOnly': output not found: PolicyArnReadOnly"),
+		},
+		{
+			name: "error_attaching_user_policy",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+			},
+			cfnOutputs: map[string]string{
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "err",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM user asb-test-binding-id: test failure"),
+		},
+		{
+			name: "role_without_access_key",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"RoleName": "exists"},
+			},
+			cfnOutputs: map[string]string{
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: make(map[string]interface{}),
+		},
+		{
+			name: "invalid_credentials_type",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "foo"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter CredentialsType must be Static or Temporary."),
+		},
+		{
+			name: "temporary_credentials",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"credentialsType": "temporary"},
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL":              "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"QUEUE_URL":              "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"AWS_ACCESS_KEY_ID":      "temporary-key-id",
+				"AWS_SECRET_ACCESS_KEY":  "temporary-secret-key",
+				"AWS_SESSION_TOKEN":      "session-token",
+				"AWS_SESSION_EXPIRATION": "2018-06-01T12:00:00Z",
+			},
+		},
+		{
+			name: "async_temporary_credentials",
+			request: &osb.BindRequest{
+				BindingID:         "test-binding-id",
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				AcceptsIncomplete: true,
+				Parameters:        map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "async_temporary_credentials_with_access_key",
+			request: &osb.BindRequest{
+				BindingID:         "test-binding-id",
+				InstanceID:        "exists",
+				ServiceID:         "test-bindings-service-id",
+				AcceptsIncomplete: true,
+				Parameters:        map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL":  "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"QueueArn":  "arn:aws:sqs:us-east-1:123456789012:myqueue",
+				"PolicyArn": "exists",
+			},
+			expectedAsync: true,
+		},
+		{
+			// the binding is created again, assuming its role fails in the mock
+			name: "failed_binding",
+			request: &osb.BindRequest{
+				BindingID:  "failed",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get temporary credentials for service binding failed: test failure"),
+		},
+		{
+			name: "binding_in_progress",
+			request: &osb.BindRequest{
+				BindingID:         "in-progress",
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				AcceptsIncomplete: true,
+				Parameters:        map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "temporary_credentials_for_role",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary", "RoleName": "exists"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "Temporary credentials can't be created for role exists, the broker creates a role for them."),
+		},
+		{
+			name: "unsupported_temporary_scope",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The CloudFormation stack an-id does not support binding with scope '': output not found: PolicyArn"),
+		},
+		{
+			name: "error_creating_role",
+			request: &osb.BindRequest{
+				BindingID:  "err-binding",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM role asb-err-binding: test failure"),
+		},
+		{
+			name: "error_assuming_role",
+			request: &osb.BindRequest{
+				BindingID:  "fail-binding",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary"},
+			},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get temporary credentials for service binding fail-binding: test failure"),
+		},
+		{
+			name: "service_account",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"ServiceAccount": "my-app"},
+				Context:    map[string]interface{}{"platform": "kubernetes", "clusterid": "test-cluster", "namespace": "test-namespace"},
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL":              "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"QUEUE_URL":    "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/aws-service-broker/asb-test-binding-id",
+			},
+		},
+		{
+			name: "service_account_unknown_namespace",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"ServiceAccount": "my-app"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The namespace of service account my-app is unknown, pass it as namespace:name."),
+		},
+		{
+			name: "service_account_with_role",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"ServiceAccount": "test-namespace:my-app", "RoleName": "exists"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter ServiceAccount can't be combined with RoleName, PrincipalName or CredentialsType."),
+		},
+		{
+			name: "service_account_unknown_cluster",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"ServiceAccount": "test-namespace:my-app"},
+			},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "No OIDC issuer is configured for cluster unknown."),
+		},
+		{
+			name: "error_creating_user",
+			request: &osb.BindRequest{
+				BindingID:  "err-binding",
+				InstanceID: "exists",
+				ServiceID:  "test-bindings-service-id",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM user asb-err-binding: test failure"),
+		},
+		{
+			name: "error_putting_user_policy",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-bindings-service-id",
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL": "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM user asb-test-binding-id: unresolved placeholder"),
+		},
+		{
+			name: "create_user",
+			request: &osb.BindRequest{
+				BindingID:  "test-binding-id",
+				InstanceID: "exists",
+				ServiceID:  "test-bindings-service-id",
+			},
+			cfnOutputs: map[string]string{
+				"QueueURL": "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"QueueArn": "arn:aws:sqs:us-east-1:123456789012:myqueue",
+			},
+			expectedCreds: map[string]interface{}{
+				"QUEUE_URL":                                  "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"TEST-BINDINGS-SERVICE-NAME_USER_KEY_ID":     "key-id",
+				"TEST-BINDINGS-SERVICE-NAME_USER_SECRET_KEY": "secret-key",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := AwsClients{
+				NewCfn: func(sess *session.Session) CfnClient {
+					return CfnClient{
+						Client: mockCfn{
+							DescribeStacksResponse: toDescribeStacksOutput(tt.cfnOutputs),
+						},
+					}
+				},
+				NewDdb: mockAwsDdbClientGetter,
+				NewIam: mockAwsIamClientGetter,
+				NewS3:  mockAwsS3ClientGetter,
+				NewSsm: func(sess *session.Session) ssmiface.SSMAPI {
+					return &mockSSM{
+						params: tt.ssmParams,
+					}
+				},
+				NewSts: mockAwsStsClientGetter,
+				NewSqs: mockAwsSqsClientGetter,
+				NewSns: mockAwsSnsClientGetter,
+				NewKms: mockAwsKmsClientGetter,
+
+				NewSecretsManager: mockAwsSecretsManagerClientGetter,
+			}
+
+			opts := Options{OIDCIssuers: "test-cluster=https://oidc.eks.us-east-1.amazonaws.com/id/EXAMPLE"}
+			b, _ := NewAWSBroker(opts, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			c := &broker.RequestContext{}
+			if tt.predecessorID != "" {
+				r := httptest.NewRequest(http.MethodPut, "/v2/service_instances/"+tt.request.InstanceID+"/service_bindings/"+tt.request.BindingID, nil)
+				c.Request = r.WithContext(context.WithValue(r.Context(), predecessorBindingKey{}, tt.predecessorID))
+			}
+
+			resp, err := b.Bind(tt.request, c)
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expectedExists, resp.Exists)
+				assert.Equal(t, tt.expectedAsync, resp.Async)
+				assert.Equal(t, tt.expectedCreds, resp.Credentials)
+			}
+		})
+	}
+}
+
+func TestUnbind(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     *osb.UnbindRequest
+		expectedErr error
+	}{
+		{
+			name: "error_getting_binding",
+			request: &osb.UnbindRequest{
+				BindingID: "err",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service binding err: test failure"),
+		},
+		{
+			name: "binding_not_found",
+			request: &osb.UnbindRequest{
+				BindingID: "foo",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusGone, "", "The service binding foo was not found."),
+		},
+		{
+			name: "success",
+			request: &osb.UnbindRequest{
+				BindingID: "exists",
+			},
+		},
+		{
+			name: "binding_in_progress",
+			request: &osb.UnbindRequest{
+				BindingID: "in-progress",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusUnprocessableEntity, "ConcurrencyError", "The service binding in-progress is still being created."),
+		},
+		{
+			name: "failed_binding",
+			request: &osb.UnbindRequest{
+				BindingID: "failed",
+			},
+		},
+		{
+			name: "error_getting_instance",
+			request: &osb.UnbindRequest{
+				BindingID: "err-instance",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance err: test failure"),
+		},
+		{
+			name: "instance_not_found",
+			request: &osb.UnbindRequest{
+				BindingID: "foo-instance",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service instance foo was not found."),
+		},
+		{
+			name: "error_detaching_role_policy",
+			request: &osb.UnbindRequest{
+				BindingID: "err-role-name",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to detach the policy exists from role err: test failure"),
+		},
+		{
+			name: "detach_role_policy",
+			request: &osb.UnbindRequest{
+				BindingID: "exists-role-name",
+			},
+		},
+		{
+			name: "role_not_found",
+			request: &osb.UnbindRequest{
+				BindingID: "foo-role-name",
+			},
+		},
+		{
+			name: "detach_user_policy",
+			request: &osb.UnbindRequest{
+				BindingID: "exists-user-principal",
+			},
+		},
+		{
+			name: "error_detaching_group_policy",
+			request: &osb.UnbindRequest{
+				BindingID: "err-group-principal",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to detach the policy exists from group err: test failure"),
+		},
+		{
+			name: "group_not_found",
+			request: &osb.UnbindRequest{
+				BindingID: "foo-group-principal",
+			},
+		},
+		{
+			name: "revoke_cross_account_access",
+			request: &osb.UnbindRequest{
+				BindingID: "exists-cross-account",
+			},
+		},
+		{
+			name: "error_revoking_cross_account_access",
+			request: &osb.UnbindRequest{
+				BindingID: "err-cross-account",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to revoke the access of service binding err-cross-account to SNS err: test failure"),
+		},
+		{
+			name: "policy_shared_with_successor",
+			request: &osb.UnbindRequest{
+				BindingID: "err-policy-rotated",
+			},
+		},
+		{
+			name: "policy_shared_with_predecessor",
+			request: &osb.UnbindRequest{
+				BindingID: "err-policy-successor",
+			},
+		},
+		{
+			name: "successor_unbound",
+			request: &osb.UnbindRequest{
+				BindingID: "err-policy-unbound-successor",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to detach the policy err from role exists: test failure"),
+		},
+		{
+			name: "error_deleting_user",
+			request: &osb.UnbindRequest{
+				BindingID: "err-user-name",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to delete the IAM user asb-err: test failure"),
+		},
+		{
+			name: "delete_user",
+			request: &osb.UnbindRequest{
+				BindingID: "exists-user-name",
+			},
+		},
+		{
+			name: "user_not_found",
+			request: &osb.UnbindRequest{
+				BindingID: "foo-user-name",
+			},
+		},
+		{
+			name: "error_deleting_role",
+			request: &osb.UnbindRequest{
+				BindingID: "err-created-role",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to delete the IAM role asb-err: test failure"),
+		},
+		{
+			name: "delete_role",
+			request: &osb.UnbindRequest{
+				BindingID: "exists-temporary",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			_, err := b.Unbind(tt.request, &broker.RequestContext{})
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+type mockDataStoreBindings struct {
+	mockDataStoreProvision
+	bindings chan serviceinstance.ServiceBinding
+}
+
+func (db mockDataStoreBindings) PutServiceBinding(sb serviceinstance.ServiceBinding) error {
+	db.bindings <- sb
+	return nil
+}
+
+func TestAsyncBind(t *testing.T) {
+	tests := []struct {
+		name                string
+		bindingID           string
+		expectedState       string
+		expectedDescription string
+	}{
+		{
+			name:          "succeeded",
+			bindingID:     "test-binding-id",
+			expectedState: "succeeded",
+		},
+		{
+			name:                "failed",
+			bindingID:           "err-binding",
+			expectedState:       "failed",
+			expectedDescription: "Failed to create the IAM role asb-err-binding: test failure",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := mockClients
+			clients.NewCfn = func(sess *session.Session) CfnClient {
+				return CfnClient{Client: mockCfn{DescribeStacksResponse: toDescribeStacksOutput(map[string]string{"PolicyArn": "exists"})}}
+			}
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			db := mockDataStoreBindings{bindings: make(chan serviceinstance.ServiceBinding, 2)}
+			b.db.DataStorePort = db
+
+			r := httptest.NewRequest(http.MethodPut, "/v2/service_instances/exists/service_bindings/"+tt.bindingID+"?accepts_incomplete=true", nil)
+			resp, err := b.Bind(&osb.BindRequest{
+				BindingID:  tt.bindingID,
+				InstanceID: "exists",
+				ServiceID:  "test-service-id",
+				Parameters: map[string]interface{}{"CredentialsType": "Temporary"},
+			}, &broker.RequestContext{Request: r})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, resp.Async)
+			assert.Nil(t, resp.Credentials)
+			assert.Equal(t, "in progress", (<-db.bindings).State, "should store the binding before creating its role")
+
+			select {
+			case binding := <-db.bindings:
+				assert.Equal(t, tt.expectedState, binding.State)
+				assert.Equal(t, tt.expectedDescription, binding.StateDescription)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the binding was not completed")
+			}
+		})
+	}
+}
+
+// mock IAM client that records the calls deleting the resources of a binding
+type mockIAMCleanup struct {
+	*mockIAM
+	calls          *[]string
+	createRoleFail bool
+}
+
+func (c mockIAMCleanup) CreateRole(input *iam.CreateRoleInput) (*iam.CreateRoleOutput, error) {
+	if c.createRoleFail {
+		return nil, errors.New("test failure")
+	}
+	return c.mockIAM.CreateRole(input)
+}
+
+func (c mockIAMCleanup) DetachRolePolicy(input *iam.DetachRolePolicyInput) (*iam.DetachRolePolicyOutput, error) {
+	*c.calls = append(*c.calls, fmt.Sprintf("DetachRolePolicy %s %s", aws.StringValue(input.RoleName), aws.StringValue(input.PolicyArn)))
+	return &iam.DetachRolePolicyOutput{}, nil
+}
+
+func (c mockIAMCleanup) DeleteAccessKey(input *iam.DeleteAccessKeyInput) (*iam.DeleteAccessKeyOutput, error) {
+	*c.calls = append(*c.calls, fmt.Sprintf("DeleteAccessKey %s %s", aws.StringValue(input.UserName), aws.StringValue(input.AccessKeyId)))
+	return &iam.DeleteAccessKeyOutput{}, nil
+}
+
+func (c mockIAMCleanup) DeleteUser(input *iam.DeleteUserInput) (*iam.DeleteUserOutput, error) {
+	*c.calls = append(*c.calls, fmt.Sprintf("DeleteUser %s", aws.StringValue(input.UserName)))
+	return &iam.DeleteUserOutput{}, nil
+}
+
+func (c mockIAMCleanup) DeleteRole(input *iam.DeleteRoleInput) (*iam.DeleteRoleOutput, error) {
+	*c.calls = append(*c.calls, fmt.Sprintf("DeleteRole %s", aws.StringValue(input.RoleName)))
+	return &iam.DeleteRoleOutput{}, nil
+}
+
+type mockSTSCallerIdentityFail struct {
+	mockSTS
+}
+
+func (c *mockSTSCallerIdentityFail) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return nil, errors.New("test failure")
+}
+
+func TestCreateBindingCleanup(t *testing.T) {
+	tests := []struct {
+		name           string
+		binding        serviceinstance.ServiceBinding
+		predecessor    *serviceinstance.ServiceBinding
+		createRoleFail bool
+		callerFail     bool
+		expectedErr    error
+		expectedCalls  []string
+	}{
+		{
+			name:          "user_fails_after_attaching_policy",
+			binding:       serviceinstance.ServiceBinding{ID: "err-user", InstanceID: "exists", RoleName: "exists", PolicyArn: "exists"},
+			expectedErr:   newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM user asb-err-user: test failure"),
+			expectedCalls: []string{"DetachRolePolicy exists exists"},
+		},
+		{
+			name:        "user_fails_after_attaching_policy_shared_with_predecessor",
+			binding:     serviceinstance.ServiceBinding{ID: "err-user", InstanceID: "exists", RoleName: "exists", PolicyArn: "exists", PredecessorBindingID: "exists-role-name"},
+			predecessor: &serviceinstance.ServiceBinding{ID: "exists-role-name", InstanceID: "exists", RoleName: "exists", PolicyArn: "exists"},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM user asb-err-user: test failure"),
+		},
+		{
+			name:          "caller_identity_fails_after_creating_user",
+			binding:       serviceinstance.ServiceBinding{ID: "test-binding-id", InstanceID: "exists", ServiceAccount: "default:app", PolicyArn: "exists"},
+			callerFail:    true,
+			expectedErr:   newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the caller identity: test failure"),
+			expectedCalls: []string{"DeleteAccessKey asb-test-binding-id key-id", "DeleteUser asb-test-binding-id"},
+		},
+		{
+			name:           "role_fails_after_creating_user",
+			binding:        serviceinstance.ServiceBinding{ID: "test-binding-id", InstanceID: "exists", ServiceAccount: "default:app", PolicyArn: "exists"},
+			createRoleFail: true,
+			expectedErr:    newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to create the IAM role asb-test-binding-id: test failure"),
+			expectedCalls:  []string{"DeleteAccessKey asb-test-binding-id key-id", "DeleteUser asb-test-binding-id"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			clients := mockClients
+			clients.NewIam = func(sess *session.Session) iamiface.IAMAPI {
+				return mockIAMCleanup{mockIAM: &mockIAM{}, calls: &calls, createRoleFail: tt.createRoleFail}
+			}
+			if tt.callerFail {
+				clients.NewSts = func(sess *session.Session) stsiface.STSAPI { return &mockSTSCallerIdentityFail{} }
+			}
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			binding := tt.binding
+			service := &osb.Service{Name: "test-service-name"}
+			_, err := b.createBinding(nil, service, &BindingSpec{AddKeypair: true}, &binding, tt.predecessor, nil, map[string]interface{}{}, "https://oidc.example.com", nil)
+			assert.EqualError(t, err, tt.expectedErr.Error())
+			assert.Equal(t, tt.expectedCalls, calls)
+		})
+	}
+}
+
+func TestBindingLastOperation(t *testing.T) {
+	tests := []struct {
+		name                string
+		request             *osb.BindingLastOperationRequest
+		expectedState       osb.LastOperationState
+		expectedDescription *string
+		expectedErr         error
+	}{
+		{
+			name:        "error_getting_binding",
+			request:     &osb.BindingLastOperationRequest{InstanceID: "exists", BindingID: "err"},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service binding err: test failure"),
+		},
+		{
+			name:        "binding_not_found",
+			request:     &osb.BindingLastOperationRequest{InstanceID: "exists", BindingID: "foo"},
+			expectedErr: newHTTPStatusCodeError(http.StatusGone, "", "The service binding foo was not found."),
+		},
+		{
+			name:        "other_instance",
+			request:     &osb.BindingLastOperationRequest{InstanceID: "foo", BindingID: "exists"},
+			expectedErr: newHTTPStatusCodeError(http.StatusGone, "", "The service binding exists was not found."),
+		},
+		{
+			name:          "in_progress",
+			request:       &osb.BindingLastOperationRequest{InstanceID: "exists", BindingID: "in-progress"},
+			expectedState: osb.StateInProgress,
+		},
+		{
+			name:                "failed",
+			request:             &osb.BindingLastOperationRequest{InstanceID: "exists", BindingID: "failed"},
+			expectedState:       osb.StateFailed,
+			expectedDescription: aws.String("Failed to create the IAM role asb-failed: test failure"),
+		},
+		{
+			name:          "synchronous_binding",
+			request:       &osb.BindingLastOperationRequest{InstanceID: "exists", BindingID: "exists"},
+			expectedState: osb.StateSucceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			resp, err := b.BindingLastOperation(tt.request, &broker.RequestContext{})
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expectedState, resp.State)
+				assert.Equal(t, tt.expectedDescription, resp.Description)
+			}
+		})
+	}
+}
+
+func TestGetBinding(t *testing.T) {
+	tests := []struct {
+		name           string
+		request        *osb.GetBindingRequest
+		cfnOutputs     map[string]string
+		expectedCreds  map[string]interface{}
+		expectedParams map[string]interface{}
+		expectedErr    error
+	}{
+		{
+			name:        "error_getting_binding",
+			request:     &osb.GetBindingRequest{InstanceID: "exists", BindingID: "err"},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service binding err: test failure"),
+		},
+		{
+			name:        "binding_not_found",
+			request:     &osb.GetBindingRequest{InstanceID: "exists", BindingID: "foo"},
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service binding foo was not found."),
+		},
+		{
+			name:        "other_instance",
+			request:     &osb.GetBindingRequest{InstanceID: "foo", BindingID: "exists"},
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service binding exists was not found."),
+		},
+		{
+			name:        "binding_in_progress",
+			request:     &osb.GetBindingRequest{InstanceID: "exists", BindingID: "in-progress"},
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service binding in-progress was not created, its state is in progress."),
+		},
+		{
+			name:        "error_getting_instance",
+			request:     &osb.GetBindingRequest{InstanceID: "err", BindingID: "err-instance"},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance err: test failure"),
+		},
+		{
+			name:    "role_binding",
+			request: &osb.GetBindingRequest{InstanceID: "exists", BindingID: "exists-role-name"},
+			cfnOutputs: map[string]string{
+				"QueueURL":  "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+				"PolicyArn": "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"QUEUE_URL": "https://sqs.us-east-1.amazonaws.com/123456789012/myqueue",
+			},
+			expectedParams: map[string]interface{}{"RoleName": "exists"},
+		},
+		{
+			name:    "user_binding",
+			request: &osb.GetBindingRequest{InstanceID: "exists", BindingID: "exists-user-name"},
+			cfnOutputs: map[string]string{
+				"SqsAwsAccessKeyId":     "binding:AccessKeyId",
+				"SqsAwsSecretAccessKey": "binding:SecretAccessKey",
+				"PolicyArn":             "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"SQS_AWS_ACCESS_KEY_ID":     "key-id",
+				"SQS_AWS_SECRET_ACCESS_KEY": "secret-key",
+			},
+			expectedParams: map[string]interface{}{},
+		},
+		{
+			name:    "temporary_binding",
+			request: &osb.GetBindingRequest{InstanceID: "exists", BindingID: "exists-temporary"},
+			cfnOutputs: map[string]string{
+				"PolicyArn": "exists",
+			},
+			expectedCreds: map[string]interface{}{
+				"AWS_ACCESS_KEY_ID":      "temporary-key-id",
+				"AWS_SECRET_ACCESS_KEY":  "temporary-secret-key",
+				"AWS_SESSION_TOKEN":      "session-token",
+				"AWS_SESSION_EXPIRATION": "2018-06-01T12:00:00Z",
+			},
+			expectedParams: map[string]interface{}{"CredentialsType": "Temporary"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := mockClients
+			clients.NewCfn = func(sess *session.Session) CfnClient {
+				return CfnClient{Client: mockCfn{DescribeStacksResponse: toDescribeStacksOutput(tt.cfnOutputs)}}
+			}
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			resp, err := b.GetBinding(tt.request, &broker.RequestContext{})
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expectedCreds, resp.Credentials)
+				assert.Equal(t, tt.expectedParams, resp.Parameters)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name            string
+		request         *osb.UpdateInstanceRequest
+		maintenanceInfo *MaintenanceInfo
+		expectedAsync   bool
+		expectedErr     error
+	}{
+		{
+			name: "async_required",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: false,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+			},
+			expectedErr: newAsyncError(),
+		},
+		{
+			name: "error_getting_instance",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "err",
+				ServiceID:         "test-service-id",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance \"err\": test failure"),
+		},
+		{
+			name: "instance_not_found",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "foo",
+				ServiceID:         "test-service-id",
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service instance \"foo\" was not found."),
+		},
+		{
+			name: "change_plan",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				PlanID:            aws.String("new-plan-id"),
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service plan cannot be changed from \"test-plan-id\" to \"new-plan-id\"."),
+		},
+		{
+			name: "error_getting_service",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "err",
+			},
 			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service \"err\": test failure"),
 		},
 		{
@@ -859,6 +2018,27 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter \"foo\" is not updatable."),
 		},
+		{
+			name: "parameter_invalid",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"req_param": []interface{}{"a", "b"}},
+			},
+			// the stack's template also has a rule on req_param, which is checked by the schema
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameters are invalid: req_param: must be of type string; req_param: must be of type string"),
+		},
+		{
+			name: "rule_failed",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"req_param": "forbidden"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameters are invalid: req_param: req_param can't be forbidden"),
+		},
 		{
 			name: "parameter_not_updated",
 			request: &osb.UpdateInstanceRequest{
@@ -869,6 +2049,36 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedAsync: false,
 		},
+		{
+			name: "parameter_only_in_newer_template",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"new_param": "a-value"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter \"new_param\" is not updatable."),
+		},
+		{
+			name: "upgrade_template_with_new_parameter",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"upgrade_template": true, "new_param": "a-value"},
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "error_getting_stack_template",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "err-template",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"req_param": "new-value"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the template of the CloudFormation stack \"err-template\": test failure"),
+		},
 		{
 			name: "error_updating_stack",
 			request: &osb.UpdateInstanceRequest{
@@ -889,6 +2099,76 @@ func TestUpdate(t *testing.T) {
 			},
 			expectedAsync: true,
 		},
+		{
+			name: "upgrade_template",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"upgrade_template": true},
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "upgrade_template_string",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"upgrade_template": "True"},
+			},
+			expectedAsync: true,
+		},
+		{
+			name: "upgrade_template_invalid",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+				Parameters:        map[string]interface{}{"upgrade_template": "yes"},
+			},
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The parameter \"upgrade_template\" must be a boolean."),
+		},
+		{
+			name: "maintenance_info_current",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "1.0.0"},
+			expectedAsync:   false,
+		},
+		{
+			name: "maintenance_info_upgrade",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "2.0.0"},
+			expectedAsync:   true,
+		},
+		{
+			name: "maintenance_info_unknown_version",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "unversioned",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "2.0.0"},
+			expectedAsync:   false,
+		},
+		{
+			name: "maintenance_info_conflict",
+			request: &osb.UpdateInstanceRequest{
+				AcceptsIncomplete: true,
+				InstanceID:        "exists",
+				ServiceID:         "test-service-id",
+			},
+			maintenanceInfo: &MaintenanceInfo{Version: "3.0.0"},
+			expectedErr:     newHTTPStatusCodeError(http.StatusUnprocessableEntity, "MaintenanceInfoConflict", "The maintenance_info version 3.0.0 does not match the plan version 2.0.0."),
+		},
 		{
 			name: "error_updating_instance",
 			request: &osb.UpdateInstanceRequest{
@@ -905,8 +2185,15 @@ func TestUpdate(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
 			b.db.DataStorePort = mockDataStoreProvision{}
+			b.templatesource = S3TemplateSource{Region: "us-east-1", S3: S3Client{Client: mockS3{HeadObjectResp: s3.HeadObjectOutput{VersionId: aws.String("v2")}}}}
+
+			c := &broker.RequestContext{}
+			if tt.maintenanceInfo != nil {
+				r := httptest.NewRequest(http.MethodPatch, "/v2/service_instances/"+tt.request.InstanceID, nil)
+				c.Request = r.WithContext(context.WithValue(r.Context(), maintenanceInfoKey{}, tt.maintenanceInfo))
+			}
 
-			resp, err := b.Update(tt.request, &broker.RequestContext{})
+			resp, err := b.Update(tt.request, c)
 			if tt.expectedErr != nil {
 				assert.EqualError(t, err, tt.expectedErr.Error())
 			} else if assert.NoError(t, err) {
@@ -12,7 +12,15 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -53,7 +61,7 @@ func AwsDdbClientGetter(sess *session.Session) *dynamodb.DynamoDB {
 	return dynamodb.New(sess)
 }
 
-func AwsStsClientGetter(sess *session.Session) *sts.STS {
+func AwsStsClientGetter(sess *session.Session) stsiface.STSAPI {
 	return sts.New(sess)
 }
 
@@ -61,6 +69,22 @@ func AwsIamClientGetter(sess *session.Session) iamiface.IAMAPI {
 	return iam.New(sess)
 }
 
+func AwsSqsClientGetter(sess *session.Session) sqsiface.SQSAPI {
+	return sqs.New(sess)
+}
+
+func AwsSnsClientGetter(sess *session.Session) snsiface.SNSAPI {
+	return sns.New(sess)
+}
+
+func AwsKmsClientGetter(sess *session.Session) kmsiface.KMSAPI {
+	return kms.New(sess)
+}
+
+func AwsSecretsManagerClientGetter(sess *session.Session) secretsmanageriface.SecretsManagerAPI {
+	return secretsmanager.New(sess)
+}
+
 func GetCallerId(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, error) {
 	return svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
 }
@@ -2,14 +2,12 @@ package broker
 
 import (
 	"fmt"
-	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/awslabs/aws-servicebroker/pkg/dynamodbadapter"
 	"github.com/go-errors/errors"
 	"github.com/golang/glog"
@@ -54,14 +52,17 @@ func NewAWSBroker(o Options, awssess GetAwsSession, clients AwsClients, getCalle
 	var catalogcache = cache.NewMemoryWithTTL(time.Duration(CacheTTL))
 	var listingcache = cache.NewMemoryWithTTL(time.Duration(CacheTTL))
 	listingcache.StartGC(time.Minute * 5)
-	bd := &BucketDetailsRequest{
-		o.S3Bucket,
-		o.S3Key,
-		o.TemplateFilter,
+	source, err := newTemplateSource(o, s3svc)
+	if err != nil {
+		return &AwsBroker{}, err
+	}
+	oidcIssuers, err := parseOIDCIssuers(o.OIDCIssuers)
+	if err != nil {
+		return &AwsBroker{}, err
 	}
 
 	// populate broker variables
-	bl := AwsBroker{
+	bl := &AwsBroker{
 		accountId:          accountid,
 		keyid:              o.KeyID,
 		secretkey:          o.SecretKey,
@@ -73,6 +74,11 @@ func NewAWSBroker(o Options, awssess GetAwsSession, clients AwsClients, getCalle
 		templatefilter:     o.TemplateFilter,
 		region:             o.Region,
 		s3svc:              s3svc,
+		templatesource:     source,
+		templateworkers:    o.TemplateWorkers,
+		catalogfallback:    o.CatalogFallback,
+		catalogmutex:       &sync.Mutex{},
+		updateCatalog:      updateCatalog,
 		catalogcache:       catalogcache,
 		listingcache:       listingcache,
 		brokerid:           o.BrokerID,
@@ -81,84 +87,306 @@ func NewAWSBroker(o Options, awssess GetAwsSession, clients AwsClients, getCalle
 		Clients:            clients,
 		prescribeOverrides: o.PrescribeOverrides,
 		globalOverrides:    getGlobalOverrides(o.BrokerID),
+		oidcIssuers:        oidcIssuers,
 	}
 
-	// get catalog and setup periodic updates from S3
-	err = updateCatalog(listingcache, catalogcache, *bd, s3svc, db, bl, ListTemplates, ListingUpdate, MetadataUpdate)
-	if err != nil {
+	// get catalog and setup periodic updates from the template source
+	bl.catalogmutex.Lock()
+	err = updateCatalog(listingcache, catalogcache, source, db, bl, ListTemplates, ListingUpdate, MetadataUpdate)
+	bl.catalogmutex.Unlock()
+	if _, ok := err.(TemplateErrors); ok {
+		// templates that fail to load are left out of the catalog, but shouldn't stop the broker from starting
+		glog.Errorln(err)
+	} else if err != nil {
 		return &AwsBroker{}, err
 	}
-	go pollUpdate(600, listingcache, catalogcache, *bd, s3svc, db, bl, updateCatalog, ListTemplates)
-	return &bl, nil
+	pollInterval := o.PollInterval
+	if pollInterval < 1 {
+		pollInterval = 600
+	}
+	if o.SQSQueueURL != "" {
+		s3source, ok := source.(S3TemplateSource)
+		if !ok {
+			return &AwsBroker{}, errors.New("sqsQueueUrl can only be used when templates are loaded from S3")
+		}
+		go ListenTemplateEvents(o.SQSQueueURL, clients.NewSqs(s3sess), s3source, bl)
+	}
+	go pollUpdate(pollInterval, listingcache, catalogcache, source, db, bl, updateCatalog, ListTemplates)
+	return bl, nil
 }
 
-func UpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
-	l, err := listTemplates(&bd, &bl)
+func UpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, source TemplateSource, db Db, bl *AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+	l, err := listTemplates(source)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "NoSuchBucket: The specified bucket does not exist") {
-			return errors.New("Cannot access S3 Bucket, either it does not exist or the IAM user/role the broker is configured to use has no access to the bucket")
+			err = errors.New("Cannot access S3 Bucket, either it does not exist or the IAM user/role the broker is configured to use has no access to the bucket")
+		}
+		if bl.catalogfallback {
+			glog.Errorf("Failed to list templates, falling back to stored service definitions: %v", err)
+			if werr := warmCatalog(listingcache, catalogcache, db); werr != nil {
+				glog.Errorln(werr)
+				return err
+			}
+			return nil
 		}
 		return err
 	}
+	previous, _ := listingcache.Get("__LISTINGS__")
 	err = listingUpdate(l, listingcache)
 	if err != nil {
 		return err
 	}
-	err = metadataUpdate(listingcache, catalogcache, bd, s3svc, db, MetadataUpdate, bl.templatefilter)
+	err = metadataUpdate(listingcache, catalogcache, source, db, MetadataUpdate, bl.templateworkers)
+	if _, ok := err.(TemplateErrors); err != nil && !ok {
+		return err
+	}
+	if perr := pruneCatalog(l, previous, listingcache, catalogcache, db); perr != nil {
+		return perr
+	}
+	return err
+}
+
+// warmCatalog rebuilds the catalog from the service definitions stored in the DataStore, so that the catalog can
+// still be served while the template source is unavailable
+func warmCatalog(listingcache cache.Cache, catalogcache cache.Cache, db Db) error {
+	services, err := db.DataStorePort.GetServiceDefinitions()
+	if err != nil {
+		return err
+	} else if len(services) == 0 {
+		return errors.New("no stored service definitions to fall back to")
+	}
+	var listings []ServiceNeedsUpdate
+	for _, sd := range services {
+		catalogcache.Set(sd.Name, sd)
+		listings = append(listings, ServiceNeedsUpdate{Name: sd.Name, Update: false})
+	}
+	glog.Infof("Loaded %d stored service definitions into the catalog", len(listings))
+	listingcache.Set("__LISTINGS__", listings)
+	return nil
+}
+
+// pruneCatalog removes services whose templates are no longer listed by the template source. Their definitions are
+// tombstoned in the DataStore rather than deleted, so that existing instances can still be updated, bound and
+// deprovisioned
+func pruneCatalog(l *[]ServiceLastUpdate, previous interface{}, listingcache cache.Cache, catalogcache cache.Cache, db Db) error {
+	if len(*l) == 0 {
+		glog.Warningln("No templates were listed, skipping catalog pruning")
+		return nil
+	}
+
+	// listed holds both template names and the service names they define, as a template that failed to load may
+	// not be in the catalog cache
+	listed := make(map[string]bool)
+	for _, item := range *l {
+		listed[item.Name] = true
+		if sd, err := catalogcache.Get(item.Name); err == nil {
+			listed[sd.(osb.Service).Name] = true
+		}
+	}
+
+	if previous != nil {
+		for _, item := range previous.([]ServiceNeedsUpdate) {
+			if !listed[item.Name] {
+				glog.Infof("Template %q is no longer listed, removing it from the catalog", item.Name)
+				listingcache.Delete(item.Name)
+				catalogcache.Delete(item.Name)
+			}
+		}
+	}
+
+	services, err := db.DataStorePort.GetServiceDefinitions()
 	if err != nil {
 		return err
 	}
+	for _, sd := range services {
+		if listed[sd.Name] {
+			continue
+		}
+		glog.Infof("Tombstoning service definition %q as its template is no longer listed", sd.Name)
+		if err := db.DataStorePort.TombstoneServiceDefinition(sd.ID); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func PollUpdate(interval int, l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser) {
+func PollUpdate(interval int, l cache.Cache, c cache.Cache, source TemplateSource, db Db, bl *AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser) {
 	for {
 		time.Sleep(time.Duration(interval) * time.Second)
-		go updateCatalog(l, c, bd, s3svc, db, bl, listTemplates, ListingUpdate, MetadataUpdate)
+		go func() {
+			bl.catalogmutex.Lock()
+			defer bl.catalogmutex.Unlock()
+			updateCatalog(l, c, source, db, bl, listTemplates, ListingUpdate, MetadataUpdate)
+		}()
 	}
 }
 
-func MetadataUpdate(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error {
-	data, err := l.Get("__LISTINGS__")
-	if err != nil {
-		return err
+// RefreshCatalog updates the catalog from the template source immediately and summarises what changed. Only templates
+// whose content changed are reported as updated. Templates that failed to load are listed in the summary, and the
+// TemplateErrors are also returned
+func (b *AwsBroker) RefreshCatalog() (*CatalogUpdateSummary, error) {
+	b.catalogmutex.Lock()
+	defer b.catalogmutex.Unlock()
+
+	before := make(map[string]bool)
+	if l, err := b.listingcache.Get("__LISTINGS__"); err == nil {
+		for _, item := range l.([]ServiceNeedsUpdate) {
+			before[item.Name] = true
+		}
 	}
-	for _, item := range data.([]ServiceNeedsUpdate) {
-		if item.Update {
-			file, err := getObjectBody(s3svc, bd.bucket, bd.prefix+item.Name+templatefilter)
-			if err != nil {
-				glog.Errorln(err)
+
+	b.listingcache.Delete("__CHANGED__")
+	err := b.updateCatalog(b.listingcache, b.catalogcache, b.templatesource, b.db, b, ListTemplates, ListingUpdate, MetadataUpdate)
+	templateErrs, ok := err.(TemplateErrors)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	summary := CatalogUpdateSummary{Added: []string{}, Updated: []string{}, Removed: []string{}}
+	for name, terr := range templateErrs {
+		if summary.Failed == nil {
+			summary.Failed = make(map[string]string)
+		}
+		summary.Failed[name] = terr.Error()
+	}
+	changed := make(map[string]bool)
+	if c, err := b.listingcache.Get("__CHANGED__"); err == nil {
+		for _, name := range c.([]string) {
+			changed[name] = true
+		}
+	}
+	after := make(map[string]bool)
+	if l, err := b.listingcache.Get("__LISTINGS__"); err == nil {
+		for _, item := range l.([]ServiceNeedsUpdate) {
+			after[item.Name] = true
+			if _, failed := templateErrs[item.Name]; failed {
 				continue
 			}
-			if err := templateToServiceDefinition(file, db, c, item); err != nil {
-				glog.Errorln(err)
-			}
-		} else {
-			i, err := c.Get(item.Name)
-			if err != nil {
-				glog.Errorln(err)
-			} else {
-				c.Set(item.Name, i)
+			if !before[item.Name] {
+				summary.Added = append(summary.Added, item.Name)
+			} else if changed[item.Name] {
+				summary.Updated = append(summary.Updated, item.Name)
 			}
 		}
 	}
+	for name := range before {
+		if !after[name] {
+			summary.Removed = append(summary.Removed, name)
+		}
+	}
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Updated)
+	sort.Strings(summary.Removed)
+	glog.Infof("Catalog refreshed: %+v", summary)
+	return &summary, err
+}
+
+func MetadataUpdate(l cache.Cache, c cache.Cache, source TemplateSource, db Db, metadataUpdate MetadataUpdater, workers int) error {
+	data, err := l.Get("__LISTINGS__")
+	if err != nil {
+		return err
+	}
+	return updateServiceDefinitions(data.([]ServiceNeedsUpdate), l, c, source, db, workers)
+}
+
+// updateServiceDefinitions fetches and converts the listed templates in parallel, collecting the errors for each
+// template. The names of the templates whose service definition changed are stored under __CHANGED__ in the listing
+// cache
+func updateServiceDefinitions(listings []ServiceNeedsUpdate, l cache.Cache, c cache.Cache, source TemplateSource, db Db, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	errs := make(TemplateErrors)
+	changed := make([]string, 0)
+	items := make(chan ServiceNeedsUpdate)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				updated, err := updateServiceDefinition(item, l, c, source, db)
+				mutex.Lock()
+				if err != nil {
+					glog.Errorf("Failed to update service definition %q: %v", item.Name, err)
+					errs[item.Name] = err
+				} else if updated {
+					changed = append(changed, item.Name)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, item := range listings {
+		items <- item
+	}
+	close(items)
+	wg.Wait()
+
+	sort.Strings(changed)
+	glog.Infof("Service definitions changed: %v", changed)
+	l.Set("__CHANGED__", changed)
+
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
+func updateServiceDefinition(item ServiceNeedsUpdate, l cache.Cache, c cache.Cache, source TemplateSource, db Db) (bool, error) {
+	if !item.Update {
+		i, err := c.Get(item.Name)
+		if err == nil {
+			c.Set(item.Name, i)
+			return false, nil
+		}
+		// the service definition expired from the catalog cache, so the template is converted again
+		glog.Infof("Service definition %q is not cached, converting its template", item.Name)
+	}
+	var updated bool
+	file, err := source.GetTemplate(item.Name)
+	if err == nil {
+		updated, err = templateToServiceDefinition(file, db, c, item)
+	}
+	if err != nil {
+		// forget the listing date so that the template is retried on the next update
+		l.Delete(item.Name)
+		return false, err
+	}
+	return updated, nil
+}
+
+// Error lists the templates that failed to load, sorted by name
+func (e TemplateErrors) Error() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var msgs []string
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e[name]))
+	}
+	return fmt.Sprintf("failed to load %d template(s): %s", len(e), strings.Join(msgs, "; "))
+}
+
 func ListingUpdate(l *[]ServiceLastUpdate, c cache.Cache) error {
 	var services []ServiceNeedsUpdate
 	for _, item := range *l {
 		data, err := c.Get(item.Name)
 		if err != nil {
 			if err.Error() == "not found" {
-				c.Set(item.Name, item.Date)
+				c.Set(item.Name, item)
 				services = append(services, ServiceNeedsUpdate{Name: item.Name, Update: true})
 			} else {
 				return err
 			}
 		} else {
-			if data.(time.Time).Unix() < item.Date.Unix() {
-				c.Set(item.Name, item.Date)
+			// unchanged templates are set again, so that they aren't fetched once their listing expires
+			c.Set(item.Name, item)
+			if templateChanged(data.(ServiceLastUpdate), item) {
 				services = append(services, ServiceNeedsUpdate{Name: item.Name, Update: true})
 			} else {
 				services = append(services, ServiceNeedsUpdate{Name: item.Name, Update: false})
@@ -170,37 +398,18 @@ func ListingUpdate(l *[]ServiceLastUpdate, c cache.Cache) error {
 	return nil
 }
 
-func ListTemplates(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
-	glog.Infoln("Listing objects bucket: " + s3source.bucket + " region: " + b.s3region + " prefix: " + s3source.prefix)
-	ListResponse, err := b.s3svc.Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(s3source.bucket),
-		Prefix: aws.String(s3source.prefix),
-	})
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			fmt.Fprintf(os.Stderr, "upload canceled due to timeout, %v\n", err)
-		} else {
-			fmt.Fprintf(os.Stderr, "failed to list objects, %v\n", err)
-		}
-		return nil, err
-	}
-	numberOfRecords := 0
-	for _, s3obj := range ListResponse.Contents {
-		if strings.HasSuffix(*s3obj.Key, s3source.suffix) {
-			numberOfRecords = numberOfRecords + 1
-		}
-	}
-	glog.Infof("Found %x objects\n", numberOfRecords)
-	s := make([]ServiceLastUpdate, 0, numberOfRecords)
-	for _, s3obj := range ListResponse.Contents {
-		if strings.HasSuffix(*s3obj.Key, s3source.suffix) {
-			s = append(s, ServiceLastUpdate{
-				Name: strings.TrimSuffix(strings.TrimPrefix(*s3obj.Key, s3source.prefix), s3source.suffix),
-				Date: *s3obj.LastModified,
-			})
-		}
+// templateChanged reports whether a listed template differs from the one that was last loaded, templates listed with an
+// ETag are compared by it, others by their last updated date
+func templateChanged(last ServiceLastUpdate, item ServiceLastUpdate) bool {
+	if item.ETag != "" {
+		return item.ETag != last.ETag
 	}
-	return &s, nil
+	return last.Date.Unix() < item.Date.Unix()
+}
+
+// ListTemplates lists the templates available in the template source
+func ListTemplates(source TemplateSource) (*[]ServiceLastUpdate, error) {
+	return source.ListTemplates()
 }
 
 // ValidateBrokerAPIVersion still to determine supported api versions
@@ -226,6 +435,8 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 		Description: stripTemplateID(sd.Description),
 		Tags:        sd.Metadata.Spec.Tags,
 		Bindable:    true,
+		// bindings are fetched with GetBinding, and polled with BindingLastOperation when they are created asynchronously
+		BindingsRetrievable: true,
 		Metadata: map[string]interface{}{
 			"displayName":         sd.Metadata.Spec.DisplayName,
 			"providerDisplayName": sd.Metadata.Spec.ProviderDisplayName,
@@ -237,9 +448,24 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 		PlanUpdatable: aws.Bool(false),
 	}
 
+	if len(sd.Rules) > 0 {
+		outp.Metadata["cfnRules"] = sd.Rules
+	}
+	if spec := toBindingSpec(sd); spec != nil {
+		outp.Metadata["bindings"] = spec
+	}
+
 	var plans []osb.Plan
 	params := cfnParamsToOsb(sd)
-	for k, p := range sd.Metadata.Spec.ServicePlans {
+	bindingSchema := toBindingSchema(sd, &outp)
+	// plans and parameters are converted in a fixed order, so that the definition hash only changes with the template
+	planNames := make([]string, 0, len(sd.Metadata.Spec.ServicePlans))
+	for k := range sd.Metadata.Spec.ServicePlans {
+		planNames = append(planNames, k)
+	}
+	sort.Strings(planNames)
+	for _, k := range planNames {
+		p := sd.Metadata.Spec.ServicePlans[k]
 		planid := uuid.NewV5(db.Accountuuid, "service__"+sd.Metadata.Spec.Name+"__plan__"+k).String()
 		plan := osb.Plan{
 			ID:          planid,
@@ -252,11 +478,15 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 				"displayName":     p.DisplayName,
 				"longDescription": p.LongDescription,
 			},
-			Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{}},
+			Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{}, ServiceBinding: bindingSchema},
+		}
+		if mi := toMaintenanceInfo(sd.Metadata.Spec.Version); mi != nil {
+			plan.Metadata["maintenance_info"] = mi
 		}
 		propsForCreate := make(map[string]interface{})
 		var openshiftFormCreate []OpenshiftFormDefinition
-		for nk, nv := range nonCfnParamDefs {
+		for _, nk := range sortedKeys(nonCfnParamDefs) {
+			nv := nonCfnParamDefs[nk]
 			openshiftFormCreate = openshiftFormAppend(openshiftFormCreate, nk, nv.(map[string]interface{}))
 			nonCfnParam := make(map[string]interface{})
 			for nnk, nnv := range nv.(map[string]interface{}) {
@@ -271,7 +501,8 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 		requiredForUpdate := make([]string, 0)
 		prescribed := make(map[string]string)
 		var openshiftFormUpdate []OpenshiftFormDefinition
-		for paramName, paramValue := range params {
+		for _, paramName := range sortedKeys(params) {
+			paramValue := params[paramName]
 			include := true
 			for planParam, planValue := range p.ParameterValues {
 				if planParam == paramName {
@@ -292,7 +523,7 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 				for planDefaultParam, planDefaultValue := range p.ParameterDefaults {
 					if planDefaultParam == paramName {
 						glog.V(10).Infof("Updating default with plan default for plan %q param %q\n", k, paramName)
-						createParam["default"] = planDefaultValue
+						createParam["default"] = cfnValueToSchema(createParam, planDefaultValue)
 					}
 				}
 				for _, v := range []string{"required", "display_group"} {
@@ -332,22 +563,28 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 			// Cloud Foundry does not allow "required" to be an empty slice
 			plan.Schemas.ServiceInstance.Create.Parameters.(map[string]interface{})["required"] = requiredForCreate
 		}
-		if len(propsForUpdate) > 0 {
-			plan.Schemas.ServiceInstance.Update = &osb.InputParametersSchema{
-				Parameters: map[string]interface{}{
-					"type":       "object",
-					"properties": propsForUpdate,
-					"$schema":    "http://json-schema.org/draft-06/schema#",
-					"prescribed": prescribed,
-				},
-			}
-			if len(openshiftFormUpdate) > 0 {
-				plan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})["openshift_form_definition"] = openshiftFormCreate
-			}
-			if len(requiredForUpdate) > 0 {
-				// Cloud Foundry does not allow "required" to be an empty slice
-				plan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})["required"] = requiredForUpdate
-			}
+		addRuleSchemas(plan.Schemas.ServiceInstance.Create, sd.Rules, propsForCreate)
+		plan.Schemas.ServiceInstance.Update = &osb.InputParametersSchema{
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": propsForUpdate,
+				"$schema":    "http://json-schema.org/draft-06/schema#",
+				"prescribed": prescribed,
+			},
+		}
+		if len(openshiftFormUpdate) > 0 {
+			plan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})["openshift_form_definition"] = openshiftFormCreate
+		}
+		if len(requiredForUpdate) > 0 {
+			// Cloud Foundry does not allow "required" to be an empty slice
+			plan.Schemas.ServiceInstance.Update.Parameters.(map[string]interface{})["required"] = requiredForUpdate
+		}
+		addRuleSchemas(plan.Schemas.ServiceInstance.Update, sd.Rules, propsForUpdate)
+		// added after the rules, which only apply to template parameters
+		propsForUpdate[updateParamUpgradeTemplate] = map[string]interface{}{
+			"type":        "boolean",
+			"title":       "Upgrade template",
+			"description": "Upgrade the stack to the latest version of the template",
 		}
 		plans = append(plans, plan)
 	}
@@ -356,10 +593,17 @@ func (db Db) ServiceDefinitionToOsb(sd CfnTemplate) osb.Service {
 	return outp
 }
 
-func (b *AwsBroker) generateS3HTTPUrl(serviceDefName string) *string {
-	prefix := "https://s3.amazonaws.com/"
-	if b.s3region != "us-east-1" {
-		prefix = fmt.Sprintf("https://s3-%s.amazonaws.com/", b.s3region)
+// addRuleSchemas adds the template rules that can be expressed as if/then schemas to the parameters schema, which
+// requires JSON Schema draft-07
+func addRuleSchemas(schema *osb.InputParametersSchema, rules map[string]interface{}, properties map[string]interface{}) {
+	if ruleSchemas := cfnRulesToSchema(rules, properties); len(ruleSchemas) > 0 {
+		schema.Parameters.(map[string]interface{})["allOf"] = ruleSchemas
+		schema.Parameters.(map[string]interface{})["$schema"] = "http://json-schema.org/draft-07/schema#"
 	}
-	return aws.String(prefix + b.s3bucket + "/" + b.s3key + strings.TrimSuffix(serviceDefName, "-apb") + b.templatefilter)
+}
+
+// getTemplateLocation returns either the url or the body of the latest template to pass to CloudFormation, and its
+// version
+func (b *AwsBroker) getTemplateLocation(serviceDefName string) (templateURL *string, templateBody *string, version string, err error) {
+	return b.templatesource.TemplateLocation(strings.TrimSuffix(serviceDefName, "-apb"))
 }
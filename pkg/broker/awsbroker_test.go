@@ -2,10 +2,12 @@ package broker
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -59,10 +61,33 @@ func mockAwsCfnClientGetter(sess *session.Session) CfnClient {
 	}}
 }
 
-func mockAwsStsClientGetter(sess *session.Session) *sts.STS {
-	conf := aws.NewConfig()
-	conf.Region = sess.Config.Region
-	return &sts.STS{Client: mock.NewMockClient(conf)}
+type mockSTS struct {
+	stsiface.STSAPI
+}
+
+func (c *mockSTS) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{
+		Account: aws.String("123456789012"),
+		Arn:     aws.String("arn:aws:sts::123456789012:assumed-role/broker/session"),
+	}, nil
+}
+
+func (c *mockSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	if strings.Contains(aws.StringValue(input.RoleArn), "fail") {
+		return nil, errors.New("test failure")
+	} else if aws.StringValue(input.Policy) != `{"Version":"2012-10-17"}` {
+		return nil, errors.New("unexpected session policy")
+	}
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String("temporary-key-id"),
+		SecretAccessKey: aws.String("temporary-secret-key"),
+		SessionToken:    aws.String("session-token"),
+		Expiration:      aws.Time(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)),
+	}}, nil
+}
+
+func mockAwsStsClientGetter(sess *session.Session) stsiface.STSAPI {
+	return &mockSTS{}
 }
 
 func mockAwsS3ClientGetter(sess *session.Session) S3Client {
@@ -82,7 +107,8 @@ type mockIAM struct {
 }
 
 func (c *mockIAM) AttachRolePolicy(input *iam.AttachRolePolicyInput) (*iam.AttachRolePolicyOutput, error) {
-	if aws.StringValue(input.RoleName) != "exists" || aws.StringValue(input.PolicyArn) != "exists" {
+	roleName := aws.StringValue(input.RoleName)
+	if (roleName != "exists" && !strings.HasPrefix(roleName, "asb-")) || aws.StringValue(input.PolicyArn) != "exists" {
 		return nil, errors.New("test failure")
 	}
 	return &iam.AttachRolePolicyOutput{}, nil
@@ -97,6 +123,132 @@ func (c *mockIAM) DetachRolePolicy(input *iam.DetachRolePolicyInput) (*iam.Detac
 	return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "", nil)
 }
 
+func (c *mockIAM) CreateRole(input *iam.CreateRoleInput) (*iam.CreateRoleOutput, error) {
+	if strings.Contains(aws.StringValue(input.RoleName), "err") {
+		return nil, errors.New("test failure")
+	}
+	return &iam.CreateRoleOutput{Role: &iam.Role{
+		RoleName: input.RoleName,
+		Arn:      aws.String("arn:aws:iam::123456789012:role/aws-service-broker/" + aws.StringValue(input.RoleName)),
+	}}, nil
+}
+
+func (c *mockIAM) GetRole(input *iam.GetRoleInput) (*iam.GetRoleOutput, error) {
+	// roles created for bindings are in the broker's path
+	path := "/"
+	if strings.HasPrefix(aws.StringValue(input.RoleName), "asb-") {
+		path = bindingIAMPath
+	}
+	return &iam.GetRoleOutput{Role: &iam.Role{
+		RoleName: input.RoleName,
+		Arn:      aws.String("arn:aws:iam::123456789012:role" + path + aws.StringValue(input.RoleName)),
+	}}, nil
+}
+
+func (c *mockIAM) ListAttachedRolePolicies(input *iam.ListAttachedRolePoliciesInput) (*iam.ListAttachedRolePoliciesOutput, error) {
+	if aws.StringValue(input.RoleName) == "asb-err" {
+		return nil, errors.New("test failure")
+	}
+	return &iam.ListAttachedRolePoliciesOutput{AttachedPolicies: []*iam.AttachedPolicy{{PolicyArn: aws.String("exists")}}}, nil
+}
+
+func (c *mockIAM) DeleteRole(input *iam.DeleteRoleInput) (*iam.DeleteRoleOutput, error) {
+	return &iam.DeleteRoleOutput{}, nil
+}
+
+func (c *mockIAM) GetPolicy(input *iam.GetPolicyInput) (*iam.GetPolicyOutput, error) {
+	return &iam.GetPolicyOutput{Policy: &iam.Policy{Arn: input.PolicyArn, DefaultVersionId: aws.String("v1")}}, nil
+}
+
+func (c *mockIAM) GetPolicyVersion(input *iam.GetPolicyVersionInput) (*iam.GetPolicyVersionOutput, error) {
+	return &iam.GetPolicyVersionOutput{PolicyVersion: &iam.PolicyVersion{
+		Document:  aws.String("%7B%22Version%22%3A%222012-10-17%22%7D"),
+		VersionId: input.VersionId,
+	}}, nil
+}
+
+func (c *mockIAM) CreateUser(input *iam.CreateUserInput) (*iam.CreateUserOutput, error) {
+	if strings.Contains(aws.StringValue(input.UserName), "err") {
+		return nil, errors.New("test failure")
+	}
+	return &iam.CreateUserOutput{User: &iam.User{UserName: input.UserName}}, nil
+}
+
+func (c *mockIAM) PutUserPolicy(input *iam.PutUserPolicyInput) (*iam.PutUserPolicyOutput, error) {
+	if strings.Contains(aws.StringValue(input.PolicyDocument), "${") {
+		return nil, errors.New("unresolved placeholder")
+	}
+	return &iam.PutUserPolicyOutput{}, nil
+}
+
+func (c *mockIAM) AttachUserPolicy(input *iam.AttachUserPolicyInput) (*iam.AttachUserPolicyOutput, error) {
+	if aws.StringValue(input.PolicyArn) != "exists" {
+		return nil, errors.New("test failure")
+	}
+	return &iam.AttachUserPolicyOutput{}, nil
+}
+
+func (c *mockIAM) ListAttachedUserPolicies(input *iam.ListAttachedUserPoliciesInput) (*iam.ListAttachedUserPoliciesOutput, error) {
+	return &iam.ListAttachedUserPoliciesOutput{AttachedPolicies: []*iam.AttachedPolicy{{PolicyArn: aws.String("exists")}}}, nil
+}
+
+func (c *mockIAM) DetachUserPolicy(input *iam.DetachUserPolicyInput) (*iam.DetachUserPolicyOutput, error) {
+	if aws.StringValue(input.UserName) == "err" {
+		return nil, errors.New("test failure")
+	}
+	return &iam.DetachUserPolicyOutput{}, nil
+}
+
+func (c *mockIAM) AttachGroupPolicy(input *iam.AttachGroupPolicyInput) (*iam.AttachGroupPolicyOutput, error) {
+	if aws.StringValue(input.GroupName) != "exists" || aws.StringValue(input.PolicyArn) != "exists" {
+		return nil, errors.New("test failure")
+	}
+	return &iam.AttachGroupPolicyOutput{}, nil
+}
+
+func (c *mockIAM) DetachGroupPolicy(input *iam.DetachGroupPolicyInput) (*iam.DetachGroupPolicyOutput, error) {
+	if aws.StringValue(input.GroupName) == "err" {
+		return nil, errors.New("test failure")
+	} else if aws.StringValue(input.GroupName) == "exists" {
+		return &iam.DetachGroupPolicyOutput{}, nil
+	}
+	return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "", nil)
+}
+
+func (c *mockIAM) CreateAccessKey(input *iam.CreateAccessKeyInput) (*iam.CreateAccessKeyOutput, error) {
+	return &iam.CreateAccessKeyOutput{AccessKey: &iam.AccessKey{
+		UserName:        input.UserName,
+		AccessKeyId:     aws.String("key-id"),
+		SecretAccessKey: aws.String("secret-key"),
+	}}, nil
+}
+
+func (c *mockIAM) ListAccessKeys(input *iam.ListAccessKeysInput) (*iam.ListAccessKeysOutput, error) {
+	switch aws.StringValue(input.UserName) {
+	case "asb-err":
+		return nil, errors.New("test failure")
+	case "asb-foo":
+		return nil, awserr.New(iam.ErrCodeNoSuchEntityException, "", nil)
+	}
+	return &iam.ListAccessKeysOutput{AccessKeyMetadata: []*iam.AccessKeyMetadata{{AccessKeyId: aws.String("key-id")}}}, nil
+}
+
+func (c *mockIAM) DeleteAccessKey(input *iam.DeleteAccessKeyInput) (*iam.DeleteAccessKeyOutput, error) {
+	return &iam.DeleteAccessKeyOutput{}, nil
+}
+
+func (c *mockIAM) ListUserPolicies(input *iam.ListUserPoliciesInput) (*iam.ListUserPoliciesOutput, error) {
+	return &iam.ListUserPoliciesOutput{PolicyNames: aws.StringSlice([]string{"binding-policy-0"})}, nil
+}
+
+func (c *mockIAM) DeleteUserPolicy(input *iam.DeleteUserPolicyInput) (*iam.DeleteUserPolicyOutput, error) {
+	return &iam.DeleteUserPolicyOutput{}, nil
+}
+
+func (c *mockIAM) DeleteUser(input *iam.DeleteUserInput) (*iam.DeleteUserOutput, error) {
+	return &iam.DeleteUserOutput{}, nil
+}
+
 func mockAwsIamClientGetter(sess *session.Session) iamiface.IAMAPI {
 	return &mockIAM{}
 }
@@ -131,6 +283,11 @@ var mockClients = AwsClients{
 	NewS3:  mockAwsS3ClientGetter,
 	NewSsm: mockAwsSsmClientGetter,
 	NewSts: mockAwsStsClientGetter,
+	NewSqs: mockAwsSqsClientGetter,
+	NewSns: mockAwsSnsClientGetter,
+	NewKms: mockAwsKmsClientGetter,
+
+	NewSecretsManager: mockAwsSecretsManagerClientGetter,
 }
 
 func mockGetAccountID(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, error) {
@@ -141,22 +298,26 @@ func mockGetAccountIDFail(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, er
 	return &sts.GetCallerIdentityOutput{}, errors.New("I should be failing")
 }
 
-func mockUpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+func mockUpdateCatalog(listingcache cache.Cache, catalogcache cache.Cache, source TemplateSource, db Db, bl *AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
 	return nil
 }
 
-func mockUpdateCatalogFail(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+func mockUpdateCatalogFail(listingcache cache.Cache, catalogcache cache.Cache, source TemplateSource, db Db, bl *AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
 	return errors.New("I failed")
 }
 
-func mockPollUpdate(interval int, l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser) {
+func mockUpdateCatalogTemplateErrors(listingcache cache.Cache, catalogcache cache.Cache, source TemplateSource, db Db, bl *AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+	return TemplateErrors{"test-service": errors.New("bad template")}
+}
+
+func mockPollUpdate(interval int, l cache.Cache, c cache.Cache, source TemplateSource, db Db, bl *AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser) {
 
 }
 
 // mock implementation of DataStore Adapter
 type mockDataStore struct{}
 
-func (db mockDataStore) PutServiceDefinition(sd osb.Service) error                   { return nil }
+func (db mockDataStore) PutServiceDefinition(sd osb.Service, definitionHash string) error { return nil }
 func (db mockDataStore) GetParam(paramname string) (value string, err error)         { return "some-value", nil }
 func (db mockDataStore) PutParam(paramname string, paramvalue string) error          { return nil }
 func (db mockDataStore) PutServiceInstance(si serviceinstance.ServiceInstance) error { return nil }
@@ -180,6 +341,12 @@ func (db mockDataStore) GetServiceDefinition(serviceuuid string) (*osb.Service,
 	}
 	return &service, nil
 }
+func (db mockDataStore) GetServiceDefinitionHash(serviceuuid string) (string, error) { return "", nil }
+func (db mockDataStore) IsServiceDefinitionTombstoned(serviceuuid string) (bool, error) {
+	return false, nil
+}
+func (db mockDataStore) GetServiceDefinitions() ([]osb.Service, error)      { return nil, nil }
+func (db mockDataStore) TombstoneServiceDefinition(serviceuuid string) error { return nil }
 func (db mockDataStore) GetServiceInstance(sid string) (*serviceinstance.ServiceInstance, error) {
 	si := serviceinstance.ServiceInstance{
 		ID:        "",
@@ -230,18 +397,22 @@ func TestNewAwsBroker(t *testing.T) {
 		// Should error
 		_, err = NewAWSBroker(v, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalogFail, mockPollUpdate)
 		assert.Error(err)
+
+		// Shouldn't error when only some templates fail to load
+		_, err = NewAWSBroker(v, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalogTemplateErrors, mockPollUpdate)
+		assert.Nil(err)
 	}
 }
 
-func mockListTemplates(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
+func mockListTemplates(source TemplateSource) (*[]ServiceLastUpdate, error) {
 	return &[]ServiceLastUpdate{}, nil
 }
 
-func mockListTemplatesFailNoBucket(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
+func mockListTemplatesFailNoBucket(source TemplateSource) (*[]ServiceLastUpdate, error) {
 	return &[]ServiceLastUpdate{}, errors.New("NoSuchBucket: The specified bucket does not exist")
 }
 
-func mockListTemplatesFail(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error) {
+func mockListTemplatesFail(source TemplateSource) (*[]ServiceLastUpdate, error) {
 	return &[]ServiceLastUpdate{}, errors.New("ListTemplates failed")
 }
 
@@ -253,11 +424,11 @@ func mockListingUpdateFail(l *[]ServiceLastUpdate, c cache.Cache) error {
 	return errors.New("ListingUpdate failed")
 }
 
-func mockMetadataUpdate(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error {
+func mockMetadataUpdate(l cache.Cache, c cache.Cache, source TemplateSource, db Db, metadataUpdate MetadataUpdater, workers int) error {
 	return nil
 }
 
-func mockMetadataUpdateFail(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error {
+func mockMetadataUpdateFail(l cache.Cache, c cache.Cache, source TemplateSource, db Db, metadataUpdate MetadataUpdater, workers int) error {
 	return errors.New("MetadataUpdate failed")
 }
 
@@ -266,43 +437,65 @@ func TestUpdateCatalog(t *testing.T) {
 	options := new(TestCases)
 	options.GetTests("../../testcases/options.yaml")
 	var bl *AwsBroker
-	var bd *BucketDetailsRequest
 	for _, v := range *options {
 		bl, _ = NewAWSBroker(v, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
-		bd = &BucketDetailsRequest{
-			v.S3Bucket,
-			v.S3Key,
-			v.TemplateFilter,
-		}
 	}
 
 	bl.db.DataStorePort = mockDataStore{}
 
-	err := UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplates, mockListingUpdate, mockMetadataUpdate)
+	err := UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplates, mockListingUpdate, mockMetadataUpdate)
 	assert.Nil(err)
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplatesFailNoBucket, mockListingUpdate, mockMetadataUpdate)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplatesFailNoBucket, mockListingUpdate, mockMetadataUpdate)
 	assert.EqualError(err, "Cannot access S3 Bucket, either it does not exist or the IAM user/role the broker is configured to use has no access to the bucket")
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplatesFail, mockListingUpdate, mockMetadataUpdate)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplatesFail, mockListingUpdate, mockMetadataUpdate)
 	assert.EqualError(err, "ListTemplates failed")
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplates, mockListingUpdateFail, mockMetadataUpdate)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplates, mockListingUpdateFail, mockMetadataUpdate)
 	assert.EqualError(err, "ListingUpdate failed")
 
-	err = UpdateCatalog(bl.listingcache, bl.catalogcache, *bd, bl.s3svc, bl.db, *bl, mockListTemplates, mockListingUpdate, mockMetadataUpdateFail)
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplates, mockListingUpdate, mockMetadataUpdateFail)
 	assert.EqualError(err, "MetadataUpdate failed")
+
+	// degraded mode without stored service definitions
+	bl.catalogfallback = true
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplatesFail, mockListingUpdate, mockMetadataUpdate)
+	assert.EqualError(err, "ListTemplates failed", "should fail when there is nothing to fall back to")
+
+	// degraded mode with stored service definitions
+	bl.db.DataStorePort = mockDataStoreCatalog{services: []osb.Service{{ID: "test-id", Name: "test"}}}
+	err = UpdateCatalog(bl.listingcache, bl.catalogcache, bl.templatesource, bl.db, bl, mockListTemplatesFailNoBucket, mockListingUpdate, mockMetadataUpdate)
+	assert.Nil(err, "should fall back to stored service definitions")
+	l, _ := bl.listingcache.Get("__LISTINGS__")
+	assert.Equal([]ServiceNeedsUpdate{{Name: "test", Update: false}}, l)
+	sd, _ := bl.catalogcache.Get("test")
+	assert.Equal(osb.Service{ID: "test-id", Name: "test"}, sd)
 }
 
 type mockS3 struct {
 	s3iface.S3API
-	GetObjectResp s3.GetObjectOutput
+	GetObjectResp      s3.GetObjectOutput
+	HeadObjectResp     s3.HeadObjectOutput
+	ListObjectsV2Resps map[string]s3.ListObjectsV2Output // keyed by continuation token
+}
+
+func (m mockS3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return &m.HeadObjectResp, nil
 }
 
 func (m mockS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
 	return &m.GetObjectResp, nil
 }
 
+func (m mockS3) ListObjectsV2(in *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if aws.StringValue(in.Bucket) == "err" {
+		return nil, errors.New("test failure")
+	}
+	resp := m.ListObjectsV2Resps[aws.StringValue(in.ContinuationToken)]
+	return &resp, nil
+}
+
 type mockCfn struct {
 	cloudformationiface.CloudFormationAPI
 	DescribeStacksResponse      cloudformation.DescribeStacksOutput
@@ -341,35 +534,90 @@ func (m mockCfn) UpdateStack(in *cloudformation.UpdateStackInput) (*cloudformati
 	if aws.StringValue(in.StackName) == "err" {
 		return nil, errors.New("test failure")
 	}
+	if aws.BoolValue(in.UsePreviousTemplate) == (in.TemplateURL != nil || in.TemplateBody != nil) {
+		return nil, errors.New("either the previous template or a new one must be used")
+	}
 	return &m.UpdateStackResponse, nil
 }
 
+// mockStackTemplate is the template version the stacks of the mock instances were created with
+const mockStackTemplate = `
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Name: test-service-name
+    UpdatableParameters: [req_param]
+    ServicePlans:
+      test-plan-name:
+        DisplayName: Test
+Parameters:
+  req_param:
+    Type: String
+Rules:
+  NotForbidden:
+    Assertions:
+    - Assert: !Not [!Equals [!Ref req_param, forbidden]]
+      AssertDescription: req_param can't be forbidden
+`
+
+func (m mockCfn) GetTemplate(in *cloudformation.GetTemplateInput) (*cloudformation.GetTemplateOutput, error) {
+	if aws.StringValue(in.StackName) == "err-template" {
+		return nil, errors.New("test failure")
+	}
+	return &cloudformation.GetTemplateOutput{TemplateBody: aws.String(mockStackTemplate)}, nil
+}
+
 func (m mockCfn) CancelUpdateStack(in *cloudformation.CancelUpdateStackInput) (*cloudformation.CancelUpdateStackOutput, error) {
 	return &cloudformation.CancelUpdateStackOutput{}, nil
 }
 
+func TestRefreshCatalog(t *testing.T) {
+	assert := assert.New(t)
+	bl, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+	bl.listingcache.Set("__LISTINGS__", []ServiceNeedsUpdate{{Name: "kept"}, {Name: "touched"}, {Name: "changed"}, {Name: "removed"}})
+
+	bl.updateCatalog = func(listingcache cache.Cache, catalogcache cache.Cache, source TemplateSource, db Db, bl *AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error {
+		listingcache.Set("__LISTINGS__", []ServiceNeedsUpdate{
+			{Name: "kept", Update: false},
+			{Name: "touched", Update: true},
+			{Name: "changed", Update: true},
+			{Name: "new", Update: true},
+			{Name: "broken", Update: true},
+		})
+		listingcache.Set("__CHANGED__", []string{"changed", "new"})
+		return TemplateErrors{"broken": errors.New("bad template")}
+	}
+	summary, err := bl.RefreshCatalog()
+	assert.EqualError(err, "failed to load 1 template(s): broken: bad template")
+	assert.Equal(&CatalogUpdateSummary{
+		Added:   []string{"new"},
+		Updated: []string{"changed"},
+		Removed: []string{"removed"},
+		Failed:  map[string]string{"broken": "bad template"},
+	}, summary)
+
+	bl.updateCatalog = mockUpdateCatalogFail
+	summary, err = bl.RefreshCatalog()
+	assert.EqualError(err, "I failed")
+	assert.Nil(summary)
+}
+
 func TestMetadataUpdate(t *testing.T) {
 	assert := assert.New(t)
 	options := new(TestCases)
 	options.GetTests("../../testcases/options.yaml")
 	var bl *AwsBroker
-	var bd *BucketDetailsRequest
 	for _, v := range *options {
 		bl, _ = NewAWSBroker(v, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
-		bd = &BucketDetailsRequest{
-			v.S3Bucket,
-			v.S3Key,
-			v.TemplateFilter,
-		}
 	}
 	bl.db.DataStorePort = mockDataStore{}
 
-	s3svc := S3Client{
-		Client: mockS3{GetObjectResp: s3.GetObjectOutput{}},
+	source := S3TemplateSource{
+		Suffix: "-main.yaml",
+		S3:     S3Client{Client: mockS3{GetObjectResp: s3.GetObjectOutput{}}},
 	}
 
 	// test "__LISTINGS__" not in cache
-	err := MetadataUpdate(bl.listingcache, bl.catalogcache, *bd, s3svc, bl.db, MetadataUpdate, "-main.yaml")
+	err := MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate, 2)
 	assert.EqualError(err, "not found")
 
 	// test empty s3 body
@@ -379,20 +627,137 @@ func TestMetadataUpdate(t *testing.T) {
 		Update: true,
 	})
 	bl.listingcache.Set("__LISTINGS__", serviceUpdates)
-	err = MetadataUpdate(bl.listingcache, bl.catalogcache, *bd, s3svc, bl.db, MetadataUpdate, "-main.yaml")
-	assert.Equal(err, nil, "should handle empty s3 objects without erroring")
+	bl.listingcache.Set("test-service", ServiceLastUpdate{Name: "test-service", Date: time.Now()})
+	err = MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate, 2)
+	assert.EqualError(err, "failed to load 1 template(s): test-service: s3 object body missing", "should collect the error for empty s3 objects")
+	_, err = bl.listingcache.Get("test-service")
+	assert.EqualError(err, "not found", "should retry failed templates on the next update")
 
 	// test object not yaml
 	s3obj := s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("test"))}
-	s3svc = S3Client{
+	source.S3 = S3Client{
 		Client: mockS3{GetObjectResp: s3obj},
 	}
-	err = MetadataUpdate(bl.listingcache, bl.catalogcache, *bd, s3svc, bl.db, MetadataUpdate, "-main.yaml")
-	assert.Equal(err, nil, "should handle bad templates without erroring")
+	err = MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate, 2)
+	assert.IsType(TemplateErrors{}, err, "should collect the error for bad templates")
+	assert.Contains(err.(TemplateErrors), "test-service")
+
+	// test many templates loaded in parallel
+	serviceUpdates = nil
+	for i := 0; i < 25; i++ {
+		serviceUpdates = append(serviceUpdates, ServiceNeedsUpdate{Name: fmt.Sprintf("service%d", i), Update: true})
+	}
+	bl.listingcache.Set("__LISTINGS__", serviceUpdates)
+	source.S3 = S3Client{Client: mockS3{GetObjectResp: s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("test"))}}}
+	err = MetadataUpdate(bl.listingcache, bl.catalogcache, source, bl.db, MetadataUpdate, 4)
+	assert.Len(err.(TemplateErrors), 25, "should collect an error for every template")
+	assert.Regexp("(?s)^failed to load 25 template\\(s\\): service0: .*; service1: ", err.Error(), "should sort errors by template name")
 
 	// TODO: test success and more failure scenarios
 }
 
+// mock implementation of DataStore Adapter that holds service definitions
+type mockDataStoreCatalog struct {
+	mockDataStore
+	services   []osb.Service
+	tombstoned map[string]bool
+}
+
+func (db mockDataStoreCatalog) GetServiceDefinitions() ([]osb.Service, error) {
+	var services []osb.Service
+	for _, sd := range db.services {
+		if !db.tombstoned[sd.ID] {
+			services = append(services, sd)
+		}
+	}
+	return services, nil
+}
+
+func (db mockDataStoreCatalog) TombstoneServiceDefinition(serviceuuid string) error {
+	if serviceuuid == "err" {
+		return errors.New("test failure")
+	}
+	db.tombstoned[serviceuuid] = true
+	return nil
+}
+
+func TestListingUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	listingcache := cache.NewMemory()
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	listingcache.Set("unchanged", ServiceLastUpdate{Name: "unchanged", Date: date})
+	listingcache.Set("newer", ServiceLastUpdate{Name: "newer", Date: date})
+	listingcache.Set("same-etag", ServiceLastUpdate{Name: "same-etag", ETag: "a"})
+	listingcache.Set("other-etag", ServiceLastUpdate{Name: "other-etag", ETag: "a"})
+
+	l := &[]ServiceLastUpdate{
+		{Name: "unchanged", Date: date},
+		{Name: "newer", Date: date.Add(time.Hour)},
+		{Name: "same-etag", ETag: "a"},
+		{Name: "other-etag", ETag: "b"},
+		{Name: "new", Date: date},
+	}
+	assert.Nil(ListingUpdate(l, listingcache))
+	listings, err := listingcache.Get("__LISTINGS__")
+	assert.Nil(err)
+	assert.Equal([]ServiceNeedsUpdate{
+		{Name: "unchanged", Update: false},
+		{Name: "newer", Update: true},
+		{Name: "same-etag", Update: false},
+		{Name: "other-etag", Update: true},
+		{Name: "new", Update: true},
+	}, listings)
+	item, err := listingcache.Get("other-etag")
+	assert.Nil(err)
+	assert.Equal(ServiceLastUpdate{Name: "other-etag", ETag: "b"}, item)
+}
+
+func TestPruneCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	listingcache := cache.NewMemory()
+	catalogcache := cache.NewMemory()
+	ds := mockDataStoreCatalog{
+		services: []osb.Service{
+			{ID: "kept-id", Name: "kept"},
+			{ID: "renamed-id", Name: "renamed-service"},
+			{ID: "removed-id", Name: "removed"},
+		},
+		tombstoned: make(map[string]bool),
+	}
+	db := Db{DataStorePort: ds}
+	for _, name := range []string{"kept", "renamed", "removed"} {
+		listingcache.Set(name, ServiceLastUpdate{Name: name, Date: time.Now()})
+	}
+	catalogcache.Set("kept", osb.Service{ID: "kept-id", Name: "kept"})
+	catalogcache.Set("renamed", osb.Service{ID: "renamed-id", Name: "renamed-service"})
+	catalogcache.Set("removed", osb.Service{ID: "removed-id", Name: "removed"})
+	previous := []ServiceNeedsUpdate{{Name: "kept"}, {Name: "renamed"}, {Name: "removed"}}
+
+	// nothing listed, should not prune
+	err := pruneCatalog(&[]ServiceLastUpdate{}, previous, listingcache, catalogcache, db)
+	assert.Nil(err)
+	assert.Empty(ds.tombstoned, "should not prune when no templates are listed")
+
+	l := &[]ServiceLastUpdate{{Name: "kept"}, {Name: "renamed"}}
+	err = pruneCatalog(l, previous, listingcache, catalogcache, db)
+	assert.Nil(err)
+	assert.Equal(map[string]bool{"removed-id": true}, ds.tombstoned, "should only tombstone services that are no longer listed")
+	_, err = catalogcache.Get("removed")
+	assert.EqualError(err, "not found", "should remove the service from the catalog cache")
+	_, err = listingcache.Get("removed")
+	assert.EqualError(err, "not found", "should remove the service from the listing cache")
+	_, err = catalogcache.Get("kept")
+	assert.Nil(err)
+
+	// no previous listing, e.g. after a restart
+	ds.services = append(ds.services, osb.Service{ID: "err", Name: "stale"})
+	db.DataStorePort = ds
+	err = pruneCatalog(l, nil, listingcache, catalogcache, db)
+	assert.EqualError(err, "test failure")
+}
+
 func TestAssumeArnGeneration(t *testing.T) {
 	params := map[string]string{"target_role_name": "worker"}
 	accountID := "123456654321"
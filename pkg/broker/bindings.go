@@ -0,0 +1,882 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// BindingSpec is the binding behavior declared in the Bindings block of a template's specification. It is kept in
+// the service metadata, so Bind doesn't need the template
+type BindingSpec struct {
+	// AddKeypair creates an IAM user and access key for each binding
+	AddKeypair bool `json:"addKeypair,omitempty"`
+	// Policies are the policy documents attached to the binding's IAM user, ${OutputKey} placeholders are replaced
+	// with the stack outputs
+	Policies []map[string]interface{} `json:"policies,omitempty"`
+	// CFNOutputs limits the credentials to the listed stack outputs
+	CFNOutputs []string `json:"cfnOutputs,omitempty"`
+	// ResourcePolicies are the resources that can grant access to principals in other accounts
+	ResourcePolicies []ResourcePolicySpec `json:"resourcePolicies,omitempty"`
+}
+
+var (
+	iamNameRegex       = regexp.MustCompile(`^[\w+=,.@-]+$`)
+	outputPlaceholders = regexp.MustCompile(`\$\{([\w:-]+)\}`)
+)
+
+// toBindingSpec converts the Bindings block of a template, returns nil when the template doesn't declare any binding
+// behavior
+func toBindingSpec(sd CfnTemplate) *BindingSpec {
+	bindings := sd.Metadata.Spec.Bindings
+	if !bindings.IAM.AddKeypair && len(bindings.IAM.Policies) == 0 && len(bindings.CFNOutputs) == 0 && len(bindings.ResourcePolicies) == 0 {
+		return nil
+	}
+	spec := &BindingSpec{
+		AddKeypair:       bindings.IAM.AddKeypair,
+		CFNOutputs:       bindings.CFNOutputs,
+		ResourcePolicies: bindings.ResourcePolicies,
+	}
+	for _, p := range bindings.IAM.Policies {
+		spec.Policies = append(spec.Policies, yamlToJSONValue(p.PolicyDocument).(map[string]interface{}))
+	}
+	return spec
+}
+
+// toBindingSchema returns the schemas of the bind parameters a template supports and of the credentials its bindings
+// return. The Scope enum lists the scopes of the PolicyArn<Scope> outputs and resource policies, and the credentials
+// are described by their outputs
+func toBindingSchema(sd CfnTemplate, service *osb.Service) *osb.ServiceBindingSchema {
+	bindings := sd.Metadata.Spec.Bindings
+	properties := make(map[string]interface{})
+	scopes := make(map[string]bool)
+	hasPolicy := false
+	for k := range sd.Outputs {
+		if strings.HasPrefix(k, cfnOutputPolicyArnPrefix) {
+			hasPolicy = true
+			if scope := strings.TrimPrefix(k, cfnOutputPolicyArnPrefix); scope != "" {
+				scopes[scope] = true
+			}
+		}
+	}
+	if hasPolicy {
+		properties[bindParamRoleName] = map[string]interface{}{
+			"type":        "string",
+			"description": "An existing IAM role to attach the policy of the binding's scope to.",
+		}
+		properties[bindParamPrincipalType] = map[string]interface{}{
+			"type":        "string",
+			"enum":        []string{principalTypeRole, principalTypeUser, principalTypeGroup},
+			"description": "The type of PrincipalName.",
+		}
+		properties[bindParamPrincipalName] = map[string]interface{}{
+			"type":        "string",
+			"description": "An existing IAM role, user or group to attach the policy of the binding's scope to.",
+		}
+		properties[bindParamCredentialsType] = map[string]interface{}{
+			"type":        "string",
+			"enum":        []string{credentialsTypeStatic, credentialsTypeTemporary},
+			"description": "Temporary returns short-lived STS credentials instead of an access key.",
+		}
+		properties[bindParamServiceAccount] = map[string]interface{}{
+			"type":        "string",
+			"description": "A Kubernetes service account, as namespace:name, to create an IAM role for.",
+		}
+	}
+	if len(bindings.ResourcePolicies) > 0 {
+		for _, p := range bindings.ResourcePolicies {
+			if p.Scope != "" {
+				scopes[p.Scope] = true
+			}
+		}
+		properties[bindParamPrincipalArn] = map[string]interface{}{
+			"type":        "string",
+			"pattern":     principalArnRegex.String(),
+			"description": "An AWS account, IAM user or IAM role, usually in another account, to grant access through resource policies.",
+		}
+	}
+	if len(scopes) > 0 {
+		enum := make([]string, 0, len(scopes))
+		for scope := range scopes {
+			enum = append(enum, scope)
+		}
+		sort.Strings(enum)
+		properties[bindParamScope] = map[string]interface{}{
+			"type":        "string",
+			"enum":        enum,
+			"description": "The access the binding gets, the default access when not set.",
+		}
+	}
+
+	credentials := make(map[string]interface{})
+	for k, o := range sd.Outputs {
+		if strings.HasPrefix(k, cfnOutputPolicyArnPrefix) || (len(bindings.CFNOutputs) > 0 && !stringInSlice(k, bindings.CFNOutputs)) {
+			continue
+		}
+		name := toScreamingSnakeCaseIfAppropriate(service, k)
+		if k == cfnOutputUserKeyID || k == cfnOutputUserSecretKey {
+			name = legacyCredentialKey(service, k)
+		}
+		credential := map[string]interface{}{"type": "string"}
+		if o.Description != "" {
+			credential["description"] = o.Description
+		}
+		credentials[name] = credential
+	}
+	extra := make(map[string]string)
+	if bindings.IAM.AddKeypair {
+		extra[legacyCredentialKey(service, cfnOutputUserKeyID)] = "The access key id of the binding's IAM user."
+		extra[legacyCredentialKey(service, cfnOutputUserSecretKey)] = "The secret access key of the binding's IAM user."
+	}
+	if hasPolicy {
+		extra[credentialRoleArn] = "The IAM role created for the binding's ServiceAccount."
+		extra[credentialAccessKeyID] = "The access key id of Temporary credentials."
+		extra[credentialSecretAccessKey] = "The secret access key of Temporary credentials."
+		extra[credentialSessionToken] = "The session token of Temporary credentials."
+		extra[credentialExpiration] = "When Temporary credentials expire."
+	}
+	for k, description := range extra {
+		if _, ok := credentials[k]; !ok {
+			credentials[k] = map[string]interface{}{"type": "string", "description": description}
+		}
+	}
+
+	return &osb.ServiceBindingSchema{
+		Create: &osb.RequestResponseSchema{
+			InputParametersSchema: osb.InputParametersSchema{
+				Parameters: map[string]interface{}{
+					"$schema":    "http://json-schema.org/draft-06/schema#",
+					"type":       "object",
+					"properties": properties,
+				},
+			},
+			Response: map[string]interface{}{
+				"$schema":    "http://json-schema.org/draft-06/schema#",
+				"type":       "object",
+				"properties": credentials,
+			},
+		},
+	}
+}
+
+// getBindingSpec returns the binding behavior of the service, or nil if it has none
+func getBindingSpec(service *osb.Service) (*BindingSpec, error) {
+	if service.Metadata == nil || service.Metadata["bindings"] == nil {
+		return nil, nil
+	}
+	// service definitions read back from the DataStore hold generic maps rather than a BindingSpec
+	b, err := json.Marshal(service.Metadata["bindings"])
+	if err != nil {
+		return nil, err
+	}
+	var spec BindingSpec
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+// yamlToJSONValue converts the map[interface{}]interface{} values produced by the yaml decoder, which can't be
+// marshalled to JSON
+func yamlToJSONValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = yamlToJSONValue(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = yamlToJSONValue(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = yamlToJSONValue(e)
+		}
+		return l
+	}
+	return v
+}
+
+// filterOutputs returns the outputs listed in the binding spec, or all of them when it doesn't list any
+func filterOutputs(outputs []*cloudformation.Output, spec *BindingSpec) []*cloudformation.Output {
+	if spec == nil || len(spec.CFNOutputs) == 0 {
+		return outputs
+	}
+	var filtered []*cloudformation.Output
+	for _, o := range outputs {
+		for _, k := range spec.CFNOutputs {
+			if aws.StringValue(o.OutputKey) == k {
+				filtered = append(filtered, o)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// bindingIAMName returns the name of the IAM user or role created for a binding, binding ids that aren't valid in IAM
+// names are hashed
+func bindingIAMName(bindingID string) string {
+	if len(bindingIAMPrefix)+len(bindingID) <= 64 && iamNameRegex.MatchString(bindingID) {
+		return bindingIAMPrefix + bindingID
+	}
+	return bindingIAMPrefix + contentHash([]byte(bindingID))[:32]
+}
+
+// substituteOutputs replaces the ${OutputKey} placeholders in the strings of a policy document with the stack outputs.
+// Other placeholders, such as the ${aws:username} policy variable, are left alone
+func substituteOutputs(v interface{}, outputs []*cloudformation.Output) interface{} {
+	switch t := v.(type) {
+	case string:
+		return outputPlaceholders.ReplaceAllStringFunc(t, func(p string) string {
+			key := outputPlaceholders.FindStringSubmatch(p)[1]
+			for _, o := range outputs {
+				if aws.StringValue(o.OutputKey) == key {
+					return aws.StringValue(o.OutputValue)
+				}
+			}
+			return p
+		})
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = substituteOutputs(e, outputs)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = substituteOutputs(e, outputs)
+		}
+		return l
+	}
+	return v
+}
+
+// createBindingUser creates the IAM user of a binding with the scoped policy of the stack, if any, and the policies of
+// the binding spec, and returns its access key. The user is deleted again if any step fails
+func createBindingUser(iamSvc iamiface.IAMAPI, userName string, policyArn string, spec *BindingSpec, outputs []*cloudformation.Output) (*iam.AccessKey, error) {
+	_, err := iamSvc.CreateUser(&iam.CreateUserInput{
+		UserName: aws.String(userName),
+		Path:     aws.String(bindingIAMPath),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey, err := func() (*iam.AccessKey, error) {
+		if policyArn != "" {
+			_, err := iamSvc.AttachUserPolicy(&iam.AttachUserPolicyInput{
+				UserName:  aws.String(userName),
+				PolicyArn: aws.String(policyArn),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		var policies []map[string]interface{}
+		if spec != nil {
+			policies = spec.Policies
+		}
+		for i, p := range policies {
+			document, err := json.Marshal(substituteOutputs(p, outputs))
+			if err != nil {
+				return nil, err
+			}
+			_, err = iamSvc.PutUserPolicy(&iam.PutUserPolicyInput{
+				UserName:       aws.String(userName),
+				PolicyName:     aws.String(fmt.Sprintf("%s%d", bindingPolicyPrefix, i)),
+				PolicyDocument: aws.String(string(document)),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		resp, err := iamSvc.CreateAccessKey(&iam.CreateAccessKeyInput{
+			UserName: aws.String(userName),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return resp.AccessKey, nil
+	}()
+	if err != nil {
+		if derr := deleteBindingUser(iamSvc, userName); derr != nil {
+			glog.Errorf("Failed to delete the IAM user %s: %v", userName, derr)
+		}
+		return nil, err
+	}
+	return accessKey, nil
+}
+
+// deleteBindingUser deletes the IAM user of a binding, along with its access keys and policies. A user that doesn't
+// exist is not an error
+func deleteBindingUser(iamSvc iamiface.IAMAPI, userName string) error {
+	keys, err := iamSvc.ListAccessKeys(&iam.ListAccessKeysInput{
+		UserName: aws.String(userName),
+	})
+	if err != nil {
+		return ignoreNoSuchEntity(err)
+	}
+	for _, k := range keys.AccessKeyMetadata {
+		_, err := iamSvc.DeleteAccessKey(&iam.DeleteAccessKeyInput{
+			UserName:    aws.String(userName),
+			AccessKeyId: k.AccessKeyId,
+		})
+		if ignoreNoSuchEntity(err) != nil {
+			return err
+		}
+	}
+
+	attached, err := iamSvc.ListAttachedUserPolicies(&iam.ListAttachedUserPoliciesInput{
+		UserName: aws.String(userName),
+	})
+	if err != nil {
+		return ignoreNoSuchEntity(err)
+	}
+	for _, p := range attached.AttachedPolicies {
+		_, err := iamSvc.DetachUserPolicy(&iam.DetachUserPolicyInput{
+			UserName:  aws.String(userName),
+			PolicyArn: p.PolicyArn,
+		})
+		if ignoreNoSuchEntity(err) != nil {
+			return err
+		}
+	}
+
+	policies, err := iamSvc.ListUserPolicies(&iam.ListUserPoliciesInput{
+		UserName: aws.String(userName),
+	})
+	if err != nil {
+		return ignoreNoSuchEntity(err)
+	}
+	for _, p := range policies.PolicyNames {
+		_, err := iamSvc.DeleteUserPolicy(&iam.DeleteUserPolicyInput{
+			UserName:   aws.String(userName),
+			PolicyName: p,
+		})
+		if ignoreNoSuchEntity(err) != nil {
+			return err
+		}
+	}
+
+	_, err = iamSvc.DeleteUser(&iam.DeleteUserInput{
+		UserName: aws.String(userName),
+	})
+	return ignoreNoSuchEntity(err)
+}
+
+// bindingSecretName returns the name of the secret holding the secret of an access key of a binding's IAM user. Deleted
+// secrets keep their name during their recovery window, so the name includes the access key id, which is new when a
+// failed binding is created again
+func bindingSecretName(bindingID string, accessKeyID string) string {
+	return fmt.Sprintf("%s%s/%s", bindingSecretPrefix, bindingIAMName(bindingID), accessKeyID)
+}
+
+// putBindingSecret stores the secret access key of a binding's IAM user in Secrets Manager, which encrypts it with the
+// account's default key
+func putBindingSecret(smSvc secretsmanageriface.SecretsManagerAPI, name string, secretAccessKey string) error {
+	_, err := smSvc.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String("Secret access key of an AWS Service Broker binding"),
+		SecretString: aws.String(secretAccessKey),
+	})
+	return err
+}
+
+// getBindingSecret returns the secret access key of a binding's IAM user
+func getBindingSecret(smSvc secretsmanageriface.SecretsManagerAPI, name string) (string, error) {
+	resp, err := smSvc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.SecretString), nil
+}
+
+// deleteBindingSecret schedules the deletion of the secret of a binding after the shortest recovery window, the access
+// key it holds is deleted along with the binding's IAM user. A secret that doesn't exist is not an error
+func deleteBindingSecret(smSvc secretsmanageriface.SecretsManagerAPI, name string) error {
+	_, err := smSvc.DeleteSecret(&secretsmanager.DeleteSecretInput{
+		SecretId:             aws.String(name),
+		RecoveryWindowInDays: aws.Int64(bindingSecretRecoveryDays),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	return err
+}
+
+func ignoreNoSuchEntity(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == iam.ErrCodeNoSuchEntityException {
+		return nil
+	}
+	return err
+}
+
+// bindingUserCredentials returns the credentials of a binding's access key, named like the UserKeyId and
+// UserSecretKey outputs for backward compatibility. The secret is left out when it isn't known
+func bindingUserCredentials(service *osb.Service, accessKey *iam.AccessKey) map[string]interface{} {
+	credentials := map[string]interface{}{
+		legacyCredentialKey(service, cfnOutputUserKeyID): aws.StringValue(accessKey.AccessKeyId),
+	}
+	if accessKey.SecretAccessKey != nil {
+		credentials[legacyCredentialKey(service, cfnOutputUserSecretKey)] = aws.StringValue(accessKey.SecretAccessKey)
+	}
+	return credentials
+}
+
+// createsBindingUser returns whether a binding gets an IAM user with its own access key
+func createsBindingUser(spec *BindingSpec, binding *serviceinstance.ServiceBinding) bool {
+	_, principalName := bindingPrincipal(binding)
+	temporary := binding.CredentialsType == credentialsTypeTemporary
+	webIdentity := binding.ServiceAccount != ""
+	crossAccount := binding.PrincipalArn != ""
+	return (spec != nil && spec.AddKeypair && !crossAccount) || (principalName == "" && binding.PolicyArn != "" && !temporary && !webIdentity)
+}
+
+// hasBindingKeys returns whether the credentials include the access key of an IAM user created for the binding
+func hasBindingKeys(credentials map[string]interface{}) bool {
+	for _, v := range credentials {
+		if v == cfnOutputBindingAccessKeyID || v == cfnOutputBindingSecretAccessKey {
+			return true
+		}
+	}
+	return false
+}
+
+// setBindingKeys replaces the binding:AccessKeyId and binding:SecretAccessKey credentials with the access key of the
+// binding's IAM user, or removes them when the binding has no IAM user or the secret isn't known
+func setBindingKeys(credentials map[string]interface{}, accessKey *iam.AccessKey) {
+	for k, v := range credentials {
+		if v != cfnOutputBindingAccessKeyID && v != cfnOutputBindingSecretAccessKey {
+			continue
+		}
+		if accessKey == nil || (v == cfnOutputBindingSecretAccessKey && accessKey.SecretAccessKey == nil) {
+			delete(credentials, k)
+		} else if v == cfnOutputBindingAccessKeyID {
+			credentials[k] = aws.StringValue(accessKey.AccessKeyId)
+		} else {
+			credentials[k] = aws.StringValue(accessKey.SecretAccessKey)
+		}
+	}
+}
+
+// bindingCredentials adds the access key, role or temporary credentials of a binding to the credentials from the stack
+// outputs. Temporary credentials are new each time. The secret of the access key is read from Secrets Manager unless
+// it is passed, bindings created before it was stored there get the access key id alone
+func (b *AwsBroker) bindingCredentials(sess *session.Session, service *osb.Service, spec *BindingSpec, binding *serviceinstance.ServiceBinding, secretAccessKey string, credentials map[string]interface{}) (map[string]interface{}, error) {
+	var accessKey *iam.AccessKey
+	if binding.UserName != "" {
+		accessKey = &iam.AccessKey{AccessKeyId: aws.String(binding.AccessKeyID)}
+		if secretAccessKey == "" && binding.SecretName != "" {
+			var err error
+			secretAccessKey, err = getBindingSecret(b.Clients.NewSecretsManager(sess), binding.SecretName)
+			if err != nil {
+				desc := fmt.Sprintf("Failed to get the secret access key of service binding %s: %v", binding.ID, err)
+				return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+			}
+		}
+		if secretAccessKey != "" {
+			accessKey.SecretAccessKey = aws.String(secretAccessKey)
+		}
+		if spec != nil && spec.AddKeypair {
+			for k, v := range bindingUserCredentials(service, accessKey) {
+				credentials[k] = v
+			}
+		}
+	}
+	setBindingKeys(credentials, accessKey)
+
+	if binding.ServiceAccount != "" {
+		role, err := b.Clients.NewIam(sess).GetRole(&iam.GetRoleInput{
+			RoleName: aws.String(binding.CreatedRoleName),
+		})
+		if err != nil {
+			desc := fmt.Sprintf("Failed to get the IAM role %s: %v", binding.CreatedRoleName, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		credentials[credentialRoleArn] = aws.StringValue(role.Role.Arn)
+	}
+
+	if binding.CredentialsType == credentialsTypeTemporary {
+		temporaryCredentials, err := getTemporaryCredentials(b.Clients.NewIam(sess), b.Clients.NewSts(sess), binding)
+		if err != nil {
+			desc := fmt.Sprintf("Failed to get temporary credentials for service binding %s: %v", binding.ID, err)
+			return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+		}
+		for k, v := range temporaryCredentials {
+			credentials[k] = v
+		}
+	}
+	return credentials, nil
+}
+
+// bindingParameters returns the bind parameters a binding was created with
+func bindingParameters(binding *serviceinstance.ServiceBinding) map[string]interface{} {
+	params := make(map[string]interface{})
+	for k, v := range map[string]string{
+		bindParamRoleName:        binding.RoleName,
+		bindParamScope:           binding.Scope,
+		bindParamCredentialsType: binding.CredentialsType,
+		bindParamServiceAccount:  binding.ServiceAccount,
+		bindParamPrincipalType:   binding.PrincipalType,
+		bindParamPrincipalName:   binding.PrincipalName,
+		bindParamPrincipalArn:    binding.PrincipalArn,
+	} {
+		if v != "" {
+			params[k] = v
+		}
+	}
+	return params
+}
+
+// acceptsIncomplete returns whether the platform accepts an asynchronous bind. The vendored broker library doesn't read
+// the accepts_incomplete query parameter of bind requests
+func acceptsIncomplete(request *osb.BindRequest, c *broker.RequestContext) bool {
+	if request.AcceptsIncomplete {
+		return true
+	}
+	return c != nil && c.Request != nil && c.Request.URL.Query().Get(osb.AcceptsIncomplete) == "true"
+}
+
+func legacyCredentialKey(service *osb.Service, outputKey string) string {
+	return fmt.Sprintf("%s_%s", strings.ToUpper(service.Name), toScreamingSnakeCase(outputKey))
+}
+
+// deleteBindingResources deletes the IAM user, secret and role created for a binding that couldn't be completed, detaches the
+// policy attached to its principal unless its predecessor shares it, and revokes the access it was granted through
+// resource policies
+func (b *AwsBroker) deleteBindingResources(sess *session.Session, binding *serviceinstance.ServiceBinding) {
+	if principalType, principalName := bindingPrincipal(binding); principalName != "" && binding.PolicyArn != "" {
+		if sharedWith, err := b.sharedPrincipalPolicy(binding); err != nil {
+			glog.Errorf("Failed to get the rotated service bindings of %s: %v", binding.ID, err)
+		} else if sharedWith == "" {
+			if err := detachPrincipalPolicy(b.Clients.NewIam(sess), principalType, principalName, binding.PolicyArn); ignoreNoSuchEntity(err) != nil {
+				glog.Errorf("Failed to detach the policy %s from %s %s: %v", binding.PolicyArn, principalType, principalName, err)
+			}
+		}
+	}
+	for _, grant := range binding.ResourceGrants {
+		if err := b.revokeResourceAccess(sess, grant, resourceStatementID(binding.ID)); err != nil {
+			glog.Errorf("Failed to revoke the access of service binding %s to %s %s: %v", binding.ID, grant.Type, grant.Resource, err)
+		}
+	}
+	if binding.UserName != "" {
+		if err := deleteBindingUser(b.Clients.NewIam(sess), binding.UserName); err != nil {
+			glog.Errorf("Failed to delete the IAM user %s: %v", binding.UserName, err)
+		}
+	}
+	if binding.SecretName != "" {
+		if err := deleteBindingSecret(b.Clients.NewSecretsManager(sess), binding.SecretName); err != nil {
+			glog.Errorf("Failed to delete the secret %s: %v", binding.SecretName, err)
+		}
+	}
+	if binding.CreatedRoleName != "" {
+		if err := deleteBindingRole(b.Clients.NewIam(sess), binding.CreatedRoleName); err != nil {
+			glog.Errorf("Failed to delete the IAM role %s: %v", binding.CreatedRoleName, err)
+		}
+	}
+}
+
+// brokerTrustPolicy returns a trust policy that only lets the IAM user or role of the broker assume a role
+func brokerTrustPolicy(principalArn string) string {
+	return fmt.Sprintf(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":%q},"Action":"sts:AssumeRole"}]}`, principalArn)
+}
+
+// brokerPrincipalArn returns the ARN of the IAM user or role the broker calls AWS as, given its caller identity ARN.
+// Sessions of an assumed role are resolved to the role, which trust policies can name
+func brokerPrincipalArn(iamSvc iamiface.IAMAPI, callerArn string) (string, error) {
+	parts := strings.SplitN(callerArn, ":", 6)
+	if len(parts) != 6 {
+		return "", fmt.Errorf("invalid caller ARN %s", callerArn)
+	}
+	resource := strings.Split(parts[5], "/")
+	if parts[2] != "sts" || resource[0] != "assumed-role" || len(resource) < 2 {
+		return callerArn, nil
+	}
+	resp, err := iamSvc.GetRole(&iam.GetRoleInput{
+		RoleName: aws.String(resource[1]),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.Role.Arn), nil
+}
+
+// arnPartition returns the partition of an ARN, such as aws or aws-cn
+func arnPartition(arn string) string {
+	if parts := strings.Split(arn, ":"); len(parts) > 1 {
+		return parts[1]
+	}
+	return ""
+}
+
+// createBindingRole creates the IAM role of a binding with the scoped policy of the stack attached. The role is
+// deleted again if the policy can't be attached
+func createBindingRole(iamSvc iamiface.IAMAPI, roleName string, trustPolicy string, policyArn string) (*iam.Role, error) {
+	resp, err := iamSvc.CreateRole(&iam.CreateRoleInput{
+		RoleName:                 aws.String(roleName),
+		Path:                     aws.String(bindingIAMPath),
+		AssumeRolePolicyDocument: aws.String(trustPolicy),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = iamSvc.AttachRolePolicy(&iam.AttachRolePolicyInput{
+		RoleName:  aws.String(roleName),
+		PolicyArn: aws.String(policyArn),
+	})
+	if err != nil {
+		if derr := deleteBindingRole(iamSvc, roleName); derr != nil {
+			glog.Errorf("Failed to delete the IAM role %s: %v", roleName, derr)
+		}
+		return nil, err
+	}
+	return resp.Role, nil
+}
+
+// deleteBindingRole detaches the policies of the IAM role of a binding and deletes it. A role that doesn't exist is
+// not an error
+func deleteBindingRole(iamSvc iamiface.IAMAPI, roleName string) error {
+	attached, err := iamSvc.ListAttachedRolePolicies(&iam.ListAttachedRolePoliciesInput{
+		RoleName: aws.String(roleName),
+	})
+	if err != nil {
+		return ignoreNoSuchEntity(err)
+	}
+	for _, p := range attached.AttachedPolicies {
+		_, err := iamSvc.DetachRolePolicy(&iam.DetachRolePolicyInput{
+			RoleName:  aws.String(roleName),
+			PolicyArn: p.PolicyArn,
+		})
+		if ignoreNoSuchEntity(err) != nil {
+			return err
+		}
+	}
+
+	_, err = iamSvc.DeleteRole(&iam.DeleteRoleInput{
+		RoleName: aws.String(roleName),
+	})
+	return ignoreNoSuchEntity(err)
+}
+
+// bindingPrincipal returns the type and name of the IAM principal the policy of a binding is attached to, or empty
+// strings if the binding has none
+func bindingPrincipal(binding *serviceinstance.ServiceBinding) (string, string) {
+	if binding.RoleName != "" {
+		return principalTypeRole, binding.RoleName
+	}
+	return binding.PrincipalType, binding.PrincipalName
+}
+
+// attachPrincipalPolicy attaches a managed policy to an IAM role, user or group
+func attachPrincipalPolicy(iamSvc iamiface.IAMAPI, principalType string, principalName string, policyArn string) error {
+	var err error
+	switch principalType {
+	case principalTypeRole:
+		_, err = iamSvc.AttachRolePolicy(&iam.AttachRolePolicyInput{
+			PolicyArn: aws.String(policyArn),
+			RoleName:  aws.String(principalName),
+		})
+	case principalTypeUser:
+		_, err = iamSvc.AttachUserPolicy(&iam.AttachUserPolicyInput{
+			PolicyArn: aws.String(policyArn),
+			UserName:  aws.String(principalName),
+		})
+	case principalTypeGroup:
+		_, err = iamSvc.AttachGroupPolicy(&iam.AttachGroupPolicyInput{
+			PolicyArn: aws.String(policyArn),
+			GroupName: aws.String(principalName),
+		})
+	default:
+		err = fmt.Errorf("unsupported principal type %s", principalType)
+	}
+	return err
+}
+
+// detachPrincipalPolicy detaches a managed policy from an IAM role, user or group
+func detachPrincipalPolicy(iamSvc iamiface.IAMAPI, principalType string, principalName string, policyArn string) error {
+	var err error
+	switch principalType {
+	case principalTypeRole:
+		_, err = iamSvc.DetachRolePolicy(&iam.DetachRolePolicyInput{
+			PolicyArn: aws.String(policyArn),
+			RoleName:  aws.String(principalName),
+		})
+	case principalTypeUser:
+		_, err = iamSvc.DetachUserPolicy(&iam.DetachUserPolicyInput{
+			PolicyArn: aws.String(policyArn),
+			UserName:  aws.String(principalName),
+		})
+	case principalTypeGroup:
+		_, err = iamSvc.DetachGroupPolicy(&iam.DetachGroupPolicyInput{
+			PolicyArn: aws.String(policyArn),
+			GroupName: aws.String(principalName),
+		})
+	default:
+		err = fmt.Errorf("unsupported principal type %s", principalType)
+	}
+	return err
+}
+
+// getPolicyDocument returns the document of the default version of a managed policy
+func getPolicyDocument(iamSvc iamiface.IAMAPI, policyArn string) (string, error) {
+	policy, err := iamSvc.GetPolicy(&iam.GetPolicyInput{
+		PolicyArn: aws.String(policyArn),
+	})
+	if err != nil {
+		return "", err
+	}
+	version, err := iamSvc.GetPolicyVersion(&iam.GetPolicyVersionInput{
+		PolicyArn: aws.String(policyArn),
+		VersionId: policy.Policy.DefaultVersionId,
+	})
+	if err != nil {
+		return "", err
+	}
+	// IAM returns policy documents url encoded, as in RFC 3986, which doesn't encode spaces as +
+	return url.PathUnescape(aws.StringValue(version.PolicyVersion.Document))
+}
+
+// getTemporaryCredentials assumes the role of a binding, with the scoped policy of the stack as the session policy so
+// the credentials can't do more than the binding's scope allows
+func getTemporaryCredentials(iamSvc iamiface.IAMAPI, stsSvc stsiface.STSAPI, binding *serviceinstance.ServiceBinding) (map[string]interface{}, error) {
+	// bindings created before temporary credentials were limited to roles created by the broker have a RoleName
+	roleName := binding.RoleName
+	if binding.CreatedRoleName != "" {
+		roleName = binding.CreatedRoleName
+	}
+	role, err := iamSvc.GetRole(&iam.GetRoleInput{
+		RoleName: aws.String(roleName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	policy, err := getPolicyDocument(iamSvc, binding.PolicyArn)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &sts.AssumeRoleInput{
+		RoleArn:         role.Role.Arn,
+		RoleSessionName: aws.String(bindingIAMName(binding.ID)),
+		Policy:          aws.String(policy),
+		DurationSeconds: aws.Int64(temporaryCredentialsDuration),
+	}
+	var resp *sts.AssumeRoleOutput
+	for attempt := 1; ; attempt++ {
+		resp, err = stsSvc.AssumeRole(input)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "AccessDenied" && attempt < assumeRoleAttempts {
+			glog.Infof("Retrying to assume role %s: %v", roleName, err)
+			time.Sleep(assumeRoleRetryDelay)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		credentialAccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		credentialSecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		credentialSessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		credentialExpiration:      aws.TimeValue(resp.Credentials.Expiration).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// RefreshBindingCredentials returns new temporary credentials for a binding with the Temporary credentials type, so
+// they can be replaced before they expire. It is served under /admin, which is only exposed behind basic auth, platforms
+// get new credentials by fetching the binding with GetBinding
+func (b *AwsBroker) RefreshBindingCredentials(bindingID string) (map[string]interface{}, error) {
+	binding, err := b.db.DataStorePort.GetServiceBinding(bindingID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service binding %s: %v", bindingID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if binding == nil {
+		desc := fmt.Sprintf("The service binding %s was not found.", bindingID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	} else if binding.CredentialsType != credentialsTypeTemporary {
+		desc := fmt.Sprintf("The service binding %s doesn't use temporary credentials.", bindingID)
+		return nil, newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+	}
+
+	instance, err := b.db.DataStorePort.GetServiceInstance(binding.InstanceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service instance %s: %v", binding.InstanceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if instance == nil {
+		desc := fmt.Sprintf("The service instance %s was not found.", binding.InstanceID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+
+	sess := b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params)
+	credentials, err := getTemporaryCredentials(b.Clients.NewIam(sess), b.Clients.NewSts(sess), binding)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get temporary credentials for service binding %s: %v", binding.ID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	return credentials, nil
+}
+
+// parseOIDCIssuers parses the oidcIssuers option, a comma separated list of cluster-id=issuer-url pairs
+func parseOIDCIssuers(s string) (map[string]string, error) {
+	issuers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || !strings.HasPrefix(strings.TrimSpace(kv[1]), "https://") {
+			return nil, fmt.Errorf("invalid oidcIssuers entry %q, expected cluster-id=https://issuer", pair)
+		}
+		issuers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return issuers, nil
+}
+
+// webIdentityTrustPolicy returns a trust policy that lets a Kubernetes service account assume a role with the web
+// identity tokens of the cluster's OIDC provider
+func webIdentityTrustPolicy(partition string, accountID string, issuer string, serviceAccount string) string {
+	provider := strings.TrimSuffix(strings.TrimPrefix(issuer, "https://"), "/")
+	policy := map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []interface{}{map[string]interface{}{
+			"Effect":    "Allow",
+			"Principal": map[string]interface{}{"Federated": fmt.Sprintf("arn:%s:iam::%s:oidc-provider/%s", partition, accountID, provider)},
+			"Action":    "sts:AssumeRoleWithWebIdentity",
+			"Condition": map[string]interface{}{"StringEquals": map[string]interface{}{
+				provider + ":sub": "system:serviceaccount:" + serviceAccount,
+				provider + ":aud": "sts.amazonaws.com",
+			}},
+		}},
+	}
+	b, _ := json.Marshal(policy)
+	return string(b)
+}
@@ -0,0 +1,269 @@
+package broker
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/iam"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestBindingSpec(t *testing.T) {
+	assertor := assert.New(t)
+
+	var sd CfnTemplate
+	err := yaml.Unmarshal([]byte(`
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Name: test
+    Bindings:
+      IAM:
+        AddKeypair: true
+        Policies:
+          - PolicyDocument:
+              Version: '2012-10-17'
+              Statement:
+                - Effect: Allow
+                  Action: ['sqs:SendMessage']
+                  Resource: '${QueueArn}'
+      CFNOutputs: [QueueURL]
+`), &sd)
+	assertor.NoError(err)
+
+	spec := toBindingSpec(sd)
+	expected := &BindingSpec{
+		AddKeypair: true,
+		Policies: []map[string]interface{}{{
+			"Version": "2012-10-17",
+			"Statement": []interface{}{map[string]interface{}{
+				"Effect":   "Allow",
+				"Action":   []interface{}{"sqs:SendMessage"},
+				"Resource": "${QueueArn}",
+			}},
+		}},
+		CFNOutputs: []string{"QueueURL"},
+	}
+	assertor.Equal(expected, spec)
+
+	// the spec is read back the same from the service and from the DataStore
+	actual, err := getBindingSpec(&osb.Service{Metadata: map[string]interface{}{"bindings": spec}})
+	assertor.NoError(err)
+	assertor.Equal(expected, actual)
+
+	actual, err = getBindingSpec(&osb.Service{})
+	assertor.NoError(err)
+	assertor.Nil(actual)
+
+	assertor.Nil(toBindingSpec(CfnTemplate{}))
+}
+
+func TestBindingSchema(t *testing.T) {
+	assertor := assert.New(t)
+
+	var sd CfnTemplate
+	err := yaml.Unmarshal([]byte(`
+Outputs:
+  QueueURL:
+    Description: The URL of the queue
+  QueueArn:
+    Description: The ARN of the queue
+  PolicyArn:
+    Value: !Ref Policy
+  PolicyArnReadOnly:
+    Value: !Ref ReadOnlyPolicy
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Name: test
+    Bindings:
+      CFNOutputs: [QueueURL]
+      ResourcePolicies:
+      - Type: SQS
+        Resource: QueueURL
+        Actions: [sqs:SendMessage]
+        Scope: SendOnly
+`), &sd)
+	assertor.NoError(err)
+
+	schema := toBindingSchema(sd, &osb.Service{Name: "test"})
+	params := schema.Create.Parameters.(map[string]interface{})["properties"].(map[string]interface{})
+	assertor.Equal([]string{"ReadOnly", "SendOnly"}, params["Scope"].(map[string]interface{})["enum"])
+	assertor.Equal([]string{"Static", "Temporary"}, params["CredentialsType"].(map[string]interface{})["enum"])
+	for _, k := range []string{"RoleName", "PrincipalType", "PrincipalName", "ServiceAccount", "PrincipalArn"} {
+		assertor.Contains(params, k)
+	}
+	credentials := schema.Create.Response.(map[string]interface{})["properties"].(map[string]interface{})
+	assertor.Equal(map[string]interface{}{"type": "string", "description": "The URL of the queue"}, credentials["QUEUE_URL"])
+	assertor.NotContains(credentials, "QUEUE_ARN", "should only describe the CFNOutputs")
+	assertor.NotContains(credentials, "POLICY_ARN")
+	assertor.Contains(credentials, "AWS_SESSION_TOKEN")
+
+	// templates without policies or resource policies only return their outputs
+	var keypair CfnTemplate
+	err = yaml.Unmarshal([]byte(`
+Outputs:
+  UserKeyId:
+    Description: The key id
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Name: test
+    OutputsAsIs: true
+    Bindings:
+      IAM:
+        AddKeypair: true
+`), &keypair)
+	assertor.NoError(err)
+
+	schema = toBindingSchema(keypair, &osb.Service{Name: "test", Metadata: map[string]interface{}{"outputsAsIs": true}})
+	assertor.Empty(schema.Create.Parameters.(map[string]interface{})["properties"])
+	credentials = schema.Create.Response.(map[string]interface{})["properties"].(map[string]interface{})
+	assertor.Equal(map[string]interface{}{"type": "string", "description": "The key id"}, credentials["TEST_USER_KEY_ID"])
+	assertor.Contains(credentials, "TEST_USER_SECRET_KEY")
+	assertor.Len(credentials, 2)
+}
+
+func TestFilterOutputs(t *testing.T) {
+	outputs := []*cloudformation.Output{
+		{OutputKey: aws.String("QueueURL"), OutputValue: aws.String("url")},
+		{OutputKey: aws.String("QueueArn"), OutputValue: aws.String("arn")},
+	}
+	assert.Equal(t, outputs, filterOutputs(outputs, nil))
+	assert.Equal(t, outputs, filterOutputs(outputs, &BindingSpec{}))
+	assert.Equal(t, outputs[:1], filterOutputs(outputs, &BindingSpec{CFNOutputs: []string{"QueueURL", "Missing"}}))
+}
+
+func TestSubstituteOutputs(t *testing.T) {
+	outputs := []*cloudformation.Output{
+		{OutputKey: aws.String("QueueArn"), OutputValue: aws.String("arn:aws:sqs:us-east-1:123456789012:myqueue")},
+	}
+	document := map[string]interface{}{
+		"Statement": []interface{}{map[string]interface{}{
+			"Resource":  []interface{}{"${QueueArn}", "${QueueArn}/*", "${Missing}"},
+			"Condition": map[string]interface{}{"StringEquals": map[string]interface{}{"aws:username": "${aws:username}"}},
+		}},
+	}
+	expected := map[string]interface{}{
+		"Statement": []interface{}{map[string]interface{}{
+			"Resource":  []interface{}{"arn:aws:sqs:us-east-1:123456789012:myqueue", "arn:aws:sqs:us-east-1:123456789012:myqueue/*", "${Missing}"},
+			"Condition": map[string]interface{}{"StringEquals": map[string]interface{}{"aws:username": "${aws:username}"}},
+		}},
+	}
+	assert.Equal(t, expected, substituteOutputs(document, outputs))
+}
+
+func TestBindingIAMName(t *testing.T) {
+	assert.Equal(t, "asb-6fb3ee41-0f94-4d4b-a0f6-a5c1d3c8e7a2", bindingIAMName("6fb3ee41-0f94-4d4b-a0f6-a5c1d3c8e7a2"))
+	// ids that aren't valid IAM names are hashed
+	assert.Equal(t, "asb-"+contentHash([]byte("a/b"))[:32], bindingIAMName("a/b"))
+}
+
+func TestRefreshBindingCredentials(t *testing.T) {
+	tests := []struct {
+		name          string
+		bindingID     string
+		expectedCreds map[string]interface{}
+		expectedErr   error
+	}{
+		{
+			name:        "error_getting_binding",
+			bindingID:   "err",
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service binding err: test failure"),
+		},
+		{
+			name:        "binding_not_found",
+			bindingID:   "foo",
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service binding foo was not found."),
+		},
+		{
+			name:        "static_credentials",
+			bindingID:   "exists",
+			expectedErr: newHTTPStatusCodeError(http.StatusBadRequest, "", "The service binding exists doesn't use temporary credentials."),
+		},
+		{
+			name:      "temporary_credentials",
+			bindingID: "exists-temporary",
+			expectedCreds: map[string]interface{}{
+				"AWS_ACCESS_KEY_ID":      "temporary-key-id",
+				"AWS_SECRET_ACCESS_KEY":  "temporary-secret-key",
+				"AWS_SESSION_TOKEN":      "session-token",
+				"AWS_SESSION_EXPIRATION": "2018-06-01T12:00:00Z",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			creds, err := b.RefreshBindingCredentials(tt.bindingID)
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expectedCreds, creds)
+			}
+		})
+	}
+}
+
+func TestParseOIDCIssuers(t *testing.T) {
+	issuers, err := parseOIDCIssuers("")
+	assert.NoError(t, err)
+	assert.Empty(t, issuers)
+
+	issuers, err = parseOIDCIssuers("a=https://oidc.eks.us-east-1.amazonaws.com/id/A, b=https://oidc.eks.us-west-2.amazonaws.com/id/B")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"a": "https://oidc.eks.us-east-1.amazonaws.com/id/A",
+		"b": "https://oidc.eks.us-west-2.amazonaws.com/id/B",
+	}, issuers)
+
+	_, err = parseOIDCIssuers("a")
+	assert.EqualError(t, err, `invalid oidcIssuers entry "a", expected cluster-id=https://issuer`)
+	_, err = parseOIDCIssuers("a=oidc.eks.us-east-1.amazonaws.com/id/A")
+	assert.Error(t, err)
+}
+
+func TestWebIdentityTrustPolicy(t *testing.T) {
+	expected := `{"Statement":[{"Action":"sts:AssumeRoleWithWebIdentity","Condition":{"StringEquals":{` +
+		`"oidc.eks.us-east-1.amazonaws.com/id/A:aud":"sts.amazonaws.com",` +
+		`"oidc.eks.us-east-1.amazonaws.com/id/A:sub":"system:serviceaccount:ns:app"}},` +
+		`"Effect":"Allow","Principal":{"Federated":"arn:aws:iam::123456789012:oidc-provider/oidc.eks.us-east-1.amazonaws.com/id/A"}}],` +
+		`"Version":"2012-10-17"}`
+	assert.Equal(t, expected, webIdentityTrustPolicy("aws", "123456789012", "https://oidc.eks.us-east-1.amazonaws.com/id/A/", "ns:app"))
+	assert.Contains(t, webIdentityTrustPolicy("aws-cn", "123456789012", "https://oidc.eks.cn-north-1.amazonaws.com.cn/id/A", "ns:app"),
+		`"Federated":"arn:aws-cn:iam::123456789012:oidc-provider/oidc.eks.cn-north-1.amazonaws.com.cn/id/A"`)
+}
+
+func TestBrokerPrincipalArn(t *testing.T) {
+	for callerArn, expected := range map[string]string{
+		"arn:aws:sts::123456789012:assumed-role/broker/i-0123456789abcdef0": "arn:aws:iam::123456789012:role/broker",
+		"arn:aws:iam::123456789012:user/brokers/broker":                     "arn:aws:iam::123456789012:user/brokers/broker",
+	} {
+		arn, err := brokerPrincipalArn(&mockIAM{}, callerArn)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, arn, callerArn)
+		assert.Equal(t, `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":"`+expected+`"},"Action":"sts:AssumeRole"}]}`, brokerTrustPolicy(arn))
+	}
+
+	_, err := brokerPrincipalArn(&mockIAM{}, "invalid")
+	assert.EqualError(t, err, "invalid caller ARN invalid")
+}
+
+type mockIAMPolicyDocument struct {
+	mockIAM
+	document string
+}
+
+func (c *mockIAMPolicyDocument) GetPolicyVersion(input *iam.GetPolicyVersionInput) (*iam.GetPolicyVersionOutput, error) {
+	return &iam.GetPolicyVersionOutput{PolicyVersion: &iam.PolicyVersion{Document: aws.String(c.document)}}, nil
+}
+
+func TestGetPolicyDocument(t *testing.T) {
+	document, err := getPolicyDocument(&mockIAMPolicyDocument{document: "%7B%22Condition%22%3A%22a+b%20c%22%7D"}, "exists")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Condition":"a+b c"}`, document, "should keep plus signs")
+}
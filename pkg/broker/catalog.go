@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// CatalogMiddleware adds the catalog fields of OSB API versions the vendored osb client predates to catalog
+// responses: maintenance_info (2.15) on plans, and instances_retrievable (2.14) and binding_rotatable (2.17) on
+// services
+func CatalogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if path, _ := route.GetPathTemplate(); path == "/v2/catalog" && r.Method == http.MethodGet {
+			serveCatalog(w, r, next)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// catalogService is an osb.Service with the catalog fields the vendored osb client predates
+type catalogService struct {
+	osb.Service
+	InstancesRetrievable bool          `json:"instances_retrievable"`
+	BindingRotatable     bool          `json:"binding_rotatable"`
+	Plans                []catalogPlan `json:"plans"`
+}
+
+// catalogPlan is an osb.Plan with the maintenance_info field the vendored osb client predates
+type catalogPlan struct {
+	osb.Plan
+	MaintenanceInfo *MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+// rewriteCatalog moves the maintenance_info of each plan in a catalog response out of the plan metadata, and marks
+// the services as supporting instance retrieval and binding rotation
+func rewriteCatalog(body []byte) ([]byte, error) {
+	var catalog struct {
+		Services []catalogService `json:"services"`
+	}
+	if err := json.Unmarshal(body, &catalog); err != nil {
+		return nil, err
+	}
+	for i := range catalog.Services {
+		service := &catalog.Services[i]
+		service.InstancesRetrievable = true
+		service.BindingRotatable = true
+		for j := range service.Plans {
+			plan := &service.Plans[j]
+			plan.MaintenanceInfo = getPlanMaintenanceInfo(&plan.Plan)
+			delete(plan.Metadata, "maintenance_info")
+		}
+	}
+	return json.Marshal(catalog)
+}
+
+// serveCatalog serves a catalog request, passing successful responses through rewriteCatalog. The response is served
+// as is when it can't be rewritten
+func serveCatalog(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	rec := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+	body := rec.body.Bytes()
+	if rec.status == http.StatusOK {
+		if b, err := rewriteCatalog(body); err != nil {
+			glog.Errorf("Failed to rewrite the catalog: %v", err)
+		} else {
+			body = b
+		}
+	}
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(rec.status)
+	w.Write(body)
+}
+
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header         { return r.header }
+func (r *responseRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *responseRecorder) WriteHeader(status int)      { r.status = status }
@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogMiddleware(t *testing.T) {
+	assertor := assert.New(t)
+
+	var calls int
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/catalog", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(osb.CatalogResponse{Services: []osb.Service{{
+			ID:       "test-service-id",
+			Metadata: map[string]interface{}{"displayName": "Test"},
+			Plans: []osb.Plan{
+				{ID: "versioned", Metadata: map[string]interface{}{"cost": "free", "maintenance_info": &MaintenanceInfo{Version: "1.0.0"}}},
+				{ID: "unversioned"},
+			},
+		}}})
+	}).Methods("GET")
+	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"plan_id": "versioned"}`))
+	}).Methods("GET")
+	router.Use(CatalogMiddleware)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/catalog", nil))
+	assertor.Equal(http.StatusOK, rec.Code)
+	assertor.Equal(1, calls)
+	assertor.Equal("application/json", rec.Header().Get("Content-Type"))
+	var catalog struct {
+		Services []struct {
+			Metadata             map[string]interface{} `json:"metadata"`
+			InstancesRetrievable bool                   `json:"instances_retrievable"`
+			BindingRotatable     bool                   `json:"binding_rotatable"`
+			Plans                []struct {
+				Metadata        map[string]interface{} `json:"metadata"`
+				MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info"`
+			} `json:"plans"`
+		} `json:"services"`
+	}
+	assertor.Nil(json.Unmarshal(rec.Body.Bytes(), &catalog))
+	service := catalog.Services[0]
+	assertor.True(service.InstancesRetrievable)
+	assertor.True(service.BindingRotatable)
+	assertor.Equal(map[string]interface{}{"displayName": "Test"}, service.Metadata)
+	assertor.Equal(&MaintenanceInfo{Version: "1.0.0"}, service.Plans[0].MaintenanceInfo, "should move maintenance_info out of the plan metadata")
+	assertor.Equal(map[string]interface{}{"cost": "free"}, service.Plans[0].Metadata)
+	assertor.Nil(service.Plans[1].MaintenanceInfo)
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v2/service_instances/test", nil))
+	assertor.Equal(`{"plan_id": "versioned"}`, rec.Body.String(), "should only rewrite catalog responses")
+}
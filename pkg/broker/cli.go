@@ -15,7 +15,13 @@ func AddFlags(o *Options) {
 	flag.StringVar(&o.S3Region, "s3Region", "us-east-1", "region S3 bucket is located in.")
 	flag.StringVar(&o.S3Key, "s3Key", "templates/latest/", "S3 key where templates are stored.")
 	flag.StringVar(&o.TemplateFilter, "templateFilter", "-main.yaml", "only process templates with the defined suffix.")
-	flag.StringVar(&o.CatalogPath, "catalogPath", "", "The path to the catalog.")
+	flag.StringVar(&o.CatalogPath, "catalogPath", "", "Path to a local directory (such as a mounted ConfigMap) to load templates from instead of S3.")
+	flag.StringVar(&o.TemplateIndexURL, "templateIndexUrl", "", "https url of a template index to load templates from instead of S3, mutually exclusive to catalogPath.")
+	flag.IntVar(&o.TemplateWorkers, "templateWorkers", 10, "Number of templates to fetch and convert in parallel when updating the catalog.")
+	flag.IntVar(&o.PollInterval, "pollInterval", 600, "Interval in seconds between catalog updates from the template source.")
+	flag.StringVar(&o.SQSQueueURL, "sqsQueueUrl", "", "URL of an SQS queue receiving S3 event notifications for the template bucket, used to update the catalog as soon as templates change.")
+	flag.BoolVar(&o.CatalogFallback, "catalogFallback", false, "Serve the catalog from the service definitions stored in DynamoDB when the template source is unavailable (degraded mode), instead of failing at startup.")
 	flag.StringVar(&o.BrokerID, "brokerId", "awsservicebroker", "An ID to use for partitioning broker data in DynamoDb. if multiple brokers are used in the same AWS account, this value must be unique per broker")
+	flag.StringVar(&o.OIDCIssuers, "oidcIssuers", "", "Comma separated list of cluster-id=issuer-url pairs giving the OIDC issuer of each Kubernetes cluster, used to create IAM roles for service accounts at bind time.")
 	flag.BoolVar(&o.PrescribeOverrides, "prescribeOverrides", false, "Plan properties that are globally overridden will be removed from service plan parameters, this enforces their values for users and simplifies the list of required parameters. Common overrides are aws_access_key, aws_secret_key, region and VpcId")
 }
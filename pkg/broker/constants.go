@@ -7,12 +7,26 @@ import (
 // CacheTTL TTL for catalog cache record expiry
 var CacheTTL = 1 * time.Hour
 
+// maxTemplateBodySize is the largest template CloudFormation accepts as a TemplateBody
+const maxTemplateBodySize = 51200
+
 var nonCfnParams = []string{
 	"region",
 	"target_role_name",
 	"target_account_id",
 	"user_tags",
 	"admin_tags",
+	"aws_access_key",
+	"aws_secret_key",
+}
+
+var awsTagSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"Key":   map[string]interface{}{"type": "string"},
+		"Value": map[string]interface{}{"type": "string"},
+	},
+	"required": []string{"Key", "Value"},
 }
 
 var nonCfnParamDefs = map[string]interface{}{
@@ -53,24 +67,97 @@ var nonCfnParamDefs = map[string]interface{}{
 		},
 	},
 	"user_tags": map[string]interface{}{
-		"description":   "AWS Resource tags to apply to resources (json formatted [{\"Key\": \"MyTagKey\", \"Value\": \"MyTagValue\"}, ...]",
+		"description":   "AWS Resource tags to apply to resources [{\"Key\": \"MyTagKey\", \"Value\": \"MyTagValue\"}, ...]",
 		"display_group": "AWS Account Information",
 		"title":         "AWS Tags",
-		"type":          "string",
-		"default":       "[]",
+		"type":          "array",
+		"items":         awsTagSchema,
+		"default":       []interface{}{},
 	},
 	"admin_tags": map[string]interface{}{
-		"description":   "AWS Resource tags to apply to resources (json formatted [{\"Key\": \"MyTagKey\", \"Value\": \"MyTagValue\"}, ...]",
+		"description":   "AWS Resource tags to apply to resources [{\"Key\": \"MyTagKey\", \"Value\": \"MyTagValue\"}, ...]",
 		"display_group": "AWS Account Information",
 		"title":         "Additional AWS Tags",
+		"type":          "array",
+		"items":         awsTagSchema,
+		"default":       []interface{}{},
+	},
+	"aws_access_key": map[string]interface{}{
+		"description":   "AWS access key id to provision with instead of the broker's credentials",
+		"display_group": "AWS Account Information",
+		"title":         "AWS Access Key ID",
+		"type":          "string",
+		"format":        "password",
+		"writeOnly":     true,
+	},
+	"aws_secret_key": map[string]interface{}{
+		"description":   "AWS secret access key to provision with instead of the broker's credentials",
+		"display_group": "AWS Account Information",
+		"title":         "AWS Secret Access Key",
 		"type":          "string",
-		"default":       "[]",
+		"format":        "password",
+		"writeOnly":     true,
 	},
 }
 
 const (
-	bindParamRoleName = "RoleName"
-	bindParamScope    = "Scope"
+	updateParamUpgradeTemplate = "upgrade_template"
+)
+
+const (
+	bindParamRoleName        = "RoleName"
+	bindParamScope           = "Scope"
+	bindParamCredentialsType = "CredentialsType"
+	bindParamServiceAccount  = "ServiceAccount"
+	bindParamPrincipalType   = "PrincipalType"
+	bindParamPrincipalName   = "PrincipalName"
+	bindParamPrincipalArn    = "PrincipalArn"
+)
+
+// IAM principals the policy of a binding can be attached to
+const (
+	principalTypeRole  = "role"
+	principalTypeUser  = "user"
+	principalTypeGroup = "group"
+)
+
+// Resources whose own policies can grant access to principals in other accounts
+const (
+	resourceTypeS3  = "S3"
+	resourceTypeSQS = "SQS"
+	resourceTypeSNS = "SNS"
+	resourceTypeKMS = "KMS"
+	// resourceStatementPrefix starts the Sid of the policy statements, and the name of the KMS grants, added for a
+	// binding
+	resourceStatementPrefix = "asb"
+)
+
+const (
+	credentialsTypeStatic    = "Static"
+	credentialsTypeTemporary = "Temporary"
+)
+
+// Role credentials are returned under the names the AWS SDKs read from the environment
+const (
+	credentialAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	credentialSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	credentialSessionToken    = "AWS_SESSION_TOKEN"
+	credentialExpiration      = "AWS_SESSION_EXPIRATION"
+	credentialRoleArn         = "AWS_ROLE_ARN"
+)
+
+const (
+	// GetParameters accepts at most 10 names
+	ssmGetParametersBatchSize = 10
+	// secretsmanager: references select a key of a JSON secret after this separator
+	secretJSONKeySeparator = "#"
+)
+
+const (
+	temporaryCredentialsDuration = 3600
+	// roles can't be assumed for a few seconds after they are created
+	assumeRoleAttempts   = 10
+	assumeRoleRetryDelay = 2 * time.Second
 )
 
 const (
@@ -78,8 +165,40 @@ const (
 	cfnOutputSSMValuePrefix  = "ssm:"
 	cfnOutputUserKeyID       = "UserKeyId"
 	cfnOutputUserSecretKey   = "UserSecretKey"
+	// Outputs with these values are replaced with the values they refer to, like those with cfnOutputSSMValuePrefix
+	cfnOutputSecretsManagerValuePrefix = "secretsmanager:"
+	cfnOutputKMSValuePrefix            = "kms:"
+	cfnOutputS3ValuePrefix             = "s3object:"
+	// Outputs with these values are replaced with the access key of the IAM user created for the binding
+	cfnOutputBindingAccessKeyID     = "binding:AccessKeyId"
+	cfnOutputBindingSecretAccessKey = "binding:SecretAccessKey"
+)
+
+const (
+	bindingIAMPrefix    = "asb-"
+	bindingIAMPath      = "/aws-service-broker/"
+	bindingPolicyPrefix = "binding-policy-"
+	// bindingSecretPrefix prefixes the Secrets Manager secrets holding the secret access keys of binding IAM users
+	bindingSecretPrefix = "aws-service-broker/bindings/"
+	// bindingSecretRecoveryDays is the shortest recovery window Secrets Manager accepts for deleted secrets
+	bindingSecretRecoveryDays = 7
 )
 
 const (
 	templateIDRegex = `\(qs-[a-z0-9]{9}\)`
 )
+
+// maskedParamValue replaces the values of NoEcho parameters when instances are fetched
+const maskedParamValue = "****"
+
+// awsParamTypePatterns are the id formats of AWS-specific CloudFormation parameter types
+var awsParamTypePatterns = map[string]string{
+	"AWS::EC2::AvailabilityZone::Name": `^[a-z]{2}(-gov)?-[a-z]+-[0-9][a-z]$`,
+	"AWS::EC2::Image::Id":              `^ami-([0-9a-f]{8}|[0-9a-f]{17})$`,
+	"AWS::EC2::Instance::Id":           `^i-([0-9a-f]{8}|[0-9a-f]{17})$`,
+	"AWS::EC2::SecurityGroup::Id":      `^sg-([0-9a-f]{8}|[0-9a-f]{17})$`,
+	"AWS::EC2::Subnet::Id":             `^subnet-([0-9a-f]{8}|[0-9a-f]{17})$`,
+	"AWS::EC2::Volume::Id":             `^vol-([0-9a-f]{8}|[0-9a-f]{17})$`,
+	"AWS::EC2::VPC::Id":                `^vpc-([0-9a-f]{8}|[0-9a-f]{17})$`,
+	"AWS::Route53::HostedZone::Id":     `^Z[0-9A-Z]{1,32}$`,
+}
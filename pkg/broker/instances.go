@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// GetInstanceResponse is the response to `GET /v2/service_instances/:instance_id`. Fetching instances is part of OSB
+// API 2.14, which the vendored broker library has no handler for
+type GetInstanceResponse struct {
+	ServiceID       string                 `json:"service_id"`
+	PlanID          string                 `json:"plan_id"`
+	DashboardURL    *string                `json:"dashboard_url,omitempty"`
+	Parameters      map[string]interface{} `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo       `json:"maintenance_info,omitempty"`
+}
+
+// GetInstance is executed when the OSB API receives `GET /v2/service_instances/:instance_id`
+// (https://github.com/openservicebrokerapi/servicebroker/blob/v2.14/spec.md#fetching-a-service-instance).
+func (b *AwsBroker) GetInstance(instanceID string) (*GetInstanceResponse, error) {
+	// Get the instance
+	instance, err := b.db.DataStorePort.GetServiceInstance(instanceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service instance %s: %v", instanceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if instance == nil {
+		desc := fmt.Sprintf("The service instance %s was not found.", instanceID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	}
+
+	// Get the service and plan, which tell which parameters are NoEcho
+	service, err := b.db.DataStorePort.GetServiceDefinition(instance.ServiceID)
+	if err != nil {
+		desc := fmt.Sprintf("Failed to get the service %s: %v", instance.ServiceID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	} else if service == nil {
+		desc := fmt.Sprintf("The service %s was not found.", instance.ServiceID)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	plan := getPlan(service, instance.PlanID)
+	if plan == nil {
+		desc := fmt.Sprintf("The service plan %s was not found.", instance.PlanID)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+
+	// Instances can't be fetched while they are provisioned or updated
+	cfnSvc := b.Clients.NewCfn(b.GetSession(b.keyid, b.secretkey, b.region, b.accountId, b.profile, instance.Params))
+	resp, err := cfnSvc.Client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(instance.StackID),
+	})
+	if err != nil {
+		desc := fmt.Sprintf("Failed to describe the CloudFormation stack %s: %v", instance.StackID, err)
+		return nil, newHTTPStatusCodeError(http.StatusInternalServerError, "", desc)
+	}
+	status := aws.StringValue(resp.Stacks[0].StackStatus)
+	if status == cloudformation.StackStatusCreateInProgress {
+		desc := fmt.Sprintf("The service instance %s is still being provisioned.", instanceID)
+		return nil, newHTTPStatusCodeError(http.StatusNotFound, "", desc)
+	} else if strings.HasSuffix(status, "_IN_PROGRESS") {
+		desc := fmt.Sprintf("The CloudFormation stack %s of service instance %s is %s.", instance.StackID, instanceID, status)
+		return nil, newHTTPStatusCodeError(http.StatusUnprocessableEntity, "ConcurrencyError", desc)
+	}
+
+	response := &GetInstanceResponse{
+		ServiceID:  instance.ServiceID,
+		PlanID:     instance.PlanID,
+		Parameters: instanceParameters(plan, instance.Params),
+	}
+	if dashboardURL := stackConsoleURL(instance.StackID); dashboardURL != "" {
+		response.DashboardURL = aws.String(dashboardURL)
+	}
+	if instance.MaintenanceVersion != "" {
+		response.MaintenanceInfo = &MaintenanceInfo{Version: instance.MaintenanceVersion}
+	}
+	return response, nil
+}
+
+// instanceParameters converts the stored parameters of an instance to the types of the plan's schema, masking the
+// values of write-only parameters
+func instanceParameters(plan *osb.Plan, params map[string]string) map[string]interface{} {
+	var schema interface{}
+	if plan.Schemas != nil && plan.Schemas.ServiceInstance != nil && plan.Schemas.ServiceInstance.Create != nil {
+		schema = plan.Schemas.ServiceInstance.Create.Parameters
+	}
+	values := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		p, _ := getParamSchema(schema, k).(map[string]interface{})
+		if writeOnly, _ := p["writeOnly"].(bool); writeOnly {
+			values[k] = maskedParamValue
+		} else if p != nil {
+			values[k] = cfnValueToSchema(p, v)
+		} else {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// stackConsoleURL returns the URL of a stack in the CloudFormation console, or an empty string if the stack id isn't
+// an ARN
+func stackConsoleURL(stackID string) string {
+	parts := strings.SplitN(stackID, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "cloudformation" {
+		return ""
+	}
+	host := "console.aws.amazon.com"
+	switch parts[1] {
+	case "aws-cn":
+		host = "console.amazonaws.cn"
+	case "aws-us-gov":
+		host = "console.amazonaws-us-gov.com"
+	}
+	return fmt.Sprintf("https://%s/cloudformation/home?region=%s#/stacks/stackinfo?stackId=%s", host, parts[3], url.QueryEscape(stackID))
+}
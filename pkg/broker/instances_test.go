@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetInstance(t *testing.T) {
+	tests := []struct {
+		name        string
+		instanceID  string
+		stackStatus string
+		expected    *GetInstanceResponse
+		expectedErr error
+	}{
+		{
+			name:        "error_getting_instance",
+			instanceID:  "err",
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to get the service instance err: test failure"),
+		},
+		{
+			name:        "instance_not_found",
+			instanceID:  "foo",
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service instance foo was not found."),
+		},
+		{
+			name:        "plan_not_found",
+			instanceID:  "foo-plan",
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "The service plan foo was not found."),
+		},
+		{
+			name:        "error_describing_stack",
+			instanceID:  "err-stack",
+			expectedErr: newHTTPStatusCodeError(http.StatusInternalServerError, "", "Failed to describe the CloudFormation stack err: test failure"),
+		},
+		{
+			name:        "provisioning",
+			instanceID:  "exists",
+			stackStatus: cloudformation.StackStatusCreateInProgress,
+			expectedErr: newHTTPStatusCodeError(http.StatusNotFound, "", "The service instance exists is still being provisioned."),
+		},
+		{
+			name:        "updating",
+			instanceID:  "exists",
+			stackStatus: cloudformation.StackStatusUpdateInProgress,
+			expectedErr: newHTTPStatusCodeError(http.StatusUnprocessableEntity, "ConcurrencyError", "The CloudFormation stack an-id of service instance exists is UPDATE_IN_PROGRESS."),
+		},
+		{
+			name:        "success",
+			instanceID:  "exists",
+			stackStatus: cloudformation.StackStatusUpdateComplete,
+			expected: &GetInstanceResponse{
+				ServiceID:       "test-service-id",
+				PlanID:          "test-plan-id",
+				Parameters:      map[string]interface{}{"req_param": "a-value"},
+				MaintenanceInfo: &MaintenanceInfo{Version: "1.0.0"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clients := mockClients
+			clients.NewCfn = func(sess *session.Session) CfnClient {
+				return CfnClient{Client: mockCfn{DescribeStacksResponse: cloudformation.DescribeStacksOutput{
+					Stacks: []*cloudformation.Stack{{StackStatus: aws.String(tt.stackStatus)}},
+				}}}
+			}
+			b, _ := NewAWSBroker(Options{}, mockGetAwsSession, clients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+			b.db.DataStorePort = mockDataStoreProvision{}
+
+			resp, err := b.GetInstance(tt.instanceID)
+			if tt.expectedErr != nil {
+				assert.EqualError(t, err, tt.expectedErr.Error())
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.expected, resp)
+			}
+		})
+	}
+}
+
+func TestInstanceParameters(t *testing.T) {
+	plan := &osb.Plan{Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{Create: &osb.InputParametersSchema{
+		Parameters: map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+			"MasterUsername": map[string]interface{}{"type": "string"},
+			"MasterPassword": map[string]interface{}{"type": "string", "format": "password", "writeOnly": true},
+			"Port":           map[string]interface{}{"type": "number"},
+			"Subnets":        map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"aws_secret_key": nonCfnParamDefs["aws_secret_key"],
+		}},
+	}}}}
+	params := map[string]string{
+		"MasterUsername": "admin",
+		"MasterPassword": "hunter22",
+		"Port":           "5432",
+		"Subnets":        "subnet-1,subnet-2",
+		"region":         "us-east-1",
+		"aws_secret_key": "secret",
+	}
+	assert.Equal(t, map[string]interface{}{
+		"MasterUsername": "admin",
+		"MasterPassword": "****",
+		"Port":           float64(5432),
+		"Subnets":        []interface{}{"subnet-1", "subnet-2"},
+		"region":         "us-east-1",
+		"aws_secret_key": "****",
+	}, instanceParameters(plan, params))
+
+	// plans without schemas return the stored values
+	assert.Equal(t, map[string]interface{}{"Port": "5432"}, instanceParameters(&osb.Plan{}, map[string]string{"Port": "5432"}))
+}
+
+func TestStackConsoleURL(t *testing.T) {
+	assert.Equal(t, "https://console.aws.amazon.com/cloudformation/home?region=us-west-2#/stacks/stackinfo?stackId="+
+		"arn%3Aaws%3Acloudformation%3Aus-west-2%3A123456789012%3Astack%2Fmystack%2F1c2fa620-982a-11e3-aff7-50e2416294e0",
+		stackConsoleURL("arn:aws:cloudformation:us-west-2:123456789012:stack/mystack/1c2fa620-982a-11e3-aff7-50e2416294e0"))
+	assert.Equal(t, "https://console.amazonaws.cn/cloudformation/home?region=cn-north-1#/stacks/stackinfo?stackId="+
+		"arn%3Aaws-cn%3Acloudformation%3Acn-north-1%3A123456789012%3Astack%2Fmystack%2Fid",
+		stackConsoleURL("arn:aws-cn:cloudformation:cn-north-1:123456789012:stack/mystack/id"))
+	assert.Equal(t, "", stackConsoleURL("an-id"))
+}
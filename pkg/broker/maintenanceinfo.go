@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+// MaintenanceInfo describes the version of the template a plan or service instance runs. It is part of OSB API 2.15,
+// which the vendored osb client predates, so it is kept in the plan metadata and moved into place by CatalogMiddleware
+type MaintenanceInfo struct {
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type maintenanceInfoKey struct{}
+
+var semverRegex = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?$`)
+
+// toMaintenanceInfo converts a template Spec.Version such as 1.0 into semantic versioned maintenance info, returns
+// nil when the version can't be converted
+func toMaintenanceInfo(version string) *MaintenanceInfo {
+	m := semverRegex.FindStringSubmatch(strings.TrimSpace(version))
+	if m == nil {
+		return nil
+	}
+	parts := make([]string, 3)
+	for i := range parts {
+		n, _ := strconv.Atoi(m[i+1])
+		parts[i] = strconv.Itoa(n)
+	}
+	return &MaintenanceInfo{
+		Version:     strings.Join(parts, "."),
+		Description: "Template version " + version,
+	}
+}
+
+// getPlanMaintenanceInfo returns the maintenance info of the plan, or nil if it has none
+func getPlanMaintenanceInfo(plan *osb.Plan) *MaintenanceInfo {
+	if plan.Metadata == nil {
+		return nil
+	}
+	switch mi := plan.Metadata["maintenance_info"].(type) {
+	case *MaintenanceInfo:
+		return mi
+	case MaintenanceInfo:
+		return &mi
+	case map[string]interface{}:
+		// service definitions read back from the DataStore
+		version, _ := mi["version"].(string)
+		description, _ := mi["description"].(string)
+		if version != "" {
+			return &MaintenanceInfo{Version: version, Description: description}
+		}
+	}
+	return nil
+}
+
+// getRequestMaintenanceInfo returns the maintenance info sent with a provision or update request, or nil if none was
+// sent
+func getRequestMaintenanceInfo(c *broker.RequestContext) *MaintenanceInfo {
+	if c == nil || c.Request == nil {
+		return nil
+	}
+	mi, _ := c.Request.Context().Value(maintenanceInfoKey{}).(*MaintenanceInfo)
+	return mi
+}
+
+// MaintenanceInfoMiddleware makes the maintenance_info sent with provision and update requests available through the
+// request context
+func MaintenanceInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, _ := route.GetPathTemplate()
+		switch {
+		case path == "/v2/service_instances/{instance_id}" && (r.Method == http.MethodPut || r.Method == http.MethodPatch):
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var req struct {
+				MaintenanceInfo *MaintenanceInfo `json:"maintenance_info"`
+			}
+			if json.Unmarshal(body, &req) == nil && req.MaintenanceInfo != nil {
+				r = r.WithContext(context.WithValue(r.Context(), maintenanceInfoKey{}, req.MaintenanceInfo))
+			}
+			next.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
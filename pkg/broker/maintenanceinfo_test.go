@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToMaintenanceInfo(t *testing.T) {
+	assertor := assert.New(t)
+	for version, expected := range map[string]string{
+		"1":      "1.0.0",
+		"1.0":    "1.0.0",
+		"v2.1":   "2.1.0",
+		"1.02.3": "1.2.3",
+	} {
+		mi := toMaintenanceInfo(version)
+		if assertor.NotNil(mi, version) {
+			assertor.Equal(expected, mi.Version)
+			assertor.Equal("Template version "+version, mi.Description)
+		}
+	}
+	for _, version := range []string{"", "latest", "1.0.0.0", "1.0-beta"} {
+		assertor.Nil(toMaintenanceInfo(version), version)
+	}
+
+	assertor.Nil(getPlanMaintenanceInfo(&osb.Plan{}))
+	assertor.Equal(&MaintenanceInfo{Version: "1.0.0"}, getPlanMaintenanceInfo(&osb.Plan{Metadata: map[string]interface{}{
+		"maintenance_info": &MaintenanceInfo{Version: "1.0.0"},
+	}}))
+	assertor.Equal(&MaintenanceInfo{Version: "1.0.0", Description: "desc"}, getPlanMaintenanceInfo(&osb.Plan{Metadata: map[string]interface{}{
+		"maintenance_info": map[string]interface{}{"version": "1.0.0", "description": "desc"},
+	}}), "should read maintenance info from stored service definitions")
+}
+
+func TestMaintenanceInfoMiddleware(t *testing.T) {
+	assertor := assert.New(t)
+
+	var received *MaintenanceInfo
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}", func(w http.ResponseWriter, r *http.Request) {
+		received = getRequestMaintenanceInfo(&broker.RequestContext{Request: r})
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}).Methods("PATCH")
+	router.Use(MaintenanceInfoMiddleware)
+
+	body := `{"service_id": "test-service-id", "maintenance_info": {"version": "2.0.0"}}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/v2/service_instances/test", strings.NewReader(body)))
+	assertor.Equal(&MaintenanceInfo{Version: "2.0.0"}, received, "should pass maintenance_info to the broker")
+	assertor.Equal(body, rec.Body.String(), "should leave the request body readable")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/v2/service_instances/test", strings.NewReader(`{}`)))
+	assertor.Nil(received)
+}
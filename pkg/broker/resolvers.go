@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// CredentialResolver returns the values of the references given, the stack output values without the prefix the
+// resolver is registered for, keyed by reference. All references with the same prefix are resolved in one call
+type CredentialResolver func(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error)
+
+var credentialResolvers = map[string]CredentialResolver{
+	cfnOutputSSMValuePrefix:            resolveSsmParameters,
+	cfnOutputSecretsManagerValuePrefix: resolveSecrets,
+	cfnOutputKMSValuePrefix:            resolveCiphertexts,
+	cfnOutputS3ValuePrefix:             resolveS3Objects,
+}
+
+// RegisterCredentialResolver makes bindings return the values resolver returns for stack outputs whose value starts
+// with prefix, replacing any resolver registered for the same prefix. Resolvers must be registered before the broker
+// serves requests
+func RegisterCredentialResolver(prefix string, resolver CredentialResolver) {
+	credentialResolvers[prefix] = resolver
+}
+
+// credentialResolverPrefix returns the longest prefix of value a resolver is registered for, or an empty string if
+// there is none
+func credentialResolverPrefix(value string) string {
+	var prefix string
+	for p := range credentialResolvers {
+		if strings.HasPrefix(value, p) && len(p) > len(prefix) {
+			prefix = p
+		}
+	}
+	return prefix
+}
+
+// resolveSsmParameters gets the decrypted values of SSM parameters, in batches of the most names GetParameters accepts
+func resolveSsmParameters(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error) {
+	ssmSvc := clients.NewSsm(sess)
+	values := make(map[string]string, len(refs))
+	for i := 0; i < len(refs); i += ssmGetParametersBatchSize {
+		end := i + ssmGetParametersBatchSize
+		if end > len(refs) {
+			end = len(refs)
+		}
+		resp, err := ssmSvc.GetParameters(&ssm.GetParametersInput{
+			Names:          aws.StringSlice(refs[i:end]),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, err
+		} else if len(resp.InvalidParameters) > 0 {
+			return nil, fmt.Errorf("invalid parameters: %v", aws.StringValueSlice(resp.InvalidParameters))
+		}
+		for _, p := range resp.Parameters {
+			values[aws.StringValue(p.Name)] = aws.StringValue(p.Value)
+		}
+	}
+	return values, nil
+}
+
+// resolveSecrets gets the values of Secrets Manager secrets. References are a secret id or ARN, optionally followed
+// by secretJSONKeySeparator and the key of a JSON secret to return the value of
+func resolveSecrets(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error) {
+	smSvc := clients.NewSecretsManager(sess)
+	secrets := make(map[string]string)
+	values := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		parts := strings.SplitN(ref, secretJSONKeySeparator, 2)
+		secret, ok := secrets[parts[0]]
+		if !ok {
+			resp, err := smSvc.GetSecretValue(&secretsmanager.GetSecretValueInput{
+				SecretId: aws.String(parts[0]),
+			})
+			if err != nil {
+				return nil, err
+			}
+			if resp.SecretString != nil {
+				secret = aws.StringValue(resp.SecretString)
+			} else {
+				secret = string(resp.SecretBinary)
+			}
+			secrets[parts[0]] = secret
+		}
+		if len(parts) == 1 {
+			values[ref] = secret
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+			return nil, fmt.Errorf("secret %s is not a JSON object: %v", parts[0], err)
+		}
+		field, ok := fields[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("secret %s has no key %s", parts[0], parts[1])
+		}
+		if s, ok := field.(string); ok {
+			values[ref] = s
+		} else {
+			b, _ := json.Marshal(field)
+			values[ref] = string(b)
+		}
+	}
+	return values, nil
+}
+
+// resolveCiphertexts decrypts base64 encoded KMS ciphertexts
+func resolveCiphertexts(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error) {
+	kmsSvc := clients.NewKms(sess)
+	values := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		blob, err := base64.StdEncoding.DecodeString(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ciphertext %s: %v", ref, err)
+		}
+		resp, err := kmsSvc.Decrypt(&kms.DecryptInput{
+			CiphertextBlob: blob,
+		})
+		if err != nil {
+			return nil, err
+		}
+		values[ref] = string(resp.Plaintext)
+	}
+	return values, nil
+}
+
+// resolveS3Objects gets the contents of S3 objects. References are bucket/key
+func resolveS3Objects(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error) {
+	s3Svc := clients.NewS3(sess).Client
+	values := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid S3 object %s, expected bucket/key", ref)
+		}
+		resp, err := s3Svc.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(parts[0]),
+			Key:    aws.String(parts[1]),
+		})
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		values[ref] = string(body)
+	}
+	return values, nil
+}
+
+// resolveCredentials replaces the credentials that refer to values stored elsewhere with those values. refs holds
+// the credential keys to replace for each prefix and reference
+func resolveCredentials(sess *session.Session, clients AwsClients, credentials map[string]interface{}, refs map[string]map[string][]string) error {
+	prefixes := make([]string, 0, len(refs))
+	for p := range refs {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	for _, p := range prefixes {
+		names := make([]string, 0, len(refs[p]))
+		for ref := range refs[p] {
+			names = append(names, ref)
+		}
+		sort.Strings(names)
+
+		values, err := credentialResolvers[p](sess, clients, names)
+		if err != nil {
+			return err
+		}
+		for _, ref := range names {
+			v, ok := values[ref]
+			if !ok {
+				return fmt.Errorf("no value found for %s%s", p, ref)
+			}
+			for _, k := range refs[p][ref] {
+				credentials[k] = v
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	calls *int
+}
+
+func (m mockSecretsManager) GetSecretValue(in *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	if m.calls != nil {
+		*m.calls++
+	}
+	switch aws.StringValue(in.SecretId) {
+	case "plain":
+		return &secretsmanager.GetSecretValueOutput{SecretString: aws.String("plain-secret")}, nil
+	case "json":
+		return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(`{"username": "admin", "port": 5432}`)}, nil
+	case "binary":
+		return &secretsmanager.GetSecretValueOutput{SecretBinary: []byte("binary-secret")}, nil
+	case bindingSecretPrefix + "asb-exists-user-name/key-id":
+		return &secretsmanager.GetSecretValueOutput{SecretString: aws.String("secret-key")}, nil
+	}
+	return nil, errors.New("test failure")
+}
+
+func (m mockSecretsManager) CreateSecret(in *secretsmanager.CreateSecretInput) (*secretsmanager.CreateSecretOutput, error) {
+	if strings.Contains(aws.StringValue(in.Name), "fail") {
+		return nil, errors.New("test failure")
+	}
+	return &secretsmanager.CreateSecretOutput{Name: in.Name}, nil
+}
+
+func (m mockSecretsManager) DeleteSecret(in *secretsmanager.DeleteSecretInput) (*secretsmanager.DeleteSecretOutput, error) {
+	if strings.Contains(aws.StringValue(in.SecretId), "err") {
+		return nil, errors.New("test failure")
+	}
+	return &secretsmanager.DeleteSecretOutput{}, nil
+}
+
+func mockAwsSecretsManagerClientGetter(sess *session.Session) secretsmanageriface.SecretsManagerAPI {
+	return mockSecretsManager{}
+}
+
+// mock SSM client that fails requests for more names than GetParameters accepts
+type mockSsmBatches struct {
+	ssmiface.SSMAPI
+	calls *int
+}
+
+func (m mockSsmBatches) GetParameters(in *ssm.GetParametersInput) (*ssm.GetParametersOutput, error) {
+	*m.calls++
+	if len(in.Names) > 10 {
+		return nil, errors.New("too many names")
+	}
+	output := ssm.GetParametersOutput{}
+	for _, n := range in.Names {
+		output.Parameters = append(output.Parameters, &ssm.Parameter{Name: n, Value: aws.String("val-" + aws.StringValue(n))})
+	}
+	return &output, nil
+}
+
+type mockS3Objects struct {
+	s3iface.S3API
+}
+
+func (m mockS3Objects) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	if aws.StringValue(in.Bucket) == "err" {
+		return nil, errors.New("test failure")
+	}
+	body := fmt.Sprintf("%s/%s", aws.StringValue(in.Bucket), aws.StringValue(in.Key))
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestGetCredentialsResolvers(t *testing.T) {
+	assertor := assert.New(t)
+
+	service := osb.Service{Name: "testsvc"}
+	clients := mockClients
+	clients.NewSsm = func(sess *session.Session) ssmiface.SSMAPI { return mockSsmGetParameters{} }
+	clients.NewS3 = func(sess *session.Session) S3Client { return S3Client{Client: mockS3Objects{}} }
+	outputs := []*cloudformation.Output{
+		{OutputKey: aws.String("Ssm"), OutputValue: aws.String("ssm:param")},
+		{OutputKey: aws.String("Secret"), OutputValue: aws.String("secretsmanager:plain")},
+		{OutputKey: aws.String("Username"), OutputValue: aws.String("secretsmanager:json#username")},
+		{OutputKey: aws.String("Port"), OutputValue: aws.String("secretsmanager:json#port")},
+		{OutputKey: aws.String("Binary"), OutputValue: aws.String("secretsmanager:binary")},
+		{OutputKey: aws.String("Encrypted"), OutputValue: aws.String("kms:Y2lwaGVydGV4dA==")},
+		{OutputKey: aws.String("Object"), OutputValue: aws.String("s3object:bucket/path/to/key")},
+		{OutputKey: aws.String("OutputLocation"), OutputValue: aws.String("s3://bucket/")},
+		{OutputKey: aws.String("Plain"), OutputValue: aws.String("https://example.com")},
+	}
+
+	expected := map[string]interface{}{
+		"SSM":             "val-param",
+		"SECRET":          "plain-secret",
+		"USERNAME":        "admin",
+		"PORT":            "5432",
+		"BINARY":          "binary-secret",
+		"ENCRYPTED":       "decrypted-ciphertext",
+		"OBJECT":          "bucket/path/to/key",
+		"OUTPUT_LOCATION": "s3://bucket/",
+		"PLAIN":           "https://example.com",
+	}
+	actual, err := getCredentials(&service, outputs, nil, clients)
+	assertor.Nil(err)
+	assertor.Equal(expected, actual)
+
+	for value, expectedErr := range map[string]string{
+		"secretsmanager:err":           "test failure",
+		"secretsmanager:plain#key":     "secret plain is not a JSON object: invalid character 'p' looking for beginning of value",
+		"secretsmanager:json#password": "secret json has no key password",
+		"kms:not base64":               "invalid ciphertext not base64: illegal base64 data at input byte 3",
+		"s3object:bucket":              "invalid S3 object bucket, expected bucket/key",
+		"s3object:err/key":             "test failure",
+	} {
+		_, err := getCredentials(&service, []*cloudformation.Output{{OutputKey: aws.String("Test"), OutputValue: aws.String(value)}}, nil, clients)
+		if assertor.Error(err, value) {
+			assertor.Equal(expectedErr, err.Error(), value)
+		}
+	}
+}
+
+func TestResolveSsmParameters(t *testing.T) {
+	assertor := assert.New(t)
+
+	var calls int
+	clients := AwsClients{NewSsm: func(sess *session.Session) ssmiface.SSMAPI { return mockSsmBatches{calls: &calls} }}
+	refs := make([]string, 25)
+	for i := range refs {
+		refs[i] = fmt.Sprintf("param-%d", i)
+	}
+
+	values, err := resolveSsmParameters(nil, clients, refs)
+	assertor.Nil(err)
+	assertor.Equal(3, calls, "should get the parameters in batches of 10")
+	assertor.Len(values, 25)
+	assertor.Equal("val-param-24", values["param-24"])
+}
+
+func TestResolveSecrets(t *testing.T) {
+	var calls int
+	clients := AwsClients{NewSecretsManager: func(sess *session.Session) secretsmanageriface.SecretsManagerAPI {
+		return mockSecretsManager{calls: &calls}
+	}}
+
+	values, err := resolveSecrets(nil, clients, []string{"json#username", "json#port", "json"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"json#username": "admin", "json#port": "5432", "json": `{"username": "admin", "port": 5432}`}, values)
+	assert.Equal(t, 1, calls, "should get each secret once")
+}
+
+func TestRegisterCredentialResolver(t *testing.T) {
+	assertor := assert.New(t)
+
+	RegisterCredentialResolver("vault:", func(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error) {
+		values := make(map[string]string)
+		for _, ref := range refs {
+			values[ref] = "vault-" + ref
+		}
+		return values, nil
+	})
+	defer delete(credentialResolvers, "vault:")
+
+	assertor.Equal("vault:", credentialResolverPrefix("vault:secret"))
+	assertor.Equal("", credentialResolverPrefix("secret"))
+
+	outputs := []*cloudformation.Output{
+		{OutputKey: aws.String("First"), OutputValue: aws.String("vault:secret")},
+		{OutputKey: aws.String("Second"), OutputValue: aws.String("vault:secret")},
+	}
+	actual, err := getCredentials(&osb.Service{Name: "testsvc"}, outputs, nil, AwsClients{})
+	assertor.Nil(err)
+	assertor.Equal(map[string]interface{}{"FIRST": "vault-secret", "SECOND": "vault-secret"}, actual)
+
+	RegisterCredentialResolver("vault:", func(sess *session.Session, clients AwsClients, refs []string) (map[string]string, error) {
+		return map[string]string{}, nil
+	})
+	_, err = getCredentials(&osb.Service{Name: "testsvc"}, outputs, nil, AwsClients{})
+	if assertor.Error(err) {
+		assertor.Equal("no value found for vault:secret", err.Error())
+	}
+}
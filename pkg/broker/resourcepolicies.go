@@ -0,0 +1,311 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+)
+
+// ResourcePolicySpec declares a resource of the stack that can grant access to principals in other accounts through
+// its own policy
+type ResourcePolicySpec struct {
+	// Type is S3, SQS, SNS or KMS
+	Type string `yaml:"Type" json:"type"`
+	// Resource is the stack output holding the bucket name, queue URL, topic ARN or key id
+	Resource string `yaml:"Resource" json:"resource"`
+	// Actions are granted to the principal of the binding, for KMS they are the operations of the grant
+	Actions []string `yaml:"Actions" json:"actions"`
+	// Scope is the binding Scope the actions are granted for, empty for bindings without one
+	Scope string `yaml:"Scope,omitempty" json:"scope,omitempty"`
+}
+
+var (
+	principalArnRegex = regexp.MustCompile(`^arn:aws[\w-]*:iam::\d{12}:(root|user/.+|role/.+)$`)
+	statementIDRegex  = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+)
+
+// resourceStatementID returns the Sid of the policy statements, and the name of the KMS grants, added for a binding.
+// Binding ids that aren't valid in a Sid are hashed
+func resourceStatementID(bindingID string) string {
+	if len(bindingID) <= 64 && statementIDRegex.MatchString(bindingID) {
+		return resourceStatementPrefix + bindingID
+	}
+	return resourceStatementPrefix + contentHash([]byte(bindingID))[:32]
+}
+
+// getResourcePolicies returns the resource policies of the binding spec for a binding scope
+func getResourcePolicies(spec *BindingSpec, scope string) []ResourcePolicySpec {
+	if spec == nil {
+		return nil
+	}
+	var policies []ResourcePolicySpec
+	for _, p := range spec.ResourcePolicies {
+		if strings.EqualFold(p.Scope, scope) {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// grantResourcePolicies grants the PrincipalArn of a binding access to each resource of the policies, and records the
+// resources on the binding so they can be revoked
+func (b *AwsBroker) grantResourcePolicies(sess *session.Session, binding *serviceinstance.ServiceBinding, policies []ResourcePolicySpec, outputs []*cloudformation.Output) error {
+	sid := resourceStatementID(binding.ID)
+	for _, p := range policies {
+		resource := ""
+		for _, o := range outputs {
+			if aws.StringValue(o.OutputKey) == p.Resource {
+				resource = aws.StringValue(o.OutputValue)
+			}
+		}
+		if resource == "" {
+			return fmt.Errorf("output not found: %s", p.Resource)
+		}
+		grant := serviceinstance.ResourceGrant{Type: strings.ToUpper(p.Type), Resource: resource}
+		if err := b.grantResourceAccess(sess, grant, sid, binding.PrincipalArn, p.Actions); err != nil {
+			return fmt.Errorf("failed to grant access to %s %s: %v", grant.Type, grant.Resource, err)
+		}
+		binding.ResourceGrants = append(binding.ResourceGrants, grant)
+	}
+	return nil
+}
+
+// grantResourceAccess adds the statement of a binding to the policy of a resource, or creates a grant for KMS keys
+func (b *AwsBroker) grantResourceAccess(sess *session.Session, grant serviceinstance.ResourceGrant, sid string, principalArn string, actions []string) error {
+	switch grant.Type {
+	case resourceTypeS3:
+		return setBucketPolicyStatement(b.Clients.NewS3(sess).Client, grant.Resource, sid, principalArn, actions)
+	case resourceTypeSQS:
+		return setQueuePolicyStatement(b.Clients.NewSqs(sess), grant.Resource, sid, principalArn, actions)
+	case resourceTypeSNS:
+		return setTopicPolicyStatement(b.Clients.NewSns(sess), grant.Resource, sid, principalArn, actions)
+	case resourceTypeKMS:
+		return createKeyGrant(b.Clients.NewKms(sess), grant.Resource, sid, principalArn, actions)
+	}
+	return fmt.Errorf("unsupported resource type %s", grant.Type)
+}
+
+// revokeResourceAccess removes the statement of a binding from the policy of a resource, or revokes its KMS grants. A
+// resource that doesn't exist is not an error
+func (b *AwsBroker) revokeResourceAccess(sess *session.Session, grant serviceinstance.ResourceGrant, sid string) error {
+	var err error
+	switch grant.Type {
+	case resourceTypeS3:
+		err = setBucketPolicyStatement(b.Clients.NewS3(sess).Client, grant.Resource, sid, "", nil)
+	case resourceTypeSQS:
+		err = setQueuePolicyStatement(b.Clients.NewSqs(sess), grant.Resource, sid, "", nil)
+	case resourceTypeSNS:
+		err = setTopicPolicyStatement(b.Clients.NewSns(sess), grant.Resource, sid, "", nil)
+	case resourceTypeKMS:
+		err = revokeKeyGrants(b.Clients.NewKms(sess), grant.Resource, sid)
+	default:
+		err = fmt.Errorf("unsupported resource type %s", grant.Type)
+	}
+	return ignoreResourceNotFound(err)
+}
+
+func ignoreResourceNotFound(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchBucket, sqs.ErrCodeQueueDoesNotExist, sns.ErrCodeNotFoundException, kms.ErrCodeNotFoundException:
+			return nil
+		}
+	}
+	return err
+}
+
+// resourceStatement returns a policy statement allowing a principal the actions on the resources
+func resourceStatement(sid string, principalArn string, actions []string, resources ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"Sid":       sid,
+		"Effect":    "Allow",
+		"Principal": map[string]interface{}{"AWS": principalArn},
+		"Action":    actions,
+		"Resource":  resources,
+	}
+}
+
+// setPolicyStatement replaces the statement with the Sid in a policy document, or removes it when statement is nil.
+// Returns an empty document when no statements are left
+func setPolicyStatement(document string, sid string, statement map[string]interface{}) (string, error) {
+	policy := map[string]interface{}{"Version": "2012-10-17"}
+	if document != "" {
+		if err := json.Unmarshal([]byte(document), &policy); err != nil {
+			return "", err
+		}
+	}
+	var statements []interface{}
+	switch s := policy["Statement"].(type) {
+	case []interface{}:
+		statements = s
+	case map[string]interface{}:
+		statements = []interface{}{s}
+	}
+	var kept []interface{}
+	for _, s := range statements {
+		if m, ok := s.(map[string]interface{}); ok && m["Sid"] == sid {
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if statement != nil {
+		kept = append(kept, statement)
+	}
+	if len(kept) == 0 {
+		return "", nil
+	}
+	policy["Statement"] = kept
+	b, err := json.Marshal(policy)
+	return string(b), err
+}
+
+// setBucketPolicyStatement sets the statement of a binding in the policy of a bucket, or removes it when principalArn
+// is empty
+func setBucketPolicyStatement(s3Svc s3iface.S3API, bucket string, sid string, principalArn string, actions []string) error {
+	document := ""
+	resp, err := s3Svc.GetBucketPolicy(&s3.GetBucketPolicyInput{
+		Bucket: aws.String(bucket),
+	})
+	if err == nil {
+		document = aws.StringValue(resp.Policy)
+	} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NoSuchBucketPolicy" {
+		return err
+	}
+
+	var statement map[string]interface{}
+	if principalArn != "" {
+		// buckets are in the partition of the principal
+		bucketArn := fmt.Sprintf("arn:%s:s3:::%s", strings.Split(principalArn, ":")[1], bucket)
+		statement = resourceStatement(sid, principalArn, actions, bucketArn, bucketArn+"/*")
+	}
+	document, err = setPolicyStatement(document, sid, statement)
+	if err != nil {
+		return err
+	}
+
+	if document == "" {
+		_, err = s3Svc.DeleteBucketPolicy(&s3.DeleteBucketPolicyInput{
+			Bucket: aws.String(bucket),
+		})
+		return err
+	}
+	_, err = s3Svc.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String(bucket),
+		Policy: aws.String(document),
+	})
+	return err
+}
+
+// setQueuePolicyStatement sets the statement of a binding in the policy of a queue, or removes it when principalArn is
+// empty
+func setQueuePolicyStatement(sqsSvc sqsiface.SQSAPI, queueURL string, sid string, principalArn string, actions []string) error {
+	resp, err := sqsSvc.GetQueueAttributes(&sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(queueURL),
+		AttributeNames: aws.StringSlice([]string{sqs.QueueAttributeNamePolicy, sqs.QueueAttributeNameQueueArn}),
+	})
+	if err != nil {
+		return err
+	}
+
+	var statement map[string]interface{}
+	if principalArn != "" {
+		statement = resourceStatement(sid, principalArn, actions, aws.StringValue(resp.Attributes[sqs.QueueAttributeNameQueueArn]))
+	}
+	document, err := setPolicyStatement(aws.StringValue(resp.Attributes[sqs.QueueAttributeNamePolicy]), sid, statement)
+	if err != nil {
+		return err
+	}
+
+	// an empty policy removes it from the queue
+	_, err = sqsSvc.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		QueueUrl:   aws.String(queueURL),
+		Attributes: map[string]*string{sqs.QueueAttributeNamePolicy: aws.String(document)},
+	})
+	return err
+}
+
+// setTopicPolicyStatement sets the statement of a binding in the policy of a topic, or removes it when principalArn is
+// empty
+func setTopicPolicyStatement(snsSvc snsiface.SNSAPI, topicArn string, sid string, principalArn string, actions []string) error {
+	resp, err := snsSvc.GetTopicAttributes(&sns.GetTopicAttributesInput{
+		TopicArn: aws.String(topicArn),
+	})
+	if err != nil {
+		return err
+	}
+
+	var statement map[string]interface{}
+	if principalArn != "" {
+		statement = resourceStatement(sid, principalArn, actions, topicArn)
+	}
+	document, err := setPolicyStatement(aws.StringValue(resp.Attributes["Policy"]), sid, statement)
+	if err != nil {
+		return err
+	}
+
+	_, err = snsSvc.SetTopicAttributes(&sns.SetTopicAttributesInput{
+		TopicArn:       aws.String(topicArn),
+		AttributeName:  aws.String("Policy"),
+		AttributeValue: aws.String(document),
+	})
+	return err
+}
+
+// createKeyGrant creates a grant of a key for the principal of a binding. Actions may be given as kms:Operation, the
+// same as in policies
+func createKeyGrant(kmsSvc kmsiface.KMSAPI, keyID string, name string, principalArn string, actions []string) error {
+	operations := make([]string, len(actions))
+	for i, a := range actions {
+		operations[i] = strings.TrimPrefix(a, "kms:")
+	}
+	_, err := kmsSvc.CreateGrant(&kms.CreateGrantInput{
+		KeyId:            aws.String(keyID),
+		GranteePrincipal: aws.String(principalArn),
+		Operations:       aws.StringSlice(operations),
+		Name:             aws.String(name),
+	})
+	return err
+}
+
+// revokeKeyGrants revokes the grants of a key created for a binding
+func revokeKeyGrants(kmsSvc kmsiface.KMSAPI, keyID string, name string) error {
+	var grantIDs []*string
+	err := kmsSvc.ListGrantsPages(&kms.ListGrantsInput{
+		KeyId: aws.String(keyID),
+	}, func(page *kms.ListGrantsResponse, lastPage bool) bool {
+		for _, g := range page.Grants {
+			if aws.StringValue(g.Name) == name {
+				grantIDs = append(grantIDs, g.GrantId)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range grantIDs {
+		_, err := kmsSvc.RevokeGrant(&kms.RevokeGrantInput{
+			KeyId:   aws.String(keyID),
+			GrantId: id,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSNS struct {
+	snsiface.SNSAPI
+}
+
+func (m mockSNS) GetTopicAttributes(in *sns.GetTopicAttributesInput) (*sns.GetTopicAttributesOutput, error) {
+	if aws.StringValue(in.TopicArn) == "err" {
+		return nil, errors.New("test failure")
+	}
+	return &sns.GetTopicAttributesOutput{Attributes: map[string]*string{
+		"Policy": aws.String(`{"Version":"2012-10-17","Statement":[{"Sid":"__default_statement_ID","Effect":"Allow"}]}`),
+	}}, nil
+}
+
+func (m mockSNS) SetTopicAttributes(in *sns.SetTopicAttributesInput) (*sns.SetTopicAttributesOutput, error) {
+	return &sns.SetTopicAttributesOutput{}, nil
+}
+
+func mockAwsSnsClientGetter(sess *session.Session) snsiface.SNSAPI {
+	return mockSNS{}
+}
+
+type mockKMS struct {
+	kmsiface.KMSAPI
+}
+
+func (m mockKMS) CreateGrant(in *kms.CreateGrantInput) (*kms.CreateGrantOutput, error) {
+	if aws.StringValue(in.KeyId) == "err" {
+		return nil, errors.New("test failure")
+	}
+	return &kms.CreateGrantOutput{GrantId: aws.String("grant-id")}, nil
+}
+
+func (m mockKMS) ListGrantsPages(in *kms.ListGrantsInput, fn func(*kms.ListGrantsResponse, bool) bool) error {
+	fn(&kms.ListGrantsResponse{Grants: []*kms.GrantListEntry{
+		{GrantId: aws.String("grant-id"), Name: aws.String(resourceStatementID("exists-cross-account"))},
+		{GrantId: aws.String("other-grant-id"), Name: aws.String("other")},
+	}}, true)
+	return nil
+}
+
+func (m mockKMS) RevokeGrant(in *kms.RevokeGrantInput) (*kms.RevokeGrantOutput, error) {
+	if aws.StringValue(in.GrantId) != "grant-id" {
+		return nil, errors.New("revoked the wrong grant")
+	}
+	return &kms.RevokeGrantOutput{}, nil
+}
+
+func (m mockKMS) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: append([]byte("decrypted-"), in.CiphertextBlob...)}, nil
+}
+
+func mockAwsKmsClientGetter(sess *session.Session) kmsiface.KMSAPI {
+	return mockKMS{}
+}
+
+type mockS3BucketPolicy struct {
+	s3iface.S3API
+	policy *string
+}
+
+func (m *mockS3BucketPolicy) GetBucketPolicy(in *s3.GetBucketPolicyInput) (*s3.GetBucketPolicyOutput, error) {
+	if m.policy == nil {
+		return nil, awserr.New("NoSuchBucketPolicy", "", nil)
+	}
+	return &s3.GetBucketPolicyOutput{Policy: m.policy}, nil
+}
+
+func (m *mockS3BucketPolicy) PutBucketPolicy(in *s3.PutBucketPolicyInput) (*s3.PutBucketPolicyOutput, error) {
+	m.policy = in.Policy
+	return &s3.PutBucketPolicyOutput{}, nil
+}
+
+func (m *mockS3BucketPolicy) DeleteBucketPolicy(in *s3.DeleteBucketPolicyInput) (*s3.DeleteBucketPolicyOutput, error) {
+	m.policy = nil
+	return &s3.DeleteBucketPolicyOutput{}, nil
+}
+
+func TestResourceStatementID(t *testing.T) {
+	assert.Equal(t, "asbtestbinding", resourceStatementID("testbinding"))
+	// ids that aren't valid in a Sid are hashed
+	assert.Equal(t, "asb"+contentHash([]byte("6fb3ee41-0f94"))[:32], resourceStatementID("6fb3ee41-0f94"))
+}
+
+func TestGetResourcePolicies(t *testing.T) {
+	spec := &BindingSpec{ResourcePolicies: []ResourcePolicySpec{
+		{Type: "SQS", Resource: "QueueURL", Actions: []string{"sqs:SendMessage", "sqs:ReceiveMessage"}},
+		{Type: "SQS", Resource: "QueueURL", Actions: []string{"sqs:ReceiveMessage"}, Scope: "ReadOnly"},
+	}}
+	assert.Equal(t, spec.ResourcePolicies[:1], getResourcePolicies(spec, ""))
+	assert.Equal(t, spec.ResourcePolicies[1:], getResourcePolicies(spec, "readonly"))
+	assert.Empty(t, getResourcePolicies(spec, "ReadWrite"))
+	assert.Empty(t, getResourcePolicies(nil, ""))
+}
+
+func TestSetPolicyStatement(t *testing.T) {
+	statement := resourceStatement("asbtest", "arn:aws:iam::210987654321:root", []string{"sqs:SendMessage"}, "arn:aws:sqs:us-east-1:123456789012:myqueue")
+	expected := `{"Statement":[{"Action":["sqs:SendMessage"],"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::210987654321:root"},` +
+		`"Resource":["arn:aws:sqs:us-east-1:123456789012:myqueue"],"Sid":"asbtest"}],"Version":"2012-10-17"}`
+
+	document, err := setPolicyStatement("", "asbtest", statement)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, document)
+
+	// setting the statement again replaces it
+	document, err = setPolicyStatement(document, "asbtest", statement)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, document)
+
+	// other statements are kept, including single statements that aren't in a list
+	document, err = setPolicyStatement(`{"Version":"2012-10-17","Statement":{"Sid":"other"}}`, "asbtest", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Statement":[{"Sid":"other"}],"Version":"2012-10-17"}`, document)
+
+	document, err = setPolicyStatement(expected, "asbtest", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "", document)
+
+	_, err = setPolicyStatement("not json", "asbtest", nil)
+	assert.Error(t, err)
+}
+
+func TestSetBucketPolicyStatement(t *testing.T) {
+	s3Svc := &mockS3BucketPolicy{}
+
+	err := setBucketPolicyStatement(s3Svc, "mybucket", "asbtest", "arn:aws-cn:iam::210987654321:root", []string{"s3:GetObject"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Statement":[{"Action":["s3:GetObject"],"Effect":"Allow","Principal":{"AWS":"arn:aws-cn:iam::210987654321:root"},`+
+		`"Resource":["arn:aws-cn:s3:::mybucket","arn:aws-cn:s3:::mybucket/*"],"Sid":"asbtest"}],"Version":"2012-10-17"}`, aws.StringValue(s3Svc.policy))
+
+	// the policy is deleted along with its last statement
+	err = setBucketPolicyStatement(s3Svc, "mybucket", "asbtest", "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, s3Svc.policy)
+}
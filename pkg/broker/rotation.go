@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+)
+
+type predecessorBindingKey struct{}
+
+// getPredecessorBindingID returns the predecessor_binding_id sent with a bind request to rotate a binding, or an empty
+// string if none was sent
+func getPredecessorBindingID(c *broker.RequestContext) string {
+	if c == nil || c.Request == nil {
+		return ""
+	}
+	id, _ := c.Request.Context().Value(predecessorBindingKey{}).(string)
+	return id
+}
+
+// BindingRotationMiddleware makes the predecessor_binding_id sent with bind requests available through the request
+// context. Binding rotation is part of OSB API 2.17, which the vendored osb client predates
+func BindingRotationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, _ := route.GetPathTemplate()
+		switch {
+		case path == "/v2/service_instances/{instance_id}/service_bindings/{binding_id}" && r.Method == http.MethodPut:
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			var req struct {
+				PredecessorBindingID string `json:"predecessor_binding_id"`
+			}
+			if json.Unmarshal(body, &req) == nil && req.PredecessorBindingID != "" {
+				r = r.WithContext(context.WithValue(r.Context(), predecessorBindingKey{}, req.PredecessorBindingID))
+			}
+			next.ServeHTTP(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// rotateBinding returns a binding with the configuration of its predecessor. The binding gets credentials of its own,
+// the predecessor's stay valid until it is unbound
+func rotateBinding(binding *serviceinstance.ServiceBinding, predecessor *serviceinstance.ServiceBinding) *serviceinstance.ServiceBinding {
+	return &serviceinstance.ServiceBinding{
+		ID:                   binding.ID,
+		InstanceID:           binding.InstanceID,
+		RoleName:             predecessor.RoleName,
+		Scope:                predecessor.Scope,
+		CredentialsType:      predecessor.CredentialsType,
+		ServiceAccount:       predecessor.ServiceAccount,
+		PrincipalType:        predecessor.PrincipalType,
+		PrincipalName:        predecessor.PrincipalName,
+		PrincipalArn:         predecessor.PrincipalArn,
+		PredecessorBindingID: predecessor.ID,
+	}
+}
+
+// sharedPrincipalPolicy returns the id of the predecessor or successor of a binding that has the same policy attached
+// to the same principal, or an empty string if there is none. The policy must stay attached while either is bound
+func (b *AwsBroker) sharedPrincipalPolicy(binding *serviceinstance.ServiceBinding) (string, error) {
+	principalType, principalName := bindingPrincipal(binding)
+	for _, id := range []string{binding.PredecessorBindingID, binding.SuccessorBindingID} {
+		if id == "" {
+			continue
+		}
+		other, err := b.db.DataStorePort.GetServiceBinding(id)
+		if err != nil {
+			return "", err
+		}
+		if other == nil || other.PolicyArn != binding.PolicyArn {
+			continue
+		}
+		if otherType, otherName := bindingPrincipal(other); otherType == principalType && otherName == principalName {
+			return id, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,59 @@
+package broker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/aws-servicebroker/pkg/serviceinstance"
+	"github.com/gorilla/mux"
+	"github.com/pmorie/osb-broker-lib/pkg/broker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBindingRotationMiddleware(t *testing.T) {
+	assertor := assert.New(t)
+
+	var received string
+	router := mux.NewRouter()
+	router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", func(w http.ResponseWriter, r *http.Request) {
+		received = getPredecessorBindingID(&broker.RequestContext{Request: r})
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}).Methods("PUT")
+	router.Use(BindingRotationMiddleware)
+
+	body := `{"service_id": "test-service-id", "predecessor_binding_id": "old"}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v2/service_instances/test/service_bindings/new", strings.NewReader(body)))
+	assertor.Equal("old", received, "should pass predecessor_binding_id to the broker")
+	assertor.Equal(body, rec.Body.String(), "should leave the request body readable")
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/v2/service_instances/test/service_bindings/new", strings.NewReader(`{}`)))
+	assertor.Equal("", received)
+}
+
+func TestRotateBinding(t *testing.T) {
+	predecessor := &serviceinstance.ServiceBinding{
+		ID:              "old",
+		InstanceID:      "instance",
+		PolicyArn:       "policy",
+		RoleName:        "role",
+		Scope:           "ReadOnly",
+		CredentialsType: "Temporary",
+		CreatedRoleName: "asb-old",
+	}
+	expected := &serviceinstance.ServiceBinding{
+		ID:                   "new",
+		InstanceID:           "instance",
+		RoleName:             "role",
+		Scope:                "ReadOnly",
+		CredentialsType:      "Temporary",
+		PredecessorBindingID: "old",
+	}
+	// the resources created for the predecessor are not shared
+	assert.Equal(t, expected, rotateBinding(&serviceinstance.ServiceBinding{ID: "new", InstanceID: "instance", Scope: "ReadWrite"}, predecessor))
+}
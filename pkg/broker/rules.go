@@ -0,0 +1,455 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// parseCfnRules reads the Rules section of a template. yaml.v2 drops the tags of short form intrinsic functions such
+// as !Equals, so the template is parsed again with yaml.v3 and the functions are converted to their long form
+func parseCfnRules(file []byte) (map[string]interface{}, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(file, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml3.MappingNode {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "Rules" {
+			rules, ok := cfnNodeToValue(root.Content[i+1]).(map[string]interface{})
+			if !ok {
+				return nil, errors.New("template Rules must be a mapping")
+			}
+			return rules, nil
+		}
+	}
+	return nil, nil
+}
+
+// cfnNodeToValue converts a yaml node to maps, slices and strings, CloudFormation compares all values as strings
+func cfnNodeToValue(n *yaml3.Node) interface{} {
+	var v interface{}
+	switch n.Kind {
+	case yaml3.AliasNode:
+		return cfnNodeToValue(n.Alias)
+	case yaml3.ScalarNode:
+		if n.Tag != "!!null" {
+			v = n.Value
+		} else {
+			v = ""
+		}
+	case yaml3.SequenceNode:
+		l := make([]interface{}, len(n.Content))
+		for i, c := range n.Content {
+			l[i] = cfnNodeToValue(c)
+		}
+		v = l
+	case yaml3.MappingNode:
+		m := make(map[string]interface{}, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			m[n.Content[i].Value] = cfnNodeToValue(n.Content[i+1])
+		}
+		v = m
+	}
+	if strings.HasPrefix(n.Tag, "!") && !strings.HasPrefix(n.Tag, "!!") {
+		fn := strings.TrimPrefix(n.Tag, "!")
+		if fn != "Ref" && fn != "Condition" {
+			fn = "Fn::" + fn
+		}
+		return map[string]interface{}{fn: v}
+	}
+	return v
+}
+
+// checkCfnRules returns an error for the first rule the broker can't evaluate, every parameter of the template is set
+// to an empty string to try the conditions and assertions
+func checkCfnRules(template CfnTemplate) error {
+	params := make(map[string]string, len(template.Parameters))
+	for k := range template.Parameters {
+		params[k] = ""
+	}
+	schema := map[string]interface{}{"properties": cfnParamsToOsb(template)}
+	names := make([]string, 0, len(template.Rules))
+	for name := range template.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e := cfnRuleEvaluator{params: params, schema: schema}
+	for _, name := range names {
+		rule, ok := template.Rules[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("rule %s must be a mapping", name)
+		}
+		if condition, ok := rule["RuleCondition"]; ok {
+			if _, err := e.boolean(condition); err != nil {
+				return fmt.Errorf("rule %s: %v", name, err)
+			}
+		}
+		assertions := toInterfaceSlice(rule["Assertions"])
+		if len(assertions) == 0 {
+			return fmt.Errorf("rule %s has no assertions", name)
+		}
+		for _, a := range assertions {
+			assertion, _ := a.(map[string]interface{})
+			if _, err := e.boolean(assertion["Assert"]); err != nil {
+				return fmt.Errorf("rule %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// evaluateCfnRules checks the parameters against the template rules and returns the AssertDescription of every
+// assertion that fails. Parameters are the strings passed to CloudFormation, the schema is used to split lists. Rules
+// are checked by checkCfnRules when the catalog is loaded, so errors only come from parameters missing at runtime
+func evaluateCfnRules(rules interface{}, params map[string]string, schema interface{}) ([]string, error) {
+	r, _ := rules.(map[string]interface{})
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	e := cfnRuleEvaluator{params: params, schema: schema}
+	var failed []string
+	for _, name := range names {
+		rule, _ := r[name].(map[string]interface{})
+		if condition, ok := rule["RuleCondition"]; ok {
+			applies, err := e.boolean(condition)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", name, err)
+			} else if !applies {
+				continue
+			}
+		}
+		for _, a := range toInterfaceSlice(rule["Assertions"]) {
+			assertion, _ := a.(map[string]interface{})
+			ok, err := e.boolean(assertion["Assert"])
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", name, err)
+			} else if !ok {
+				desc, _ := assertion["AssertDescription"].(string)
+				if desc == "" {
+					desc = "assertion failed"
+				}
+				failed = append(failed, fmt.Sprintf("%s: %s", name, desc))
+			}
+		}
+	}
+	return failed, nil
+}
+
+// cfnRuleEvaluator evaluates rule expressions. Expressions it can't evaluate, such as Fn::ValueOf, which looks up AWS
+// resources, or references to pseudo parameters, are reported as unsupported rules
+type cfnRuleEvaluator struct {
+	params map[string]string
+	schema interface{}
+}
+
+func (e cfnRuleEvaluator) boolean(expr interface{}) (bool, error) {
+	v, err := e.value(expr)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("%v is not a condition", expr)
+	}
+	return b, nil
+}
+
+func (e cfnRuleEvaluator) value(expr interface{}) (interface{}, error) {
+	switch t := expr.(type) {
+	case nil:
+		// empty strings are stored as null in DynamoDB
+		return "", nil
+	case string:
+		return t, nil
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, item := range t {
+			v, err := e.value(item)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = v
+		}
+		return l, nil
+	case map[string]interface{}:
+		if len(t) != 1 {
+			break
+		}
+		for fn, arg := range t {
+			return e.function(fn, arg)
+		}
+	}
+	return nil, fmt.Errorf("unsupported rule: %v", expr)
+}
+
+func (e cfnRuleEvaluator) function(fn string, arg interface{}) (interface{}, error) {
+	if fn == "Ref" {
+		name, _ := arg.(string)
+		v, ok := e.params[name]
+		if !ok {
+			// pseudo parameters such as AWS::Region aren't known to the broker
+			return nil, fmt.Errorf("unsupported rule: unknown parameter %q", name)
+		}
+		if s, ok := getParamSchema(e.schema, name).(map[string]interface{}); ok && s["type"] == "array" {
+			return coerceValue("array", v), nil
+		}
+		return v, nil
+	}
+
+	args, err := e.value(arg)
+	if err != nil {
+		return nil, err
+	}
+	l, _ := args.([]interface{})
+	switch fn {
+	case "Fn::Not":
+		if len(l) != 1 {
+			break
+		}
+		b, ok := l[0].(bool)
+		if !ok {
+			return nil, fmt.Errorf("%v is not a condition", l[0])
+		}
+		return !b, nil
+	case "Fn::And", "Fn::Or":
+		result := fn == "Fn::And"
+		for _, c := range l {
+			b, ok := c.(bool)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a condition", c)
+			}
+			if fn == "Fn::And" {
+				result = result && b
+			} else {
+				result = result || b
+			}
+		}
+		return result, nil
+	case "Fn::Equals":
+		if len(l) != 2 {
+			break
+		}
+		return reflect.DeepEqual(l[0], l[1]), nil
+	case "Fn::Contains", "Fn::EachMemberEquals", "Fn::EachMemberIn":
+		if len(l) != 2 {
+			break
+		}
+		list, ok := l[0].([]interface{})
+		if !ok {
+			break
+		}
+		switch fn {
+		case "Fn::Contains":
+			return containsValue(list, l[1]), nil
+		case "Fn::EachMemberEquals":
+			for _, v := range list {
+				if !reflect.DeepEqual(v, l[1]) {
+					return false, nil
+				}
+			}
+			return true, nil
+		default:
+			allowed, ok := l[1].([]interface{})
+			if !ok {
+				break
+			}
+			for _, v := range list {
+				if !containsValue(allowed, v) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported rule: %s %v", fn, arg)
+}
+
+func containsValue(list []interface{}, v interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// cfnRulesToSchema translates the rules whose condition and assertions only compare parameters to fixed values into
+// if/then schemas, so that platforms can check them in their forms. Other rules, and rules on parameters that aren't
+// in the properties, are only checked by evaluateCfnRules
+func cfnRulesToSchema(rules interface{}, properties map[string]interface{}) []interface{} {
+	r, _ := rules.(map[string]interface{})
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var schemas []interface{}
+	for _, name := range names {
+		rule, _ := r[name].(map[string]interface{})
+		var then []interface{}
+		for _, a := range toInterfaceSlice(rule["Assertions"]) {
+			assertion, _ := a.(map[string]interface{})
+			s := cfnConditionToSchema(assertion["Assert"], properties)
+			if s == nil {
+				then = nil
+				break
+			}
+			if desc, ok := assertion["AssertDescription"].(string); ok && desc != "" {
+				for _, p := range s["properties"].(map[string]interface{}) {
+					p.(map[string]interface{})["constraint_description"] = desc
+				}
+			}
+			then = append(then, s)
+		}
+		if len(then) == 0 {
+			continue
+		}
+		var s map[string]interface{}
+		if len(then) == 1 {
+			s = then[0].(map[string]interface{})
+		} else {
+			s = map[string]interface{}{"allOf": then}
+		}
+		if condition, ok := rule["RuleCondition"]; ok {
+			c := cfnConditionToSchema(condition, properties)
+			if c == nil {
+				continue
+			}
+			s = map[string]interface{}{"if": c, "then": s}
+		}
+		schemas = append(schemas, s)
+	}
+	return schemas
+}
+
+// cfnConditionToSchema translates a condition comparing parameters to fixed values, returns nil when the condition
+// uses anything else
+func cfnConditionToSchema(condition interface{}, properties map[string]interface{}) map[string]interface{} {
+	c, _ := condition.(map[string]interface{})
+	if len(c) != 1 {
+		return nil
+	}
+	for fn, arg := range c {
+		args := toInterfaceSlice(arg)
+		switch fn {
+		case "Fn::And":
+			merged := map[string]interface{}{"properties": map[string]interface{}{}, "required": []string{}}
+			for _, a := range args {
+				s := cfnConditionToSchema(a, properties)
+				if s == nil {
+					return nil
+				}
+				for k, v := range s["properties"].(map[string]interface{}) {
+					if _, ok := merged["properties"].(map[string]interface{})[k]; ok {
+						// conditions on the same parameter can't be merged
+						return nil
+					}
+					merged["properties"].(map[string]interface{})[k] = v
+				}
+				merged["required"] = append(merged["required"].([]string), s["required"].([]string)...)
+			}
+			return merged
+		case "Fn::Not":
+			if len(args) != 1 {
+				return nil
+			}
+			s := cfnConditionToSchema(args[0], properties)
+			if s == nil || len(s["properties"].(map[string]interface{})) != 1 {
+				// negating conditions on several parameters needs anyOf, which forms don't handle well
+				return nil
+			}
+			for k, v := range s["properties"].(map[string]interface{}) {
+				p := v.(map[string]interface{})
+				if _, ok := p["maxLength"]; ok {
+					p["minLength"] = 1
+					delete(p, "maxLength")
+				} else {
+					p["not"] = map[string]interface{}{"enum": p["enum"]}
+					delete(p, "enum")
+				}
+				s["properties"].(map[string]interface{})[k] = p
+			}
+			return s
+		case "Fn::Equals", "Fn::Contains":
+			if len(args) != 2 {
+				return nil
+			}
+			name, values := cfnRefAndValues(fn, args)
+			p, ok := properties[name].(map[string]interface{})
+			if !ok || p["type"] == "array" || values == nil {
+				return nil
+			}
+			schema := map[string]interface{}{"type": p["type"]}
+			if len(values) == 1 && values[0] == "" {
+				// DynamoDB can't store empty strings
+				schema["maxLength"] = 0
+			} else {
+				enum := make([]interface{}, len(values))
+				for i, v := range values {
+					enum[i] = cfnValueToSchema(p, v)
+				}
+				schema["enum"] = enum
+			}
+			return map[string]interface{}{
+				"properties": map[string]interface{}{name: schema},
+				"required":   []string{name},
+			}
+		}
+	}
+	return nil
+}
+
+// cfnRefAndValues returns the parameter and the fixed values an Fn::Equals or Fn::Contains compares it to
+func cfnRefAndValues(fn string, args []interface{}) (string, []string) {
+	ref := func(v interface{}) (string, bool) {
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			return "", false
+		}
+		name, ok := m["Ref"].(string)
+		return name, ok
+	}
+	literal := func(v interface{}) (string, bool) {
+		if v == nil {
+			return "", true
+		}
+		s, ok := v.(string)
+		return s, ok
+	}
+	if fn == "Fn::Equals" {
+		for i := range args {
+			if name, ok := ref(args[i]); ok {
+				if value, ok := literal(args[1-i]); ok {
+					return name, []string{value}
+				}
+			}
+		}
+		return "", nil
+	}
+	name, ok := ref(args[1])
+	if !ok {
+		return "", nil
+	}
+	var values []string
+	for _, v := range toInterfaceSlice(args[0]) {
+		value, ok := literal(v)
+		if !ok {
+			return "", nil
+		}
+		values = append(values, value)
+	}
+	return name, values
+}
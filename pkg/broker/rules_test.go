@@ -0,0 +1,249 @@
+package broker
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+var testCfnTemplateRules = []byte(`
+Parameters:
+  FifoQueue:
+    Type: String
+    AllowedValues: ['true', 'false']
+  ContentBasedDeduplication:
+    Type: String
+  Subnets:
+    Type: CommaDelimitedList
+  Name:
+    Type: String
+Rules:
+  Dedup:
+    RuleCondition: !Equals [!Ref FifoQueue, 'false']
+    Assertions:
+    - Assert:
+        !Equals
+        - !Ref ContentBasedDeduplication
+        - 'false'
+      AssertDescription: Content based deduplication can only be enabled for FIFO queues
+  Subnets:
+    Assertions:
+    - Assert:
+        Fn::EachMemberIn:
+        - Ref: Subnets
+        - [subnet-1, subnet-2]
+      AssertDescription: Subnets must be in the VPC
+  Name:
+    RuleCondition:
+      Fn::And:
+      - !Equals [!Ref FifoQueue, 'true']
+      - !Not [!Equals [!Ref Name, '']]
+    Assertions:
+    - Assert: !Contains [[a.fifo, b.fifo], !Ref Name]
+`)
+
+func TestParseCfnRules(t *testing.T) {
+	assertor := assert.New(t)
+
+	rules, err := parseCfnRules(testCfnTemplateRules)
+	assertor.Nil(err)
+	assertor.Equal(map[string]interface{}{
+		"RuleCondition": map[string]interface{}{"Fn::Equals": []interface{}{map[string]interface{}{"Ref": "FifoQueue"}, "false"}},
+		"Assertions": []interface{}{map[string]interface{}{
+			"Assert":            map[string]interface{}{"Fn::Equals": []interface{}{map[string]interface{}{"Ref": "ContentBasedDeduplication"}, "false"}},
+			"AssertDescription": "Content based deduplication can only be enabled for FIFO queues",
+		}},
+	}, rules["Dedup"], "should convert short form functions to their long form")
+	assertor.Equal(map[string]interface{}{
+		"Assertions": []interface{}{map[string]interface{}{
+			"Assert":            map[string]interface{}{"Fn::EachMemberIn": []interface{}{map[string]interface{}{"Ref": "Subnets"}, []interface{}{"subnet-1", "subnet-2"}}},
+			"AssertDescription": "Subnets must be in the VPC",
+		}},
+	}, rules["Subnets"])
+
+	rules, err = parseCfnRules([]byte(`
+Resources:
+  Instance:
+    Properties:
+      UserData: !Base64
+        Fn::Sub: |
+          echo !Ref
+Rules:
+  Name:
+    Assertions:
+    - Assert: !Equals
+      - !Ref Name
+      - ~
+      AssertDescription: 'Name can''t be set: it is
+        generated'
+Outputs:
+  Arn:
+    Value: !GetAtt Instance.Arn
+`))
+	assertor.Nil(err)
+	assertor.Equal(map[string]interface{}{"Name": map[string]interface{}{
+		"Assertions": []interface{}{map[string]interface{}{
+			"Assert":            map[string]interface{}{"Fn::Equals": []interface{}{map[string]interface{}{"Ref": "Name"}, ""}},
+			"AssertDescription": "Name can't be set: it is generated",
+		}},
+	}}, rules, "should ignore the short form functions of other sections")
+
+	rules, err = parseCfnRules([]byte("Rules:\n  Name:\n    Assertions:\n    - Assert: !Not\n        Fn::Equals: [a, b]\n"))
+	assertor.Nil(err)
+	assertor.Equal(map[string]interface{}{"Fn::Not": map[string]interface{}{"Fn::Equals": []interface{}{"a", "b"}}},
+		rules["Name"].(map[string]interface{})["Assertions"].([]interface{})[0].(map[string]interface{})["Assert"],
+		"should keep the tags of mappings")
+
+	_, err = parseCfnRules([]byte("Rules:\n  Name: [a\n"))
+	assertor.NotNil(err, "should return YAML syntax errors")
+
+	rules, err = parseCfnRules([]byte(`{"Parameters": {}}`))
+	assertor.Nil(err)
+	assertor.Nil(rules, "should return no rules for templates without rules")
+
+	_, err = parseCfnRules([]byte(`Rules: [a]`))
+	assertor.EqualError(err, "template Rules must be a mapping")
+}
+
+func TestEvaluateCfnRules(t *testing.T) {
+	rules, _ := parseCfnRules(testCfnTemplateRules)
+	schema := map[string]interface{}{"properties": map[string]interface{}{
+		"Subnets": map[string]interface{}{"type": "array"},
+	}}
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		expected []string
+		err      string
+	}{
+		{
+			name:   "valid",
+			params: map[string]string{"FifoQueue": "false", "ContentBasedDeduplication": "false", "Subnets": "subnet-1,subnet-2", "Name": ""},
+		},
+		{
+			name:   "condition_not_met",
+			params: map[string]string{"FifoQueue": "true", "ContentBasedDeduplication": "true", "Subnets": "", "Name": ""},
+		},
+		{
+			name:   "contains",
+			params: map[string]string{"FifoQueue": "true", "ContentBasedDeduplication": "true", "Subnets": "subnet-2", "Name": "b.fifo"},
+		},
+		{
+			name:   "failed",
+			params: map[string]string{"FifoQueue": "false", "ContentBasedDeduplication": "true", "Subnets": "subnet-1,subnet-3", "Name": "c"},
+			expected: []string{
+				"Dedup: Content based deduplication can only be enabled for FIFO queues",
+				"Subnets: Subnets must be in the VPC",
+			},
+		},
+		{
+			name:     "failed_without_description",
+			params:   map[string]string{"FifoQueue": "true", "ContentBasedDeduplication": "true", "Subnets": "", "Name": "c"},
+			expected: []string{"Name: assertion failed"},
+		},
+		{
+			name:   "missing_parameter",
+			params: map[string]string{},
+			err:    `rule Dedup: unsupported rule: unknown parameter "FifoQueue"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failed, err := evaluateCfnRules(rules, tt.params, schema)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.expected, failed)
+		})
+	}
+
+	failed, err := evaluateCfnRules(nil, map[string]string{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, failed, "should pass without rules")
+	failed, err = evaluateCfnRules(map[string]interface{}{"Stored": map[string]interface{}{
+		"Assertions": []interface{}{map[string]interface{}{"Assert": map[string]interface{}{"Fn::Equals": []interface{}{map[string]interface{}{"Ref": "Name"}, nil}}}},
+	}}, map[string]string{"Name": ""}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, failed, "should treat empty strings stored as null as empty")
+}
+
+func TestCheckCfnRules(t *testing.T) {
+	assertor := assert.New(t)
+
+	var template CfnTemplate
+	assertor.Nil(yaml.Unmarshal(testCfnTemplateRules, &template))
+	template.Rules, _ = parseCfnRules(testCfnTemplateRules)
+	assertor.Nil(checkCfnRules(template))
+
+	for rules, expected := range map[string]string{
+		"Region:\n  Assertions:\n  - Assert: !Equals [!Ref 'AWS::Region', us-east-1]\n":   `rule Region: unsupported rule: unknown parameter "AWS::Region"`,
+		"Vpc:\n  Assertions:\n  - Assert: !Equals [!ValueOf [!Ref Name, VpcId], vpc-1]\n": "rule Vpc: unsupported rule: Fn::ValueOf",
+		"Name:\n  RuleCondition: !Ref Name\n  Assertions: []\n":                           "rule Name: map[Ref:Name] is not a condition",
+		"Name:\n  Assertions: []\n": "rule Name has no assertions",
+		"Name: true\n":              "rule Name must be a mapping",
+	} {
+		template.Rules, _ = parseCfnRules([]byte("Rules:\n  " + strings.Replace(rules, "\n", "\n  ", -1)))
+		err := checkCfnRules(template)
+		if assertor.NotNil(err, rules) {
+			assertor.True(strings.HasPrefix(err.Error(), expected), err.Error())
+		}
+	}
+}
+
+func TestCfnRulesToSchema(t *testing.T) {
+	assertor := assert.New(t)
+
+	rules, _ := parseCfnRules(testCfnTemplateRules)
+	properties := map[string]interface{}{
+		"FifoQueue":                 map[string]interface{}{"type": "string"},
+		"ContentBasedDeduplication": map[string]interface{}{"type": "string"},
+		"Name":                      map[string]interface{}{"type": "string"},
+		"Subnets":                   map[string]interface{}{"type": "array"},
+	}
+	dedup := map[string]interface{}{
+		"if": map[string]interface{}{
+			"properties": map[string]interface{}{"FifoQueue": map[string]interface{}{"type": "string", "enum": []interface{}{"false"}}},
+			"required":   []string{"FifoQueue"},
+		},
+		"then": map[string]interface{}{
+			"properties": map[string]interface{}{"ContentBasedDeduplication": map[string]interface{}{
+				"type":                   "string",
+				"enum":                   []interface{}{"false"},
+				"constraint_description": "Content based deduplication can only be enabled for FIFO queues",
+			}},
+			"required": []string{"ContentBasedDeduplication"},
+		},
+	}
+	name := map[string]interface{}{
+		"if": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"FifoQueue": map[string]interface{}{"type": "string", "enum": []interface{}{"true"}},
+				"Name":      map[string]interface{}{"type": "string", "minLength": 1},
+			},
+			"required": []string{"FifoQueue", "Name"},
+		},
+		"then": map[string]interface{}{
+			"properties": map[string]interface{}{"Name": map[string]interface{}{"type": "string", "enum": []interface{}{"a.fifo", "b.fifo"}}},
+			"required":   []string{"Name"},
+		},
+	}
+	schemas := cfnRulesToSchema(rules, properties)
+	assertor.Equal([]interface{}{dedup, name}, schemas, "should only translate rules comparing parameters to fixed values")
+
+	delete(properties, "FifoQueue")
+	assertor.Nil(cfnRulesToSchema(rules, properties), "should skip rules on parameters missing from the schema")
+
+	parameters := map[string]interface{}{"type": "object", "properties": properties, "allOf": schemas}
+	assertor.Nil(validateParameters(parameters, map[string]interface{}{"FifoQueue": "true", "ContentBasedDeduplication": "true", "Name": "a.fifo"}))
+	assertor.Equal([]string{
+		"ContentBasedDeduplication: Content based deduplication can only be enabled for FIFO queues",
+	}, validateParameters(parameters, map[string]interface{}{"FifoQueue": "false", "ContentBasedDeduplication": "true"}))
+	assertor.Equal([]string{
+		"Name: must be one of [a.fifo b.fifo]",
+	}, validateParameters(parameters, map[string]interface{}{"FifoQueue": "true", "Name": "c"}))
+}
@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// schemaKeywords are the JSON Schema keywords validateValue checks, or that only describe values. Schemas using any
+// other keyword, such as oneOf, anyOf or dependencies, are rejected when the catalog is loaded, rather than advertising
+// constraints the broker wouldn't check
+var schemaKeywords = map[string]bool{
+	"$schema":                   true,
+	"title":                     true,
+	"description":               true,
+	"default":                   true,
+	"writeOnly":                 true,
+	"constraint_description":    true,
+	"prescribed":                true,
+	"openshift_form_definition": true,
+	"type":                      true,
+	"enum":                      true,
+	"minLength":                 true,
+	"maxLength":                 true,
+	"pattern":                   true,
+	"minimum":                   true,
+	"maximum":                   true,
+	"items":                     true,
+	"required":                  true,
+	"properties":                true,
+	"additionalProperties":      true,
+	"allOf":                     true,
+	"if":                        true,
+	"then":                      true,
+	"else":                      true,
+	"not":                       true,
+}
+
+// checkServiceSchemas returns an error listing the unsupported keywords and the patterns that don't compile in the
+// parameter schemas of the plans
+func checkServiceSchemas(service osb.Service) error {
+	var unsupported []string
+	for _, plan := range service.Plans {
+		if plan.Schemas == nil || plan.Schemas.ServiceInstance == nil {
+			continue
+		}
+		for _, s := range []*osb.InputParametersSchema{plan.Schemas.ServiceInstance.Create, plan.Schemas.ServiceInstance.Update} {
+			if s == nil {
+				continue
+			}
+			if schema, ok := s.Parameters.(map[string]interface{}); ok {
+				unsupported = append(unsupported, unsupportedSchemaKeywords("parameters", schema)...)
+			}
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("unsupported JSON Schema keywords: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+func unsupportedSchemaKeywords(path string, schema map[string]interface{}) []string {
+	var unsupported []string
+	for k, v := range schema {
+		// password is the only format used, it only tells forms to hide the value
+		if !schemaKeywords[k] && !(k == "format" && v == "password") {
+			unsupported = append(unsupported, fmt.Sprintf("%s.%s", path, k))
+		} else if k == "pattern" {
+			if _, err := regexp.Compile(fmt.Sprint(v)); err != nil {
+				unsupported = append(unsupported, fmt.Sprintf("%s.%s (%v)", path, k, err))
+			}
+		}
+	}
+	check := func(path string, sub interface{}) {
+		if sub, ok := sub.(map[string]interface{}); ok {
+			unsupported = append(unsupported, unsupportedSchemaKeywords(path, sub)...)
+		}
+	}
+	if properties, ok := schema["properties"].(map[string]interface{}); ok {
+		for k, v := range properties {
+			check(k, v)
+		}
+	}
+	for i, sub := range toInterfaceSlice(schema["allOf"]) {
+		check(fmt.Sprintf("%s.allOf[%d]", path, i), sub)
+	}
+	for _, k := range []string{"items", "if", "then", "else", "not"} {
+		check(path+"."+k, schema[k])
+	}
+	return unsupported
+}
+
+// validateParameters validates request parameters against the JSON Schema of a plan and returns every violation.
+// Platforms often send every parameter as a string, so strings are accepted for number, boolean and array parameters
+// when they convert to the right type, the same way CloudFormation converts them. Only the keywords in schemaKeywords
+// are checked
+func validateParameters(schema interface{}, params map[string]interface{}) []string {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	object := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		object[k] = v
+	}
+	violations := validateValue("parameters", s, object)
+	sort.Strings(violations)
+	return violations
+}
+
+func validateValue(path string, schema map[string]interface{}, value interface{}) []string {
+	schemaType, _ := schema["type"].(string)
+	value = coerceValue(schemaType, value)
+	if schemaType != "" && !isSchemaType(schemaType, value) {
+		return []string{fmt.Sprintf("%s: must be of type %s", path, schemaType)}
+	}
+
+	// constraint violations are described by the template's ConstraintDescription when it has one
+	var violations []string
+	violated := func(format string, a ...interface{}) {
+		if d, ok := schema["constraint_description"].(string); ok && d != "" {
+			violations = append(violations, fmt.Sprintf("%s: %s", path, d))
+		} else {
+			violations = append(violations, fmt.Sprintf("%s: "+format, append([]interface{}{path}, a...)...))
+		}
+	}
+
+	for _, sub := range toInterfaceSlice(schema["allOf"]) {
+		if sub, ok := sub.(map[string]interface{}); ok {
+			violations = append(violations, validateValue(path, sub, value)...)
+		}
+	}
+	if condition, ok := schema["if"].(map[string]interface{}); ok {
+		branch := "then"
+		if len(validateValue(path, condition, value)) > 0 {
+			branch = "else"
+		}
+		if sub, ok := schema[branch].(map[string]interface{}); ok {
+			violations = append(violations, validateValue(path, sub, value)...)
+		}
+	}
+	if not, ok := schema["not"].(map[string]interface{}); ok && len(validateValue(path, not, value)) == 0 {
+		if enum, ok := not["enum"]; ok {
+			violated("must not be one of %v", toInterfaceSlice(enum))
+		} else {
+			violated("must not match %v", not)
+		}
+	}
+
+	if enum, ok := schema["enum"]; ok {
+		allowed := toInterfaceSlice(enum)
+		found := false
+		for _, a := range allowed {
+			if schemaValuesEqual(a, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			violated("must be one of %v", allowed)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if min, ok := toFloat(schema["minLength"]); ok && length < min {
+			violated("must be at least %v characters long", min)
+		}
+		if max, ok := toFloat(schema["maxLength"]); ok && length > max {
+			violated("must be at most %v characters long", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				// checkServiceSchemas rejects these, so only definitions that weren't checked have them
+				violated("can't be checked against the invalid pattern %s", pattern)
+			} else if !re.MatchString(v) {
+				violated("must match the pattern %s", pattern)
+			}
+		}
+	case float64:
+		if min, ok := toFloat(schema["minimum"]); ok && v < min {
+			violated("must be at least %v", min)
+		}
+		if max, ok := toFloat(schema["maximum"]); ok && v > max {
+			violated("must be at most %v", max)
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				violations = append(violations, validateValue(fmt.Sprintf("%s[%d]", path, i), items, item)...)
+			}
+		}
+	case map[string]interface{}:
+		for _, r := range toInterfaceSlice(schema["required"]) {
+			if _, ok := v[fmt.Sprint(r)]; !ok {
+				violations = append(violations, fmt.Sprintf("%s: %s is required", path, r))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for k, pv := range v {
+			if ps, ok := properties[k].(map[string]interface{}); ok {
+				// properties are reported by name rather than by their path in the request
+				violations = append(violations, validateValue(k, ps, pv)...)
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				violations = append(violations, fmt.Sprintf("%s: %s is not allowed", path, k))
+			}
+		}
+	}
+	return violations
+}
+
+// coerceValue converts string values to the schema type when possible, anything else is returned as is
+func coerceValue(schemaType string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return normalizeNumber(value)
+	}
+	switch schemaType {
+	case "number", "integer":
+		if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(s); err == nil {
+			return b
+		}
+	case "array":
+		l := make([]interface{}, 0)
+		if s == "" {
+			return l
+		}
+		// lists of objects, such as user_tags, used to be sent as JSON strings
+		if strings.HasPrefix(strings.TrimSpace(s), "[") && json.Unmarshal([]byte(s), &l) == nil {
+			return l
+		}
+		for _, e := range strings.Split(s, ",") {
+			l = append(l, strings.TrimSpace(e))
+		}
+		return l
+	}
+	return value
+}
+
+func isSchemaType(schemaType string, value interface{}) bool {
+	switch schemaType {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+// schemaValuesEqual compares values the way JSON Schema does, where 1 and 1.0 are equal
+func schemaValuesEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeNumber(a), normalizeNumber(b))
+}
+
+func normalizeNumber(v interface{}) interface{} {
+	if n, ok := toFloat(v); ok {
+		return n
+	}
+	return v
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// toInterfaceSlice returns the elements of any slice, schemas built in code use typed slices such as []string
+func toInterfaceSlice(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return nil
+	}
+	l := make([]interface{}, rv.Len())
+	for i := range l {
+		l[i] = rv.Index(i).Interface()
+	}
+	return l
+}
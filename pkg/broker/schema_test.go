@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"testing"
+
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateParameters(t *testing.T) {
+	schema := map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"name": map[string]interface{}{
+				"type":      "string",
+				"minLength": float64(2),
+				"maxLength": float64(4),
+				"pattern":   "^(?:[a-z]+)$",
+			},
+			"password": map[string]interface{}{
+				"type":                   "string",
+				"pattern":                "^(?:[a-z]+)$",
+				"constraint_description": "must contain only lowercase letters",
+			},
+			"size": map[string]interface{}{
+				"type":    "number",
+				"minimum": float64(5),
+				"maximum": 10,
+			},
+			"count": map[string]interface{}{"type": "integer"},
+			"mode":  map[string]interface{}{"type": "number", "enum": []interface{}{float64(1), float64(2)}},
+			"region": map[string]interface{}{
+				"type": "string",
+				"enum": []string{"us-east-1", "us-west-2"},
+			},
+			"subnets": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "string", "pattern": "^subnet-[0-9a-f]+$"},
+			},
+			"tags": nonCfnParamDefs["user_tags"],
+			"dbname": map[string]interface{}{
+				"type":    "string",
+				"pattern": "^(?!^mysql$)[a-z]*$",
+			},
+		},
+		"required": []string{"name"},
+	}
+
+	tests := []struct {
+		name     string
+		params   map[string]interface{}
+		expected []string
+	}{
+		{
+			name:   "valid",
+			params: map[string]interface{}{"name": "abc", "size": float64(5), "count": float64(3), "mode": float64(2), "region": "us-west-2", "subnets": []interface{}{"subnet-1a"}},
+		},
+		{
+			name:   "valid_strings",
+			params: map[string]interface{}{"name": "abc", "size": "10", "count": "3", "mode": "1", "subnets": "subnet-1a, subnet-2b"},
+		},
+		{
+			name:   "unknown_parameters_are_ignored",
+			params: map[string]interface{}{"name": "abc", "other": "value"},
+		},
+		{
+			name:     "invalid_pattern",
+			params:   map[string]interface{}{"name": "abc", "dbname": "mysql"},
+			expected: []string{"dbname: can't be checked against the invalid pattern ^(?!^mysql$)[a-z]*$"},
+		},
+		{
+			name:   "tags",
+			params: map[string]interface{}{"name": "abc", "tags": []interface{}{map[string]interface{}{"Key": "k", "Value": "v"}}},
+		},
+		{
+			name:   "tags_string",
+			params: map[string]interface{}{"name": "abc", "tags": `[{"Key": "k", "Value": "v"}]`},
+		},
+		{
+			name:     "tags_invalid",
+			params:   map[string]interface{}{"name": "abc", "tags": []interface{}{map[string]interface{}{"Key": "k"}, "k=v"}},
+			expected: []string{"tags[0]: Value is required", "tags[1]: must be of type object"},
+		},
+		{
+			name:     "type",
+			params:   map[string]interface{}{"name": float64(5), "size": "five", "count": 1.5, "subnets": map[string]interface{}{}},
+			expected: []string{"count: must be of type integer", "name: must be of type string", "size: must be of type number", "subnets: must be of type array"},
+		},
+		{
+			name:     "constraints",
+			params:   map[string]interface{}{"name": "aBcDe", "size": float64(11), "mode": "3", "region": "eu-west-1"},
+			expected: []string{"mode: must be one of [1 2]", "name: must be at most 4 characters long", "name: must match the pattern ^(?:[a-z]+)$", "region: must be one of [us-east-1 us-west-2]", "size: must be at most 10"},
+		},
+		{
+			name:     "constraint_description",
+			params:   map[string]interface{}{"name": "abc", "password": "ABC"},
+			expected: []string{"password: must contain only lowercase letters"},
+		},
+		{
+			name:     "items",
+			params:   map[string]interface{}{"name": "abc", "subnets": []interface{}{"subnet-1a", "vpc-1a", float64(1)}},
+			expected: []string{"subnets[1]: must match the pattern ^subnet-[0-9a-f]+$", "subnets[2]: must be of type string"},
+		},
+		{
+			name:     "required",
+			params:   map[string]interface{}{"size": float64(1)},
+			expected: []string{"parameters: name is required", "size: must be at least 5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, validateParameters(schema, tt.params))
+		})
+	}
+
+	assert.Nil(t, validateParameters(nil, map[string]interface{}{"name": float64(1)}), "should not validate without a schema")
+}
+
+func TestCheckServiceSchemas(t *testing.T) {
+	assertor := assert.New(t)
+
+	service := func(schema map[string]interface{}) osb.Service {
+		return osb.Service{Plans: []osb.Plan{{
+			Schemas: &osb.Schemas{ServiceInstance: &osb.ServiceInstanceSchema{
+				Create: &osb.InputParametersSchema{Parameters: schema},
+			}},
+		}}}
+	}
+	supported := map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"password":  map[string]interface{}{"type": "string", "format": "password", "writeOnly": true, "minLength": float64(8)},
+			"user_tags": map[string]interface{}{"type": "array", "items": awsTagSchema, "default": []interface{}{}},
+		},
+		"required":   []string{"password"},
+		"prescribed": map[string]string{"size": "small"},
+		"allOf": []interface{}{
+			map[string]interface{}{
+				"if":   map[string]interface{}{"properties": map[string]interface{}{"size": map[string]interface{}{"enum": []interface{}{"large"}}}},
+				"then": map[string]interface{}{"properties": map[string]interface{}{"zones": map[string]interface{}{"not": map[string]interface{}{"enum": []interface{}{"1"}}}}},
+			},
+		},
+	}
+	assertor.Nil(checkServiceSchemas(service(supported)))
+	assertor.Nil(checkServiceSchemas(osb.Service{Plans: []osb.Plan{{}}}), "should accept plans without schemas")
+
+	unsupported := map[string]interface{}{
+		"type":  "object",
+		"oneOf": []interface{}{},
+		"properties": map[string]interface{}{
+			"email": map[string]interface{}{"type": "string", "format": "email"},
+			"name":  map[string]interface{}{"type": "string", "pattern": "^(?!^mysql$)[a-z]*$"},
+			"tags":  map[string]interface{}{"type": "array", "items": map[string]interface{}{"anyOf": []interface{}{}}},
+		},
+		"allOf": []interface{}{map[string]interface{}{"dependencies": map[string]interface{}{}}},
+	}
+	err := checkServiceSchemas(service(unsupported))
+	if assertor.Error(err) {
+		assertor.Equal("unsupported JSON Schema keywords: email.format, name.pattern (error parsing regexp: invalid or unsupported Perl syntax: `(?!`), parameters.allOf[0].dependencies, parameters.oneOf, tags.items.anyOf", err.Error())
+	}
+}
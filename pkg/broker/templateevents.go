@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/golang/glog"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+)
+
+// S3EventNotification is the subset of an S3 event notification needed to update the catalog
+type S3EventNotification struct {
+	Records []struct {
+		EventName string    `json:"eventName"`
+		EventTime time.Time `json:"eventTime"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// ListenTemplateEvents consumes S3 event notifications for the template bucket from an SQS queue and updates the
+// catalog for the templates that changed. Polling keeps running alongside, in case events are lost
+func ListenTemplateEvents(queueURL string, sqssvc sqsiface.SQSAPI, source S3TemplateSource, bl *AwsBroker) {
+	glog.Infof("Listening for template events on queue %q", queueURL)
+	for {
+		if err := processTemplateEvents(queueURL, sqssvc, source, bl); err != nil {
+			glog.Errorf("Failed to receive template events: %v", err)
+			time.Sleep(10 * time.Second)
+		}
+	}
+}
+
+// processTemplateEvents receives a batch of messages from the queue, applies each of them to the catalog and deletes
+// the ones that were applied. The others are received again once their visibility timeout expires, or moved to the
+// dead-letter queue if the queue has a redrive policy
+func processTemplateEvents(queueURL string, sqssvc sqsiface.SQSAPI, source S3TemplateSource, bl *AwsBroker) error {
+	resp, err := sqssvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(20),
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.Messages) == 0 {
+		return nil
+	}
+
+	for _, m := range resp.Messages {
+		var event S3EventNotification
+		if err := json.Unmarshal([]byte(aws.StringValue(m.Body)), &event); err != nil {
+			// the message can never be processed, so it's dropped rather than retried
+			glog.Errorf("Ignoring malformed template event %s: %v", aws.StringValue(m.MessageId), err)
+		} else if err := applyTemplateEvents([]S3EventNotification{event}, source, bl); err != nil {
+			glog.Errorf("Failed to apply template event %s: %v", aws.StringValue(m.MessageId), err)
+			continue
+		}
+		_, err := sqssvc.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(queueURL),
+			ReceiptHandle: m.ReceiptHandle,
+		})
+		if err != nil {
+			glog.Errorf("Failed to delete template event %s: %v", aws.StringValue(m.MessageId), err)
+		}
+	}
+	return nil
+}
+
+// applyTemplateEvents updates the catalog for the templates created or removed by the events, other objects in the
+// bucket are ignored
+func applyTemplateEvents(events []S3EventNotification, source S3TemplateSource, bl *AwsBroker) error {
+	// only the last event for each template matters
+	created := make(map[string]ServiceLastUpdate)
+	removed := make(map[string]bool)
+	for _, event := range events {
+		for _, r := range event.Records {
+			key, err := url.QueryUnescape(r.S3.Object.Key)
+			if err != nil || r.S3.Bucket.Name != source.Bucket || !strings.HasPrefix(key, source.Prefix) || !strings.HasSuffix(key, source.Suffix) {
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(key, source.Prefix), source.Suffix)
+			if strings.HasPrefix(r.EventName, "ObjectCreated:") {
+				created[name] = ServiceLastUpdate{Name: name, Date: r.EventTime, ETag: r.S3.Object.ETag}
+				delete(removed, name)
+			} else if strings.HasPrefix(r.EventName, "ObjectRemoved:") {
+				removed[name] = true
+				delete(created, name)
+			}
+		}
+	}
+	if len(created) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	bl.catalogmutex.Lock()
+	defer bl.catalogmutex.Unlock()
+
+	var listings []ServiceNeedsUpdate
+	if l, err := bl.listingcache.Get("__LISTINGS__"); err == nil {
+		for _, item := range l.([]ServiceNeedsUpdate) {
+			if _, ok := created[item.Name]; !ok && !removed[item.Name] {
+				listings = append(listings, ServiceNeedsUpdate{Name: item.Name, Update: false})
+			}
+		}
+	}
+	var updates []ServiceNeedsUpdate
+	for name, item := range created {
+		glog.Infof("Template %q was created or updated, updating the catalog", name)
+		bl.listingcache.Set(name, item)
+		updates = append(updates, ServiceNeedsUpdate{Name: name, Update: true})
+		listings = append(listings, ServiceNeedsUpdate{Name: name, Update: false})
+	}
+	for name := range removed {
+		glog.Infof("Template %q was removed, removing it from the catalog", name)
+		bl.listingcache.Delete(name)
+		if sd, err := bl.catalogcache.Get(name); err == nil {
+			bl.catalogcache.Delete(name)
+			if err := bl.db.DataStorePort.TombstoneServiceDefinition(sd.(osb.Service).ID); err != nil {
+				glog.Errorln(err)
+			}
+		}
+	}
+	bl.listingcache.Set("__LISTINGS__", listings)
+	return updateServiceDefinitions(updates, bl.listingcache, bl.catalogcache, source, bl.db, bl.templateworkers)
+}
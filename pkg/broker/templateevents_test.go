@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSQS struct {
+	sqsiface.SQSAPI
+	messages []*sqs.Message
+	deleted  *[]string
+}
+
+func (m mockSQS) ReceiveMessage(in *sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error) {
+	if aws.StringValue(in.QueueUrl) == "err" {
+		return nil, errors.New("test failure")
+	}
+	return &sqs.ReceiveMessageOutput{Messages: m.messages}, nil
+}
+
+func (m mockSQS) DeleteMessage(in *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	*m.deleted = append(*m.deleted, aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (m mockSQS) GetQueueAttributes(in *sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{Attributes: map[string]*string{
+		sqs.QueueAttributeNameQueueArn: aws.String("arn:aws:sqs:us-east-1:123456789012:myqueue"),
+	}}, nil
+}
+
+func (m mockSQS) SetQueueAttributes(in *sqs.SetQueueAttributesInput) (*sqs.SetQueueAttributesOutput, error) {
+	return &sqs.SetQueueAttributesOutput{}, nil
+}
+
+func mockAwsSqsClientGetter(sess *session.Session) sqsiface.SQSAPI {
+	return mockSQS{deleted: &[]string{}}
+}
+
+func s3Event(eventName string, bucket string, key string) string {
+	return `{"Records":[{"eventName":"` + eventName + `","eventTime":"2018-06-01T00:00:00.000Z","s3":{"bucket":{"name":"` + bucket + `"},"object":{"key":"` + key + `"}}}]}`
+}
+
+func TestProcessTemplateEvents(t *testing.T) {
+	assert := assert.New(t)
+	bl, _ := NewAWSBroker(Options{}, mockGetAwsSession, mockClients, mockGetAccountID, mockUpdateCatalog, mockPollUpdate)
+	ds := mockDataStoreCatalog{tombstoned: make(map[string]bool)}
+	bl.db.DataStorePort = ds
+	bl.listingcache.Set("__LISTINGS__", []ServiceNeedsUpdate{{Name: "kept"}, {Name: "removed"}})
+	bl.listingcache.Set("removed", ServiceLastUpdate{Name: "removed", Date: time.Now()})
+	bl.catalogcache.Set("removed", osb.Service{ID: "removed-id", Name: "removed"})
+
+	source := S3TemplateSource{
+		Bucket: "templates",
+		Prefix: "latest/",
+		Suffix: "-main.yaml",
+		S3:     S3Client{Client: mockS3{GetObjectResp: s3.GetObjectOutput{}}},
+	}
+	svc := mockSQS{
+		messages: []*sqs.Message{
+			{ReceiptHandle: aws.String("created"), Body: aws.String(s3Event("ObjectCreated:Put", "templates", "latest/new-main.yaml"))},
+			{ReceiptHandle: aws.String("removed"), Body: aws.String(s3Event("ObjectRemoved:Delete", "templates", "latest/removed-main.yaml"))},
+			{ReceiptHandle: aws.String("other-bucket"), Body: aws.String(s3Event("ObjectCreated:Put", "other", "latest/other-main.yaml"))},
+			{ReceiptHandle: aws.String("other-key"), Body: aws.String(s3Event("ObjectCreated:Put", "templates", "latest/README.md"))},
+			{ReceiptHandle: aws.String("malformed"), Body: aws.String("not json")},
+		},
+		deleted: &[]string{},
+	}
+
+	err := processTemplateEvents("queue", svc, source, bl)
+	assert.Nil(err)
+	assert.Equal([]string{"removed", "other-bucket", "other-key", "malformed"}, *svc.deleted, "should keep the messages that failed to apply")
+	l, _ := bl.listingcache.Get("__LISTINGS__")
+	assert.Equal([]ServiceNeedsUpdate{{Name: "kept"}, {Name: "new"}}, l)
+	_, err = bl.catalogcache.Get("removed")
+	assert.EqualError(err, "not found", "should remove the service from the catalog cache")
+	assert.Equal(map[string]bool{"removed-id": true}, ds.tombstoned, "should tombstone the removed service")
+	_, err = bl.listingcache.Get("new")
+	assert.EqualError(err, "not found", "an invalid template should be retried on the next poll")
+
+	err = processTemplateEvents("err", svc, source, bl)
+	assert.EqualError(err, "test failure")
+}
@@ -0,0 +1,381 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+)
+
+// TemplateSource provides the CloudFormation templates that make up the catalog
+type TemplateSource interface {
+	// ListTemplates returns the name and last update date of every template in the source
+	ListTemplates() (*[]ServiceLastUpdate, error)
+	// GetTemplate returns the body of the named template
+	GetTemplate(name string) ([]byte, error)
+	// TemplateLocation returns either the url or the body CloudFormation should use to create a stack from the
+	// latest version of the named template, and that version
+	TemplateLocation(name string) (templateURL *string, templateBody *string, version string, err error)
+}
+
+// newTemplateSource picks the template source configured in the cli options, defaulting to S3. The S3 key is used as
+// a prefix, so it always ends with a slash
+func newTemplateSource(o Options, s3svc S3Client) (TemplateSource, error) {
+	if o.CatalogPath != "" && o.TemplateIndexURL != "" {
+		return nil, errors.New("catalogPath and templateIndexUrl are mutually exclusive")
+	}
+	if o.CatalogPath != "" {
+		glog.Infof("Loading templates from local catalog path %q.", o.CatalogPath)
+		return LocalTemplateSource{Path: o.CatalogPath, Suffix: o.TemplateFilter}, nil
+	}
+	if o.TemplateIndexURL != "" {
+		u, err := url.Parse(o.TemplateIndexURL)
+		if err != nil {
+			return nil, err
+		} else if u.Scheme != "https" {
+			return nil, fmt.Errorf("templateIndexUrl must be an https url: %s", o.TemplateIndexURL)
+		}
+		glog.Infof("Loading templates from index %q.", o.TemplateIndexURL)
+		return HTTPTemplateSource{
+			IndexURL: o.TemplateIndexURL,
+			Client:   &http.Client{Timeout: 30 * time.Second},
+			urls:     &templateURLs{},
+		}, nil
+	}
+	return S3TemplateSource{
+		Bucket: o.S3Bucket,
+		Prefix: addTrailingSlash(o.S3Key),
+		Suffix: o.TemplateFilter,
+		Region: o.S3Region,
+		S3:     s3svc,
+	}, nil
+}
+
+// S3TemplateSource loads templates from an S3 bucket and prefix
+type S3TemplateSource struct {
+	Bucket string
+	Prefix string
+	Suffix string
+	Region string
+	S3     S3Client
+}
+
+// ListTemplates lists the objects under the prefix that match the template suffix, following continuation tokens
+// until every page has been read. Objects are listed with their ETag, so that templates uploaded again without changes
+// aren't fetched
+func (s S3TemplateSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	glog.Infoln("Listing objects bucket: " + s.Bucket + " region: " + s.Region + " prefix: " + s.Prefix)
+	l := make([]ServiceLastUpdate, 0)
+	var continuationToken string
+	for {
+		input := &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.Bucket),
+			Prefix: aws.String(s.Prefix),
+		}
+		if continuationToken != "" {
+			input.ContinuationToken = aws.String(continuationToken)
+		}
+		ListResponse, err := s.S3.Client.ListObjectsV2(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+				fmt.Fprintf(os.Stderr, "upload canceled due to timeout, %v\n", err)
+			} else {
+				fmt.Fprintf(os.Stderr, "failed to list objects, %v\n", err)
+			}
+			return nil, err
+		}
+		for _, s3obj := range ListResponse.Contents {
+			if strings.HasSuffix(*s3obj.Key, s.Suffix) {
+				l = append(l, ServiceLastUpdate{
+					Name: strings.TrimSuffix(strings.TrimPrefix(*s3obj.Key, s.Prefix), s.Suffix),
+					Date: *s3obj.LastModified,
+					ETag: strings.Trim(aws.StringValue(s3obj.ETag), `"`),
+				})
+			}
+		}
+
+		if !aws.BoolValue(ListResponse.IsTruncated) || ListResponse.NextContinuationToken == nil {
+			break
+		}
+		continuationToken = aws.StringValue(ListResponse.NextContinuationToken)
+	}
+	glog.Infof("Found %d objects\n", len(l))
+	return &l, nil
+}
+
+// GetTemplate fetches the template object from S3
+func (s S3TemplateSource) GetTemplate(name string) ([]byte, error) {
+	return getObjectBody(s.S3, s.Bucket, s.Prefix+name+s.Suffix)
+}
+
+// TemplateLocation returns the https url of the template object, CloudFormation reads it directly from S3. When the
+// bucket is versioned the url and version point at the current object version, otherwise the ETag is the version.
+// The url of an unversioned bucket always points at the latest object, instances stay on the template they were
+// created with only because updates that don't upgrade it use the previous template of the stack
+func (s S3TemplateSource) TemplateLocation(name string) (*string, *string, string, error) {
+	head, err := s.S3.Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + name + s.Suffix),
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	prefix := "https://s3.amazonaws.com/"
+	if s.Region != "us-east-1" {
+		prefix = fmt.Sprintf("https://s3-%s.amazonaws.com/", s.Region)
+	}
+	templateURL := prefix + s.Bucket + "/" + s.Prefix + name + s.Suffix
+	if v := aws.StringValue(head.VersionId); v != "" && v != "null" {
+		return aws.String(templateURL + "?versionId=" + url.QueryEscape(v)), nil, v, nil
+	}
+	return aws.String(templateURL), nil, strings.Trim(aws.StringValue(head.ETag), `"`), nil
+}
+
+// LocalTemplateSource loads templates from a local directory, such as a mounted ConfigMap
+type LocalTemplateSource struct {
+	Path   string
+	Suffix string
+}
+
+// ListTemplates lists the files in the directory that match the template suffix, using the file modification time
+// as the last updated date
+func (s LocalTemplateSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	glog.Infoln("Listing templates in local catalog path: " + s.Path)
+	files, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	l := make([]ServiceLastUpdate, 0)
+	for _, f := range files {
+		// ConfigMap mounts contain hidden symlinked directories (..data, ..2018_06_01...) that must be skipped
+		if strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), s.Suffix) {
+			continue
+		}
+		// os.Stat follows symlinks, which is how ConfigMap keys are exposed
+		fi, err := os.Stat(filepath.Join(s.Path, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		l = append(l, ServiceLastUpdate{
+			Name: strings.TrimSuffix(f.Name(), s.Suffix),
+			Date: fi.ModTime(),
+		})
+	}
+	glog.Infof("Found %d templates\n", len(l))
+	return &l, nil
+}
+
+// GetTemplate reads the template file, which must fit in a TemplateBody
+func (s LocalTemplateSource) GetTemplate(name string) ([]byte, error) {
+	file, err := ioutil.ReadFile(filepath.Join(s.Path, name+s.Suffix))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplateBodySize(name, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// TemplateLocation returns the body of the template, as CloudFormation has no access to the local directory, and
+// its SHA-256 as the version
+func (s LocalTemplateSource) TemplateLocation(name string) (*string, *string, string, error) {
+	file, err := s.GetTemplate(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return nil, aws.String(string(file)), contentHash(file), nil
+}
+
+// HTTPTemplateSource loads templates listed in an index document served over https
+type HTTPTemplateSource struct {
+	IndexURL string
+	Client   *http.Client
+	urls     *templateURLs
+}
+
+// templateURLs holds the template urls of the index read by the last ListTemplates, so that a catalog update doesn't
+// fetch the index again for every template, and the templates it already fetched to hash them
+type templateURLs struct {
+	sync.RWMutex
+	urls   map[string]string
+	bodies map[string][]byte
+}
+
+// TemplateIndex is the index document served by an HTTPTemplateSource, it can be either yaml or json.
+// Template urls may be relative to the index url but must be https, and templates without a lastModified date are
+// fetched on every catalog update and compared by their SHA-256
+type TemplateIndex struct {
+	Templates []struct {
+		Name         string `yaml:"name"`
+		URL          string `yaml:"url"`
+		LastModified string `yaml:"lastModified,omitempty"`
+	} `yaml:"templates"`
+}
+
+// ListTemplates fetches the index and returns the templates it lists
+func (s HTTPTemplateSource) ListTemplates() (*[]ServiceLastUpdate, error) {
+	glog.Infoln("Listing templates in index: " + s.IndexURL)
+	index, err := s.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	urls, err := s.resolveURLs(index)
+	if err != nil {
+		return nil, err
+	}
+	bodies := make(map[string][]byte)
+	l := make([]ServiceLastUpdate, 0, len(index.Templates))
+	for _, t := range index.Templates {
+		item := ServiceLastUpdate{Name: t.Name}
+		if t.LastModified != "" {
+			item.Date, err = time.Parse(time.RFC3339, t.LastModified)
+			if err != nil {
+				return nil, fmt.Errorf("invalid lastModified for template %s: %v", t.Name, err)
+			}
+		} else if file, err := s.get(urls[t.Name]); err != nil {
+			// listed without an ETag, so it's fetched again when the catalog is updated and the error is reported then
+			glog.Errorf("Failed to fetch template %s: %v", t.Name, err)
+		} else {
+			bodies[t.Name] = file
+			item.ETag = contentHash(file)
+		}
+		l = append(l, item)
+	}
+	if s.urls != nil {
+		s.urls.Lock()
+		s.urls.urls = urls
+		s.urls.bodies = bodies
+		s.urls.Unlock()
+	}
+	glog.Infof("Found %d templates\n", len(l))
+	return &l, nil
+}
+
+// GetTemplate fetches the template, using the url listed in the index by the last ListTemplates, or the body it
+// already fetched. Templates that weren't listed yet are looked up in a freshly fetched index
+func (s HTTPTemplateSource) GetTemplate(name string) ([]byte, error) {
+	if s.urls != nil {
+		s.urls.RLock()
+		file, fetched := s.urls.bodies[name]
+		u, ok := s.urls.urls[name]
+		s.urls.RUnlock()
+		if fetched {
+			if err := checkTemplateBodySize(name, file); err != nil {
+				return nil, err
+			}
+			return file, nil
+		} else if ok {
+			return s.getTemplate(name, u)
+		}
+	}
+	index, err := s.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	urls, err := s.resolveURLs(index)
+	if err != nil {
+		return nil, err
+	}
+	if u, ok := urls[name]; ok {
+		return s.getTemplate(name, u)
+	}
+	return nil, fmt.Errorf("template %s not found in index %s", name, s.IndexURL)
+}
+
+// resolveURLs returns the absolute url of each template in the index, keyed by template name. Like the index, the
+// templates must be served over https
+func (s HTTPTemplateSource) resolveURLs(index *TemplateIndex) (map[string]string, error) {
+	base, err := url.Parse(s.IndexURL)
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[string]string, len(index.Templates))
+	for _, t := range index.Templates {
+		u, err := base.Parse(t.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url for template %s: %v", t.Name, err)
+		} else if u.Scheme != "https" {
+			return nil, fmt.Errorf("template %s must have an https url: %s", t.Name, u)
+		}
+		urls[t.Name] = u.String()
+	}
+	return urls, nil
+}
+
+// TemplateLocation returns the body of the template, as CloudFormation only accepts template urls in S3, and its
+// SHA-256 as the version
+func (s HTTPTemplateSource) TemplateLocation(name string) (*string, *string, string, error) {
+	file, err := s.GetTemplate(name)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return nil, aws.String(string(file)), contentHash(file), nil
+}
+
+// checkTemplateBodySize fails for templates CloudFormation wouldn't accept as a TemplateBody, so that they are left
+// out of the catalog instead of failing to provision
+func checkTemplateBodySize(name string, file []byte) error {
+	if len(file) > maxTemplateBodySize {
+		return fmt.Errorf("template %s is %d bytes, templates that aren't loaded from S3 can't be larger than %d bytes", name, len(file), maxTemplateBodySize)
+	}
+	return nil
+}
+
+func contentHash(file []byte) string {
+	sum := sha256.Sum256(file)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s HTTPTemplateSource) getIndex() (*TemplateIndex, error) {
+	body, err := s.get(s.IndexURL)
+	if err != nil {
+		return nil, err
+	}
+	var index TemplateIndex
+	if err := yaml.Unmarshal(body, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+func (s HTTPTemplateSource) getTemplate(name string, u string) ([]byte, error) {
+	file, err := s.get(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplateBodySize(name, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s HTTPTemplateSource) get(u string) ([]byte, error) {
+	resp, err := s.Client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,207 @@
+package broker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTemplateSource(t *testing.T) {
+	assertor := assert.New(t)
+
+	source, err := newTemplateSource(Options{S3Bucket: "abucket", S3Key: "templates", TemplateFilter: "-main.yaml", S3Region: "us-west-2"}, S3Client{})
+	assertor.Nil(err)
+	assertor.Equal(S3TemplateSource{Bucket: "abucket", Prefix: "templates/", Suffix: "-main.yaml", Region: "us-west-2"}, source, "should default to S3")
+
+	source, err = newTemplateSource(Options{CatalogPath: "/catalog", TemplateFilter: "-main.yaml"}, S3Client{})
+	assertor.Nil(err)
+	assertor.Equal(LocalTemplateSource{Path: "/catalog", Suffix: "-main.yaml"}, source, "should use the local catalog path")
+
+	source, err = newTemplateSource(Options{TemplateIndexURL: "https://example.com/index.yaml"}, S3Client{})
+	assertor.Nil(err)
+	assertor.Equal("https://example.com/index.yaml", source.(HTTPTemplateSource).IndexURL, "should use the template index")
+
+	_, err = newTemplateSource(Options{TemplateIndexURL: "http://example.com/index.yaml"}, S3Client{})
+	assertor.EqualError(err, "templateIndexUrl must be an https url: http://example.com/index.yaml")
+
+	_, err = newTemplateSource(Options{CatalogPath: "/catalog", TemplateIndexURL: "https://example.com/index.yaml"}, S3Client{})
+	assertor.EqualError(err, "catalogPath and templateIndexUrl are mutually exclusive")
+}
+
+func TestS3TemplateSource(t *testing.T) {
+	assertor := assert.New(t)
+
+	date := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	source := S3TemplateSource{
+		Bucket: "abucket",
+		Prefix: "templates/latest/",
+		Suffix: "-main.yaml",
+		Region: "us-east-1",
+		S3: S3Client{Client: mockS3{ListObjectsV2Resps: map[string]s3.ListObjectsV2Output{
+			"": {
+				Contents: []*s3.Object{
+					{Key: aws.String("templates/latest/test-service-main.yaml"), LastModified: aws.Time(date), ETag: aws.String(`"abc123"`)},
+					{Key: aws.String("templates/latest/README.md"), LastModified: aws.Time(date)},
+				},
+				IsTruncated:           aws.Bool(true),
+				NextContinuationToken: aws.String("page2"),
+			},
+			"page2": {
+				Contents: []*s3.Object{
+					{Key: aws.String("templates/latest/other-main.yaml"), LastModified: aws.Time(date)},
+				},
+				IsTruncated: aws.Bool(false),
+			},
+		}}},
+	}
+	l, err := source.ListTemplates()
+	assertor.Nil(err)
+	expected := &[]ServiceLastUpdate{{Name: "test-service", Date: date, ETag: "abc123"}, {Name: "other", Date: date}}
+	assertor.Equal(expected, l, "should list objects matching the template filter on every page")
+
+	source.S3 = S3Client{Client: mockS3{HeadObjectResp: s3.HeadObjectOutput{ETag: aws.String(`"abc123"`), VersionId: aws.String("null")}}}
+	url, body, version, err := source.TemplateLocation("test-service")
+	assertor.Nil(err)
+	assertor.Nil(body)
+	assertor.Equal("https://s3.amazonaws.com/abucket/templates/latest/test-service-main.yaml", aws.StringValue(url))
+	assertor.Equal("abc123", version, "should use the ETag as the version in unversioned buckets")
+
+	source.Region = "us-west-2"
+	source.S3 = S3Client{Client: mockS3{HeadObjectResp: s3.HeadObjectOutput{ETag: aws.String(`"abc123"`), VersionId: aws.String("v1+2")}}}
+	url, _, version, _ = source.TemplateLocation("test-service")
+	assertor.Equal("https://s3-us-west-2.amazonaws.com/abucket/templates/latest/test-service-main.yaml?versionId=v1%2B2", aws.StringValue(url))
+	assertor.Equal("v1+2", version, "should pin the object version in versioned buckets")
+
+	source.Bucket = "err"
+	_, err = source.ListTemplates()
+	assertor.EqualError(err, "test failure")
+}
+
+func TestLocalTemplateSource(t *testing.T) {
+	assertor := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "catalog")
+	assertor.Nil(err)
+	defer os.RemoveAll(dir)
+	for _, f := range []string{"test-service-main.yaml", "other-main.yaml", "README.md", ".hidden-main.yaml"} {
+		assertor.Nil(ioutil.WriteFile(filepath.Join(dir, f), []byte("Description: test"), 0644))
+	}
+	assertor.Nil(os.Mkdir(filepath.Join(dir, "nested-main.yaml"), 0755))
+
+	source := LocalTemplateSource{Path: dir, Suffix: "-main.yaml"}
+	l, err := source.ListTemplates()
+	assertor.Nil(err)
+	var names []string
+	for _, item := range *l {
+		names = append(names, item.Name)
+	}
+	assertor.ElementsMatch([]string{"test-service", "other"}, names, "should only list files matching the template filter")
+
+	file, err := source.GetTemplate("test-service")
+	assertor.Nil(err)
+	assertor.Equal("Description: test", string(file))
+
+	url, body, version, err := source.TemplateLocation("test-service")
+	assertor.Nil(err)
+	assertor.Nil(url)
+	assertor.Equal("Description: test", aws.StringValue(body))
+	assertor.Equal(contentHash([]byte("Description: test")), version)
+
+	_, _, _, err = source.TemplateLocation("missing")
+	assertor.Error(err)
+
+	assertor.Nil(ioutil.WriteFile(filepath.Join(dir, "large-main.yaml"), make([]byte, maxTemplateBodySize+1), 0644))
+	_, err = source.GetTemplate("large")
+	assertor.EqualError(err, "template large is 51201 bytes, templates that aren't loaded from S3 can't be larger than 51200 bytes")
+
+	source.Path = filepath.Join(dir, "missing")
+	_, err = source.ListTemplates()
+	assertor.Error(err)
+}
+
+func TestHTTPTemplateSource(t *testing.T) {
+	assertor := assert.New(t)
+
+	var indexRequests, unversionedRequests int
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/catalog/index.json":
+			indexRequests++
+			fmt.Fprint(w, `{"templates": [
+				{"name": "test-service", "url": "templates/test-service-main.yaml", "lastModified": "2018-06-01T00:00:00Z"},
+				{"name": "missing", "url": "/missing-main.yaml"},
+				{"name": "unversioned", "url": "templates/unversioned-main.yaml"}
+			]}`)
+		case "/catalog/http.json":
+			fmt.Fprint(w, `{"templates": [{"name": "test-service", "url": "http://example.com/test-service-main.yaml"}]}`)
+		case "/catalog/large.json":
+			fmt.Fprint(w, `{"templates": [{"name": "large", "url": "templates/large-main.yaml"}]}`)
+		case "/catalog/templates/test-service-main.yaml":
+			fmt.Fprint(w, "Description: test")
+		case "/catalog/templates/unversioned-main.yaml":
+			unversionedRequests++
+			fmt.Fprint(w, "Description: unversioned")
+		case "/catalog/templates/large-main.yaml":
+			w.Write(make([]byte, maxTemplateBodySize+1))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	source := HTTPTemplateSource{IndexURL: ts.URL + "/catalog/index.json", Client: ts.Client(), urls: &templateURLs{}}
+	l, err := source.ListTemplates()
+	assertor.Nil(err)
+	assertor.Len(*l, 3)
+	assertor.Equal(ServiceLastUpdate{Name: "test-service", Date: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)}, (*l)[0])
+	assertor.Equal(ServiceLastUpdate{Name: "missing"}, (*l)[1], "should list templates that fail to be fetched without an ETag")
+	assertor.Equal(ServiceLastUpdate{Name: "unversioned", ETag: contentHash([]byte("Description: unversioned"))}, (*l)[2], "should hash templates without a lastModified date")
+
+	file, err := source.GetTemplate("unversioned")
+	assertor.Nil(err)
+	assertor.Equal("Description: unversioned", string(file))
+	assertor.Equal(1, unversionedRequests, "should reuse the templates fetched while listing")
+
+	url, body, version, err := source.TemplateLocation("test-service")
+	assertor.Nil(err)
+	assertor.Nil(url)
+	assertor.Equal("Description: test", aws.StringValue(body), "should resolve template urls relative to the index")
+	assertor.Equal(contentHash([]byte("Description: test")), version)
+
+	_, err = source.GetTemplate("missing")
+	assertor.EqualError(err, fmt.Sprintf("failed to get %s/missing-main.yaml: 404 Not Found", ts.URL))
+
+	assertor.Equal(1, indexRequests, "should reuse the template urls of the listed index")
+
+	_, err = source.GetTemplate("unknown")
+	assertor.EqualError(err, fmt.Sprintf("template unknown not found in index %s/catalog/index.json", ts.URL))
+	assertor.Equal(2, indexRequests, "should fetch the index for templates that weren't listed")
+
+	uncached := HTTPTemplateSource{IndexURL: ts.URL + "/catalog/index.json", Client: ts.Client()}
+	file, err = uncached.GetTemplate("test-service")
+	assertor.Nil(err)
+	assertor.Equal("Description: test", string(file))
+
+	source.IndexURL = ts.URL + "/catalog/http.json"
+	_, err = source.ListTemplates()
+	assertor.EqualError(err, "template test-service must have an https url: http://example.com/test-service-main.yaml")
+
+	source.IndexURL = ts.URL + "/catalog/large.json"
+	_, err = source.ListTemplates()
+	assertor.Nil(err)
+	_, err = source.GetTemplate("large")
+	assertor.EqualError(err, "template large is 51201 bytes, templates that aren't loaded from S3 can't be larger than 51200 bytes")
+
+	source.IndexURL = ts.URL + "/nothere.json"
+	_, err = source.ListTemplates()
+	assertor.Error(err)
+}
@@ -8,7 +8,11 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
@@ -30,17 +34,16 @@ type Options struct {
 	S3Region           string
 	S3Key              string
 	TemplateFilter     string
+	TemplateIndexURL   string
+	TemplateWorkers    int
+	CatalogFallback    bool
+	PollInterval       int
+	SQSQueueURL        string
 	Region             string
 	BrokerID           string
 	RoleArn            string
 	PrescribeOverrides bool
-}
-
-// BucketDetailsRequest describes the details required to fetch metadata and templates from s3
-type BucketDetailsRequest struct {
-	bucket string
-	prefix string
-	suffix string
+	OIDCIssuers        string
 }
 
 // AwsBroker holds configuration, caches and aws service clients
@@ -57,6 +60,11 @@ type AwsBroker struct {
 	templatefilter     string
 	region             string
 	s3svc              S3Client
+	templatesource     TemplateSource
+	templateworkers    int
+	catalogfallback    bool
+	catalogmutex       *sync.Mutex
+	updateCatalog      UpdateCataloger
 	ssmsvc             ssm.SSM
 	catalogcache       cache.Cache
 	listingcache       cache.Cache
@@ -67,6 +75,7 @@ type AwsBroker struct {
 	Clients            AwsClients
 	prescribeOverrides bool
 	globalOverrides    map[string]string
+	oidcIssuers        map[string]string
 }
 
 // ServiceNeedsUpdate if Update == true the metadata should be refreshed from s3
@@ -75,10 +84,23 @@ type ServiceNeedsUpdate struct {
 	Update bool
 }
 
-// ServiceLastUpdate date when a service exposed by the broker was last updated from s3
+// TemplateErrors holds the error for each template that failed to load during a catalog update
+type TemplateErrors map[string]error
+
+// CatalogUpdateSummary lists the templates added, updated, removed and failed during a catalog update
+type CatalogUpdateSummary struct {
+	Added   []string          `json:"added"`
+	Updated []string          `json:"updated"`
+	Removed []string          `json:"removed"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// ServiceLastUpdate date when a service exposed by the broker was last updated from s3. Templates listed with an ETag
+// are compared by it instead of the date
 type ServiceLastUpdate struct {
 	Name string
 	Date time.Time
+	ETag string
 }
 
 // Db configuration
@@ -91,10 +113,14 @@ type Db struct {
 
 // DataStore port, any backend datastore must provide at least these interfaces
 type DataStore interface {
-	PutServiceDefinition(sd osb.Service) error
+	PutServiceDefinition(sd osb.Service, definitionHash string) error
 	GetParam(paramname string) (value string, err error)
 	PutParam(paramname string, paramvalue string) error
 	GetServiceDefinition(serviceuuid string) (*osb.Service, error)
+	GetServiceDefinitionHash(serviceuuid string) (string, error)
+	IsServiceDefinitionTombstoned(serviceuuid string) (bool, error)
+	GetServiceDefinitions() ([]osb.Service, error)
+	TombstoneServiceDefinition(serviceuuid string) error
 	GetServiceInstance(sid string) (*serviceinstance.ServiceInstance, error)
 	PutServiceInstance(si serviceinstance.ServiceInstance) error
 	DeleteServiceInstance(sid string) error
@@ -109,8 +135,12 @@ type GetCfnClient func(sess *session.Session) CfnClient
 type GetSsmClient func(sess *session.Session) ssmiface.SSMAPI
 type GetS3Client func(sess *session.Session) S3Client
 type GetDdbClient func(sess *session.Session) *dynamodb.DynamoDB
-type GetStsClient func(sess *session.Session) *sts.STS
+type GetStsClient func(sess *session.Session) stsiface.STSAPI
 type GetIamClient func(sess *session.Session) iamiface.IAMAPI
+type GetSqsClient func(sess *session.Session) sqsiface.SQSAPI
+type GetSnsClient func(sess *session.Session) snsiface.SNSAPI
+type GetKmsClient func(sess *session.Session) kmsiface.KMSAPI
+type GetSecretsManagerClient func(sess *session.Session) secretsmanageriface.SecretsManagerAPI
 
 type AwsClients struct {
 	NewCfn GetCfnClient
@@ -119,6 +149,11 @@ type AwsClients struct {
 	NewDdb GetDdbClient
 	NewSts GetStsClient
 	NewIam GetIamClient
+	NewSqs GetSqsClient
+	NewSns GetSnsClient
+	NewKms GetKmsClient
+
+	NewSecretsManager GetSecretsManagerClient
 }
 
 type S3Client struct {
@@ -135,23 +170,32 @@ type AwsTags []struct {
 }
 
 type GetCallerIder func(svc stsiface.STSAPI) (*sts.GetCallerIdentityOutput, error)
-type UpdateCataloger func(listingcache cache.Cache, catalogcache cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error
-type PollUpdater func(interval int, l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, bl AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser)
-type ListTemplateser func(s3source *BucketDetailsRequest, b *AwsBroker) (*[]ServiceLastUpdate, error)
+type UpdateCataloger func(listingcache cache.Cache, catalogcache cache.Cache, source TemplateSource, db Db, bl *AwsBroker, listTemplates ListTemplateser, listingUpdate ListingUpdater, metadataUpdate MetadataUpdater) error
+type PollUpdater func(interval int, l cache.Cache, c cache.Cache, source TemplateSource, db Db, bl *AwsBroker, updateCatalog UpdateCataloger, listTemplates ListTemplateser)
+type ListTemplateser func(source TemplateSource) (*[]ServiceLastUpdate, error)
 type ListingUpdater func(l *[]ServiceLastUpdate, c cache.Cache) error
-type MetadataUpdater func(l cache.Cache, c cache.Cache, bd BucketDetailsRequest, s3svc S3Client, db Db, metadataUpdate MetadataUpdater, templatefilter string) error
+type MetadataUpdater func(l cache.Cache, c cache.Cache, source TemplateSource, db Db, metadataUpdate MetadataUpdater, workers int) error
 
 type CfnTemplate struct {
 	Description string `yaml:"Description,omitempty"`
 	Parameters  map[string]struct {
-		Description   string   `yaml:"Description,omitempty"`
-		Type          string   `yaml:"Type,omitempty"`
-		Default       *string  `yaml:"Default,omitempty"`
-		AllowedValues []string `yaml:"AllowedValues,omitempty"`
+		Description           string   `yaml:"Description,omitempty"`
+		Type                  string   `yaml:"Type,omitempty"`
+		Default               *string  `yaml:"Default,omitempty"`
+		AllowedValues         []string `yaml:"AllowedValues,omitempty"`
+		AllowedPattern        string   `yaml:"AllowedPattern,omitempty"`
+		ConstraintDescription string   `yaml:"ConstraintDescription,omitempty"`
+		MinValue              string   `yaml:"MinValue,omitempty"`
+		MaxValue              string   `yaml:"MaxValue,omitempty"`
+		MinLength             string   `yaml:"MinLength,omitempty"`
+		MaxLength             string   `yaml:"MaxLength,omitempty"`
+		NoEcho                string   `yaml:"NoEcho,omitempty"`
 	} `yaml:"Parameters,omitempty"`
 	Outputs map[string]struct {
 		Description string `yaml:"Description,omitempty"`
 	} `yaml:"Outputs,omitempty"`
+	// Rules are read by parseCfnRules, as yaml.v2 drops the tags of short form intrinsic functions
+	Rules    map[string]interface{} `yaml:"-"`
 	Metadata struct {
 		Spec struct {
 			Version             string   `yaml:"Version,omitempty"`
@@ -170,7 +214,8 @@ type CfnTemplate struct {
 						PolicyDocument map[string]interface{} `yaml:"PolicyDocument,omitempty"`
 					} `yaml:"Policies,omitempty"`
 				} `yaml:"IAM,omitempty"`
-				CFNOutputs []string `yaml:"CFNOutputs,omitempty"`
+				CFNOutputs       []string             `yaml:"CFNOutputs,omitempty"`
+				ResourcePolicies []ResourcePolicySpec `yaml:"ResourcePolicies,omitempty"`
 			} `yaml:"Bindings,omitempty"`
 			ServicePlans map[string]struct {
 				DisplayName       string            `yaml:"DisplayName,omitempty"`
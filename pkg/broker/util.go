@@ -1,11 +1,16 @@
 package broker
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -13,9 +18,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
-	"github.com/aws/aws-sdk-go/service/ssm"
-	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/golang/glog"
 	"github.com/koding/cache"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
@@ -33,7 +37,7 @@ func getGlobalOverrides(brokerID string) map[string]string {
 	return overrides
 }
 
-func prescribeOverrides(b AwsBroker, services []osb.Service) []osb.Service {
+func prescribeOverrides(b *AwsBroker, services []osb.Service) []osb.Service {
 	if !b.prescribeOverrides || len(b.globalOverrides) == 0 {
 		return services
 	}
@@ -295,6 +299,19 @@ func newAsyncError() osb.HTTPStatusCodeError {
 	return newHTTPStatusCodeError(http.StatusUnprocessableEntity, osb.AsyncErrorMessage, osb.AsyncErrorDescription)
 }
 
+func newMaintenanceInfoConflictError(requested, current *MaintenanceInfo) osb.HTTPStatusCodeError {
+	desc := fmt.Sprintf("The maintenance_info version %s does not match the plan, which has no maintenance_info.", requested.Version)
+	if current != nil {
+		desc = fmt.Sprintf("The maintenance_info version %s does not match the plan version %s.", requested.Version, current.Version)
+	}
+	return newHTTPStatusCodeError(http.StatusUnprocessableEntity, "MaintenanceInfoConflict", desc)
+}
+
+func newInvalidParametersError(violations []string) osb.HTTPStatusCodeError {
+	desc := "The parameters are invalid: " + strings.Join(violations, "; ")
+	return newHTTPStatusCodeError(http.StatusBadRequest, "", desc)
+}
+
 func newHTTPStatusCodeError(statusCode int, msg, desc string) osb.HTTPStatusCodeError {
 	err := osb.HTTPStatusCodeError{
 		StatusCode: statusCode,
@@ -346,11 +363,25 @@ func getPlan(service *osb.Service, planID string) *osb.Plan {
 	return nil
 }
 
+func getPlanByName(service *osb.Service, name string) *osb.Plan {
+	for _, p := range service.Plans {
+		if p.Name == name {
+			return &p
+		}
+	}
+	return nil
+}
+
 func getPlanDefaults(plan *osb.Plan) map[string]string {
 	defaults := make(map[string]string)
 	for k, v := range plan.Schemas.ServiceInstance.Create.Parameters.(map[string]interface{})["properties"].(map[string]interface{}) {
 		if d, ok := v.(map[string]interface{})["default"]; ok {
-			defaults[k] = paramValue(d)
+			value, err := toCfnParamValue(v, d)
+			if err != nil {
+				glog.Errorf("Ignoring the default of parameter %s: %v", k, err)
+				continue
+			}
+			defaults[k] = value
 		}
 	}
 	return defaults
@@ -388,11 +419,65 @@ func getRequiredParams(plan *osb.Plan) (params []string) {
 	return
 }
 
-func paramValue(v interface{}) string {
-	if v == nil {
-		return ""
+// toCfnParamValue converts a parameter value sent as JSON to the string CloudFormation expects, based on the
+// parameter schema. Lists become comma delimited lists, numbers are rendered without exponents and lists of objects,
+// such as user_tags, are passed on as JSON. Shapes CloudFormation can't represent are rejected
+func toCfnParamValue(schema interface{}, v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case []interface{}:
+		if s, ok := schema.(map[string]interface{}); ok {
+			if items, ok := s["items"].(map[string]interface{}); ok && items["type"] == "object" {
+				b, err := json.Marshal(t)
+				return string(b), err
+			}
+		}
+		l := make([]string, len(t))
+		for i, e := range t {
+			switch e.(type) {
+			case []interface{}, map[string]interface{}:
+				return "", errors.New("lists can only contain strings, numbers and booleans")
+			}
+			value, err := toCfnParamValue(nil, e)
+			if err != nil {
+				return "", err
+			} else if strings.Contains(value, ",") {
+				return "", fmt.Errorf("list values can't contain commas: %q", value)
+			}
+			l[i] = value
+		}
+		return strings.Join(l, ","), nil
+	case map[string]interface{}:
+		return "", errors.New("objects are not supported")
 	}
-	return fmt.Sprintf("%v", v)
+	return fmt.Sprintf("%v", v), nil
+}
+
+// getParamSchema returns the schema of the named parameter, or nil if the parameters schema doesn't declare it
+func getParamSchema(parameters interface{}, name string) interface{} {
+	s, _ := parameters.(map[string]interface{})
+	properties, _ := s["properties"].(map[string]interface{})
+	return properties[name]
+}
+
+// requestValues merges the parameters sent with a request over the resolved parameters, so that they are validated
+// with the types they were sent with
+func requestValues(params map[string]string, requestParams map[string]interface{}) map[string]interface{} {
+	values := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		values[k] = v
+	}
+	for k, v := range requestParams {
+		values[k] = v
+	}
+	return values
 }
 
 func leaveOutputsAsIs(service *osb.Service) bool {
@@ -417,49 +502,41 @@ func toScreamingSnakeCaseIfAppropriate(service *osb.Service, s string) string {
 	return toScreamingSnakeCase(s)
 }
 
-func getCredentials(service *osb.Service, outputs []*cloudformation.Output, ssmSvc ssmiface.SSMAPI) (map[string]interface{}, error) {
+func getCredentials(service *osb.Service, outputs []*cloudformation.Output, sess *session.Session, clients AwsClients) (map[string]interface{}, error) {
 	credentials := make(map[string]interface{})
-	var ssmValues []string
+	refs := make(map[string]map[string][]string)
 
 	for _, o := range outputs {
 		if strings.HasPrefix(aws.StringValue(o.OutputKey), cfnOutputPolicyArnPrefix) {
 			continue
 		}
 
+		var key string
+		value := aws.StringValue(o.OutputValue)
 		// The output keys "UserKeyId" and "UserSecretKey" require special handling for backward compatibility :/
 		if aws.StringValue(o.OutputKey) == cfnOutputUserKeyID || aws.StringValue(o.OutputKey) == cfnOutputUserSecretKey {
-			k := fmt.Sprintf("%s_%s", strings.ToUpper(service.Name), toScreamingSnakeCase(aws.StringValue(o.OutputKey)))
-			credentials[k] = aws.StringValue(o.OutputValue)
-			ssmValues = append(ssmValues, aws.StringValue(o.OutputValue))
+			key = legacyCredentialKey(service, aws.StringValue(o.OutputKey))
+			credentials[key] = value
+			// their values are the names of SSM parameters
+			value = cfnOutputSSMValuePrefix + value
 		} else {
-			credentials[toScreamingSnakeCaseIfAppropriate(service, aws.StringValue(o.OutputKey))] = aws.StringValue(o.OutputValue)
-			// If the output value starts with "ssm:", we'll get the actual value from SSM
-			if strings.HasPrefix(aws.StringValue(o.OutputValue), cfnOutputSSMValuePrefix) {
-				ssmValues = append(ssmValues, strings.TrimPrefix(aws.StringValue(o.OutputValue), cfnOutputSSMValuePrefix))
-			}
-		}
-	}
-
-	if len(ssmValues) > 0 {
-		resp, err := ssmSvc.GetParameters(&ssm.GetParametersInput{
-			Names:          aws.StringSlice(ssmValues),
-			WithDecryption: aws.Bool(true),
-		})
-		if err != nil {
-			return nil, err
-		} else if len(resp.InvalidParameters) > 0 {
-			return nil, fmt.Errorf("invalid parameters: %v", aws.StringValueSlice(resp.InvalidParameters))
+			key = toScreamingSnakeCaseIfAppropriate(service, aws.StringValue(o.OutputKey))
+			credentials[key] = value
 		}
 
-		for _, p := range resp.Parameters {
-			for k, v := range credentials {
-				if strings.TrimPrefix(v.(string), cfnOutputSSMValuePrefix) == aws.StringValue(p.Name) {
-					credentials[k] = aws.StringValue(p.Value)
-				}
+		// If the output value starts with a resolver prefix such as "ssm:", we'll get the actual value it refers to
+		if prefix := credentialResolverPrefix(value); prefix != "" {
+			ref := strings.TrimPrefix(value, prefix)
+			if refs[prefix] == nil {
+				refs[prefix] = make(map[string][]string)
 			}
+			refs[prefix][ref] = append(refs[prefix][ref], key)
 		}
 	}
 
+	if err := resolveCredentials(sess, clients, credentials, refs); err != nil {
+		return nil, err
+	}
 	return credentials, nil
 }
 
@@ -473,48 +550,161 @@ func getPolicyArn(outputs []*cloudformation.Output, scope string) (string, error
 	return "", fmt.Errorf("output not found: %s", outputKey)
 }
 
-func templateToServiceDefinition(file []byte, db Db, c cache.Cache, item ServiceNeedsUpdate) error {
+// templateToServiceDefinition converts the template and stores the resulting service definition, unless the template
+// hash shows it is unchanged since it was last stored. Returns whether the service definition changed
+func templateToServiceDefinition(file []byte, db Db, c cache.Cache, item ServiceNeedsUpdate) (bool, error) {
 	var i CfnTemplate
 	err := yaml.Unmarshal(file, &i)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if i.Metadata.Spec.Name == "" {
+		return false, errors.New("template is not a valid service definition")
+	}
+	if i.Rules, err = parseCfnRules(file); err != nil {
+		return false, err
+	}
+	if err := checkCfnRules(i); err != nil {
+		return false, err
 	}
+
 	osbdef := db.ServiceDefinitionToOsb(i)
-	if osbdef.Name != "" {
-		err := db.DataStorePort.PutServiceDefinition(osbdef)
-		if err == nil {
-			c.Set(item.Name, osbdef)
-		} else {
-			glog.V(10).Infoln(item)
-			glog.V(10).Infoln(osbdef)
-			glog.Errorln(err)
-		}
-	} else {
+	if osbdef.Name == "" {
 		glog.Errorln(i)
 		glog.Errorln(osbdef)
+		return false, errors.New("template is not a valid service definition")
 	}
-	return nil
+	if err := checkServiceSchemas(osbdef); err != nil {
+		return false, err
+	}
+	hash, err := serviceDefinitionHash(osbdef)
+	if err != nil {
+		return false, err
+	}
+	if sd, err := c.Get(item.Name); err == nil {
+		if cachedHash, err := serviceDefinitionHash(sd.(osb.Service)); err == nil && cachedHash == hash {
+			glog.Infof("Service definition %q is unchanged", item.Name)
+			c.Set(item.Name, osbdef)
+			return false, nil
+		}
+	}
+	storedHash, err := db.DataStorePort.GetServiceDefinitionHash(osbdef.ID)
+	if err != nil {
+		return false, err
+	}
+	if storedHash == hash {
+		glog.Infof("Service definition %q is unchanged, skipping the update of the stored definition", item.Name)
+		c.Set(item.Name, osbdef)
+		return false, nil
+	}
+	err = db.DataStorePort.PutServiceDefinition(osbdef, hash)
+	if err != nil {
+		glog.V(10).Infoln(item)
+		glog.V(10).Infoln(osbdef)
+		return false, err
+	}
+	c.Set(item.Name, osbdef)
+	return true, nil
+}
+
+// stackServiceDefinition converts the template a stack was last created or updated with into a service definition,
+// which is older than the one in the catalog when the stack is pinned to a previous template version
+func (b *AwsBroker) stackServiceDefinition(cfnSvc CfnClient, stackID string) (*osb.Service, error) {
+	resp, err := cfnSvc.Client.GetTemplate(&cloudformation.GetTemplateInput{
+		StackName: aws.String(stackID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	file := []byte(aws.StringValue(resp.TemplateBody))
+	var sd CfnTemplate
+	if err := yaml.Unmarshal(file, &sd); err != nil {
+		return nil, err
+	}
+	if sd.Metadata.Spec.Name == "" {
+		return nil, errors.New("template is not a valid service definition")
+	}
+	if sd.Rules, err = parseCfnRules(file); err != nil {
+		return nil, err
+	}
+	if err := checkCfnRules(sd); err != nil {
+		return nil, err
+	}
+	service := b.db.ServiceDefinitionToOsb(sd)
+	return &service, nil
+}
+
+// serviceDefinitionHash returns the SHA-256 of a converted service definition, which changes with either the template
+// or the way it is converted
+func serviceDefinitionHash(sd osb.Service) (string, error) {
+	b, err := json.Marshal(sd)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func cfnParamsToOsb(template CfnTemplate) map[string]interface{} {
 	osbParams := make(map[string]interface{})
 	for k, v := range template.Parameters {
 
-		p := map[string]interface{}{"description": v.Description}
-		switch v.Type {
-		case "Number":
-			p["type"] = "integer"
-		default:
-			p["type"] = "string"
+		p := cfnTypeToSchema(v.Type)
+		p["description"] = v.Description
+		// list constraints apply to each value in the list
+		values := p
+		if items, ok := p["items"].(map[string]interface{}); ok {
+			values = items
 		}
 		if v.Default != nil {
 			p["required"] = false
-			p["default"] = *v.Default
+			p["default"] = cfnValueToSchema(p, *v.Default)
 		} else {
 			p["required"] = true
 		}
 		if v.AllowedValues != nil {
-			p["enum"] = v.AllowedValues
+			enum := make([]interface{}, len(v.AllowedValues))
+			for i, a := range v.AllowedValues {
+				enum[i] = cfnValueToSchema(values, a)
+			}
+			values["enum"] = enum
+		}
+		if v.AllowedPattern != "" {
+			// CloudFormation patterns must match the whole value, JSON Schema patterns don't
+			pattern := "^(?:" + v.AllowedPattern + ")$"
+			if _, err := regexp.Compile(pattern); err != nil {
+				// patterns using syntax Go doesn't support, such as lookaheads, are only checked by CloudFormation
+				glog.Warningf("Leaving the AllowedPattern of parameter %s out of its schema: %v", k, err)
+			} else {
+				values["pattern"] = pattern
+			}
+		}
+		for keyword, value := range map[string]string{
+			"minimum":   v.MinValue,
+			"maximum":   v.MaxValue,
+			"minLength": v.MinLength,
+			"maxLength": v.MaxLength,
+		} {
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				values[keyword] = n
+			}
+		}
+		if v.ConstraintDescription != "" {
+			p["constraint_description"] = v.ConstraintDescription
+		}
+		if strings.EqualFold(v.NoEcho, "true") {
+			p["format"] = "password"
+			p["writeOnly"] = true
 		}
 		if template.Metadata.Interface.ParameterLabels[k].Label != "" {
 			p["title"] = template.Metadata.Interface.ParameterLabels[k].Label
@@ -528,6 +718,46 @@ func cfnParamsToOsb(template CfnTemplate) map[string]interface{} {
 	return osbParams
 }
 
+// cfnTypeToSchema returns the JSON Schema for a CloudFormation parameter type, AWS-specific types that identify a
+// resource are checked against the resource id format
+func cfnTypeToSchema(cfnType string) map[string]interface{} {
+	switch {
+	case cfnType == "Number":
+		return map[string]interface{}{"type": "number"}
+	case cfnType == "CommaDelimitedList":
+		return map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+	case strings.HasPrefix(cfnType, "List<") && strings.HasSuffix(cfnType, ">"):
+		return map[string]interface{}{"type": "array", "items": cfnTypeToSchema(cfnType[len("List<") : len(cfnType)-1])}
+	}
+	p := map[string]interface{}{"type": "string"}
+	if pattern, ok := awsParamTypePatterns[cfnType]; ok {
+		p["pattern"] = pattern
+	}
+	return p
+}
+
+// cfnValueToSchema converts a CloudFormation parameter value to the type of its JSON Schema, values that can't be
+// converted are returned as is
+func cfnValueToSchema(schema map[string]interface{}, value string) interface{} {
+	switch schema["type"] {
+	case "number":
+		if n, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return n
+		}
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		l := make([]interface{}, 0)
+		if value == "" {
+			return l
+		}
+		for _, v := range strings.Split(value, ",") {
+			l = append(l, cfnValueToSchema(items, strings.TrimSpace(v)))
+		}
+		return l
+	}
+	return value
+}
+
 func cfnGetParamGroup(param string, template CfnTemplate) string {
 	for _, v := range template.Metadata.Interface.ParameterGroups {
 		if stringInSlice(param, v.Parameters) {
@@ -13,8 +13,11 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/koding/cache"
 	osb "github.com/pmorie/go-open-service-broker-client/v2"
+	"github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func clearOverrides() {
@@ -49,7 +52,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	g := map[string]string{"override_param": "overridden"}
 
 	msg := "params should not be modified when prescribeOverrides is false"
-	psvcs := prescribeOverrides(AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: false, globalOverrides: g}, services)
+	psvcs := prescribeOverrides(&AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: false, globalOverrides: g}, services)
 	expected := []osb.Service{
 		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
 			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
@@ -68,7 +71,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	assertor.Equal(expected, psvcs, msg)
 
 	msg = "override_param should be removed when prescribeOverrides is true"
-	psvcs = prescribeOverrides(AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
+	psvcs = prescribeOverrides(&AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
 	expected = []osb.Service{
 		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
 			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
@@ -115,7 +118,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	}
 
 	msg = "override_param should be removed from Update params too when prescribeOverrides is true"
-	psvcs = prescribeOverrides(AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
+	psvcs = prescribeOverrides(&AwsBroker{brokerid: "awsservicebroker", prescribeOverrides: true, globalOverrides: g}, services)
 	expected = []osb.Service{
 		{ID: "test", Name: "test", Description: "test", Plans: []osb.Plan{
 			{ID: "testplan", Name: "testplan", Description: "testplan", Schemas: &osb.Schemas{
@@ -145,7 +148,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	assertor.Equal(expected, psvcs, msg)
 
 	msg = "required should be removed if all required params are overridden"
-	b := AwsBroker{
+	b := &AwsBroker{
 		brokerid:           "awsservicebroker",
 		prescribeOverrides: true,
 		globalOverrides:    map[string]string{"override_param": "overridden", "req_param": "overridden"},
@@ -176,7 +179,7 @@ func TestPrescribeOverrides(t *testing.T) {
 	assertor.Equal(expected, psvcs, msg)
 
 	msg = "should succeed when there are no required params"
-	b = AwsBroker{
+	b = &AwsBroker{
 		brokerid:           "awsservicebroker",
 		prescribeOverrides: true,
 		globalOverrides:    map[string]string{"override_param": "overridden"},
@@ -401,7 +404,247 @@ func TestGetCredentials(t *testing.T) {
 		"TESTSVC_USER_KEY_ID": "val-testkeyval",
 		"TEST_SSM_VAL":        "val-testssmval",
 	}
-	actual, err := getCredentials(&service, outputs, ssmSvc)
+	clients := AwsClients{NewSsm: func(sess *session.Session) ssmiface.SSMAPI { return ssmSvc }}
+	actual, err := getCredentials(&service, outputs, nil, clients)
 	assertor.Equal(nil, err, "err should be nil")
 	assertor.Equal(expected, actual, "not getting expected output")
 }
+
+// mock implementation of DataStore Adapter that records put service definitions and their hashes
+type mockDataStoreHashes struct {
+	mockDataStore
+	hashes map[string]string
+	puts   *int
+}
+
+func (db mockDataStoreHashes) PutServiceDefinition(sd osb.Service, definitionHash string) error {
+	*db.puts++
+	db.hashes[sd.ID] = definitionHash
+	return nil
+}
+
+func (db mockDataStoreHashes) GetServiceDefinitionHash(serviceuuid string) (string, error) {
+	return db.hashes[serviceuuid], nil
+}
+
+func TestTemplateToServiceDefinition(t *testing.T) {
+	assertor := assert.New(t)
+	template := []byte("Metadata:\n  AWS::ServiceBroker::Specification:\n    Name: test\n")
+	ds := mockDataStoreHashes{hashes: make(map[string]string), puts: new(int)}
+	db := Db{Accountuuid: uuid.NewV4(), DataStorePort: ds}
+	c := cache.NewMemory()
+	item := ServiceNeedsUpdate{Name: "test", Update: true}
+	serviceid := uuid.NewV5(db.Accountuuid, "test").String()
+
+	changed, err := templateToServiceDefinition(template, db, c, item)
+	assertor.Nil(err)
+	assertor.True(changed, "new templates should be converted")
+	assertor.Equal(1, *ds.puts)
+	sd, _ := c.Get("test")
+	assertor.Equal("test", sd.(osb.Service).Name)
+	hash, _ := serviceDefinitionHash(sd.(osb.Service))
+	assertor.Equal(hash, ds.hashes[serviceid], "should store the hash of the service definition")
+
+	changed, err = templateToServiceDefinition(template, db, c, item)
+	assertor.Nil(err)
+	assertor.False(changed, "unchanged templates should be skipped")
+	assertor.Equal(1, *ds.puts, "unchanged templates should not be put")
+
+	// unchanged template after the catalog cache expired
+	c.Delete("test")
+	changed, err = templateToServiceDefinition(template, db, c, item)
+	assertor.Nil(err)
+	assertor.False(changed, "should compare with the stored hash")
+	assertor.Equal(1, *ds.puts)
+	sd, _ = c.Get("test")
+	assertor.Equal("test", sd.(osb.Service).Name, "should cache the converted service definition")
+
+	// a stored definition converted differently is put again
+	ds.hashes[serviceid] = "other"
+	c.Delete("test")
+	changed, err = templateToServiceDefinition(template, db, c, item)
+	assertor.Nil(err)
+	assertor.True(changed)
+	assertor.Equal(2, *ds.puts)
+
+	changed, err = templateToServiceDefinition(append(template, []byte("Description: changed\n")...), db, c, item)
+	assertor.Nil(err)
+	assertor.True(changed, "changed templates should be converted")
+	assertor.Equal(3, *ds.puts)
+
+	_, err = templateToServiceDefinition([]byte("Description: no spec\n"), db, c, item)
+	assertor.EqualError(err, "template is not a valid service definition")
+}
+
+func TestServiceDefinitionHash(t *testing.T) {
+	assertor := assert.New(t)
+
+	var template CfnTemplate
+	err := yaml.Unmarshal([]byte(`
+Parameters:
+  A: {Type: String}
+  B: {Type: String}
+  C: {Type: String}
+  D: {Type: Number, Default: '1'}
+Metadata:
+  AWS::ServiceBroker::Specification:
+    Name: test
+    UpdatableParameters: [A, B, C]
+    ServicePlans:
+      small: {Description: small}
+      medium: {Description: medium}
+      large: {Description: large}
+`), &template)
+	assertor.Nil(err)
+	db := Db{Accountuuid: uuid.NewV4()}
+	expected, err := serviceDefinitionHash(db.ServiceDefinitionToOsb(template))
+	assertor.Nil(err)
+	for i := 0; i < 10; i++ {
+		hash, err := serviceDefinitionHash(db.ServiceDefinitionToOsb(template))
+		assertor.Nil(err)
+		assertor.Equal(expected, hash, "converting the same template should give the same hash")
+	}
+
+	template.Description = "changed"
+	hash, err := serviceDefinitionHash(db.ServiceDefinitionToOsb(template))
+	assertor.Nil(err)
+	assertor.NotEqual(expected, hash)
+}
+
+func TestCfnParamsToOsb(t *testing.T) {
+	assertor := assert.New(t)
+
+	var template CfnTemplate
+	err := yaml.Unmarshal([]byte(`
+Parameters:
+  Name:
+    Type: String
+    MinLength: 1
+    MaxLength: '64'
+    AllowedPattern: '[a-z]+'
+    ConstraintDescription: must be lowercase letters
+  DBName:
+    Type: String
+    AllowedPattern: ^(?!^mysql$)[a-z]*$
+  Password:
+    Type: String
+    NoEcho: 'True'
+  Size:
+    Type: Number
+    Default: '1000000'
+    MinValue: '5'
+    MaxValue: 1e7
+  Mode:
+    Type: Number
+    Default: '1'
+    AllowedValues: ['1', '2']
+  Cidrs:
+    Type: CommaDelimitedList
+    Default: 10.0.0.0/16, 10.1.0.0/16
+  Subnets:
+    Type: List<AWS::EC2::Subnet::Id>
+  Vpc:
+    Type: AWS::EC2::VPC::Id
+`), &template)
+	assertor.Nil(err)
+
+	expected := map[string]interface{}{
+		"Name": map[string]interface{}{
+			"description":            "",
+			"type":                   "string",
+			"required":               true,
+			"minLength":              float64(1),
+			"maxLength":              float64(64),
+			"pattern":                "^(?:[a-z]+)$",
+			"constraint_description": "must be lowercase letters",
+		},
+		"DBName": map[string]interface{}{
+			"description": "",
+			"type":        "string",
+			"required":    true,
+		},
+		"Password": map[string]interface{}{
+			"description": "",
+			"type":        "string",
+			"required":    true,
+			"format":      "password",
+			"writeOnly":   true,
+		},
+		"Size": map[string]interface{}{
+			"description": "",
+			"type":        "number",
+			"required":    false,
+			"default":     float64(1000000),
+			"minimum":     float64(5),
+			"maximum":     float64(10000000),
+		},
+		"Mode": map[string]interface{}{
+			"description": "",
+			"type":        "number",
+			"required":    false,
+			"default":     float64(1),
+			"enum":        []interface{}{float64(1), float64(2)},
+		},
+		"Cidrs": map[string]interface{}{
+			"description": "",
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string"},
+			"required":    false,
+			"default":     []interface{}{"10.0.0.0/16", "10.1.0.0/16"},
+		},
+		"Subnets": map[string]interface{}{
+			"description": "",
+			"type":        "array",
+			"items":       map[string]interface{}{"type": "string", "pattern": awsParamTypePatterns["AWS::EC2::Subnet::Id"]},
+			"required":    true,
+		},
+		"Vpc": map[string]interface{}{
+			"description": "",
+			"type":        "string",
+			"pattern":     awsParamTypePatterns["AWS::EC2::VPC::Id"],
+			"required":    true,
+		},
+	}
+	assertor.Equal(expected, cfnParamsToOsb(template))
+}
+
+func TestToCfnParamValue(t *testing.T) {
+	tagsSchema := nonCfnParamDefs["user_tags"]
+	tests := []struct {
+		name     string
+		schema   interface{}
+		value    interface{}
+		expected string
+		err      string
+	}{
+		{name: "nil", value: nil, expected: ""},
+		{name: "string", value: "a-value", expected: "a-value"},
+		{name: "bool", value: true, expected: "true"},
+		{name: "large_number", value: float64(1000000), expected: "1000000"},
+		{name: "decimal", value: 1.5, expected: "1.5"},
+		{name: "list", schema: map[string]interface{}{"type": "array"}, value: []interface{}{"a", float64(1), false}, expected: "a,1,false"},
+		{name: "empty_list", value: []interface{}{}, expected: ""},
+		{name: "list_with_commas", value: []interface{}{"a,b"}, err: `list values can't contain commas: "a,b"`},
+		{name: "nested_list", value: []interface{}{[]interface{}{"a"}}, err: "lists can only contain strings, numbers and booleans"},
+		{name: "object", value: map[string]interface{}{"a": "b"}, err: "objects are not supported"},
+		{
+			name:     "tags",
+			schema:   tagsSchema,
+			value:    []interface{}{map[string]interface{}{"Key": "k", "Value": "v"}},
+			expected: `[{"Key":"k","Value":"v"}]`,
+		},
+		{name: "tags_string", schema: tagsSchema, value: `[{"Key": "k", "Value": "v"}]`, expected: `[{"Key": "k", "Value": "v"}]`},
+		{name: "tags_default", schema: tagsSchema, value: []interface{}{}, expected: "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := toCfnParamValue(tt.schema, tt.value)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.expected, actual)
+			}
+		})
+	}
+}
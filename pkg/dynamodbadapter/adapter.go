@@ -2,6 +2,7 @@ package dynamodbadapter
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -22,6 +23,14 @@ const (
 	itemTypeServiceInstance = "serviceinstance"
 )
 
+const (
+	// BatchGetItem accepts at most 100 keys
+	batchGetItemMaxKeys = 100
+	// unprocessed keys are retried with a growing delay, as they are usually throttled
+	batchGetItemAttempts   = 5
+	batchGetItemRetryDelay = 100 * time.Millisecond
+)
+
 // DdbDataStore is a DynamoDB implementation of DataStore.
 type DdbDataStore struct {
 	Accountid   string
@@ -33,7 +42,7 @@ type DdbDataStore struct {
 }
 
 // PutServiceDefinition push catalog service definition to DynamoDb
-func (db DdbDataStore) PutServiceDefinition(sd osb.Service) error {
+func (db DdbDataStore) PutServiceDefinition(sd osb.Service, definitionHash string) error {
 	glog.Infof("putting service definition %q into dynamdb", sd.Name)
 	serviceid := uuid.NewV5(db.Accountuuid, sd.Name)
 	si, err := dynamodbattribute.Marshal(sd)
@@ -52,6 +61,9 @@ func (db DdbDataStore) PutServiceDefinition(sd osb.Service) error {
 			"type":        {S: aws.String(itemTypeService)},
 		},
 	}
+	if definitionHash != "" {
+		putInput.Item["definitionhash"] = &dynamodb.AttributeValue{S: aws.String(definitionHash)}
+	}
 	_, err = db.Ddb.PutItem(&putInput)
 	if err != nil {
 		glog.Infoln(putInput)
@@ -119,15 +131,159 @@ func (db DdbDataStore) PutParam(paramname string, paramvalue string) error {
 
 // ServiceItem used to unmarshal catalog entries from DynamoDb
 type ServiceItem struct {
-	ID          string      `json:"id"`
-	Userid      string      `json:"userid"`
-	Service     osb.Service `json:"service"`
-	Serviceid   string      `json:"serviceid"`
-	Servicename string      `json:"servicename"`
+	ID             string      `json:"id"`
+	Userid         string      `json:"userid"`
+	Service        osb.Service `json:"service"`
+	Serviceid      string      `json:"serviceid"`
+	Servicename    string      `json:"servicename"`
+	Tombstone      bool        `json:"tombstone"`
+	DefinitionHash string      `json:"definitionhash"`
 }
 
-// GetServiceDefinition fetches given catalog service definition from Dynamo
+// GetServiceDefinition fetches given catalog service definition from Dynamo, including tombstoned definitions
 func (db DdbDataStore) GetServiceDefinition(serviceuuid string) (*osb.Service, error) {
+	item, err := db.getServiceItem(serviceuuid)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return &item.Service, nil
+}
+
+// GetServiceDefinitionHash fetches the hash of given catalog service definition.
+// Tombstoned definitions have no hash, so that they are put again when their template comes back
+func (db DdbDataStore) GetServiceDefinitionHash(serviceuuid string) (string, error) {
+	item, err := db.getServiceItem(serviceuuid)
+	if err != nil || item == nil || item.Tombstone {
+		return "", err
+	}
+	return item.DefinitionHash, nil
+}
+
+// IsServiceDefinitionTombstoned tells whether given catalog service definition was removed from the catalog
+func (db DdbDataStore) IsServiceDefinitionTombstoned(serviceuuid string) (bool, error) {
+	item, err := db.getServiceItem(serviceuuid)
+	if err != nil || item == nil {
+		return false, err
+	}
+	return item.Tombstone, nil
+}
+
+// GetServiceDefinitions fetches all catalog service definitions from Dynamo, leaving out tombstoned ones
+func (db DdbDataStore) GetServiceDefinitions() ([]osb.Service, error) {
+	keyCond := expression.Key("type").Equal(expression.Value(itemTypeService)).
+		And(expression.Key("userid").Equal(expression.Value(db.Accountuuid.String())))
+	expr, err := expression.NewBuilder().WithKeyCondition(keyCond).Build()
+	if err != nil {
+		return nil, err
+	}
+
+	// the type-userid-index only projects the keys, so the definitions are fetched from the table
+	var ids []string
+	input := &dynamodb.QueryInput{
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		IndexName:                 aws.String("type-userid-index"),
+		KeyConditionExpression:    expr.KeyCondition(),
+		TableName:                 aws.String(db.Tablename),
+	}
+	err = db.Ddb.QueryPages(input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			ids = append(ids, aws.StringValue(item["id"].S))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]ServiceItem, len(ids))
+	for i := 0; i < len(ids); i += batchGetItemMaxKeys {
+		end := i + batchGetItemMaxKeys
+		if end > len(ids) {
+			end = len(ids)
+		}
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, end-i)
+		for _, id := range ids[i:end] {
+			keys = append(keys, map[string]*dynamodb.AttributeValue{
+				"id":     {S: aws.String(id)},
+				"userid": {S: aws.String(db.Accountuuid.String())},
+			})
+		}
+		resp, err := db.batchGetItems(keys)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resp {
+			var item ServiceItem
+			if err := dynamodbattribute.UnmarshalMap(r, &item); err != nil {
+				return nil, err
+			}
+			items[item.ID] = item
+		}
+	}
+
+	// BatchGetItem returns the items in no particular order, the definitions keep the order of the index
+	var services []osb.Service
+	for _, id := range ids {
+		if item, ok := items[id]; ok && !item.Tombstone {
+			services = append(services, item.Service)
+		}
+	}
+	return services, nil
+}
+
+// batchGetItems fetches the items with given keys, retrying the keys BatchGetItem leaves unprocessed
+func (db DdbDataStore) batchGetItems(keys []map[string]*dynamodb.AttributeValue) ([]map[string]*dynamodb.AttributeValue, error) {
+	var items []map[string]*dynamodb.AttributeValue
+	requestItems := map[string]*dynamodb.KeysAndAttributes{db.Tablename: {Keys: keys}}
+	for attempt := 1; ; attempt++ {
+		resp, err := db.Ddb.BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: requestItems})
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, resp.Responses[db.Tablename]...)
+		if len(resp.UnprocessedKeys) == 0 {
+			return items, nil
+		} else if attempt == batchGetItemAttempts {
+			return nil, fmt.Errorf("%d items were left unprocessed after %d attempts", len(resp.UnprocessedKeys[db.Tablename].Keys), attempt)
+		}
+		requestItems = resp.UnprocessedKeys
+		time.Sleep(time.Duration(attempt) * batchGetItemRetryDelay)
+	}
+}
+
+// TombstoneServiceDefinition marks given catalog service definition as removed from the catalog. It can still be
+// fetched with GetServiceDefinition so that existing instances keep working, and is cleared the next time the
+// definition is put
+func (db DdbDataStore) TombstoneServiceDefinition(serviceuuid string) error {
+	glog.Infof("tombstoning service definition %q in dynamdb", serviceuuid)
+	expr, _ := expression.NewBuilder().
+		WithCondition(expression.Name("type").Equal(expression.Value(itemTypeService))).
+		WithUpdate(expression.Set(expression.Name("tombstone"), expression.Value(true))).
+		Build()
+
+	_, err := db.Ddb.UpdateItem(&dynamodb.UpdateItemInput{
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":     {S: aws.String(serviceuuid)},
+			"userid": {S: aws.String(db.Accountuuid.String())},
+		},
+		TableName:        aws.String(db.Tablename),
+		UpdateExpression: expr.Update(),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			glog.Errorf("item %s does not have type %s", serviceuuid, itemTypeService)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (db DdbDataStore) getServiceItem(serviceuuid string) (*ServiceItem, error) {
 	resp, err := db.Ddb.GetItem(&dynamodb.GetItemInput{
 		Key: map[string]*dynamodb.AttributeValue{
 			"id":     {S: aws.String(serviceuuid)},
@@ -143,7 +299,7 @@ func (db DdbDataStore) GetServiceDefinition(serviceuuid string) (*osb.Service, e
 
 	var item ServiceItem
 	err = dynamodbattribute.UnmarshalMap(resp.Item, &item)
-	return &item.Service, err
+	return &item, err
 }
 
 // GetServiceInstance fetches given service instance from Dynamo
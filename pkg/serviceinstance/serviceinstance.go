@@ -9,6 +9,11 @@ type ServiceInstance struct {
 	PlanID    string
 	Params    map[string]string
 	StackID   string
+	// TemplateVersion is the version of the template the stack was last created or upgraded with, either an S3
+	// object version ID or a content hash
+	TemplateVersion string
+	// MaintenanceVersion is the maintenance_info version of the plan when the stack was last created or upgraded
+	MaintenanceVersion string
 }
 
 func (i *ServiceInstance) Match(other *ServiceInstance) bool {
@@ -22,6 +27,43 @@ type ServiceBinding struct {
 	PolicyArn  string
 	RoleName   string
 	Scope      string
+	// UserName is the IAM user created for the binding, if any
+	UserName string
+	// AccessKeyID is the access key of UserName given to the binding, for attribution in CloudTrail
+	AccessKeyID string
+	// SecretName is the Secrets Manager secret holding the secret of AccessKeyID, so that the binding can be fetched
+	SecretName string
+	// CredentialsType is Temporary for bindings that get STS credentials, empty otherwise
+	CredentialsType string
+	// CreatedRoleName is the IAM role created for the binding, if any
+	CreatedRoleName string
+	// ServiceAccount is the Kubernetes service account, as namespace:name, trusted to assume CreatedRoleName
+	ServiceAccount string
+	// PrincipalType is the type of the IAM user or group PolicyArn is attached to, roles are kept in RoleName
+	PrincipalType string
+	// PrincipalName is the name of the IAM user or group PolicyArn is attached to
+	PrincipalName string
+	// PrincipalArn is the principal, usually in another account, granted access by the policies of ResourceGrants
+	PrincipalArn string
+	// ResourceGrants are the resources whose policies were changed to grant PrincipalArn access
+	ResourceGrants []ResourceGrant
+	// PredecessorBindingID is the binding this binding rotated
+	PredecessorBindingID string
+	// SuccessorBindingID is the binding that rotated this binding
+	SuccessorBindingID string
+	// State is the state of an asynchronous bind, in progress, succeeded or failed. It is empty for bindings that were
+	// created synchronously
+	State string
+	// StateDescription is the reason an asynchronous bind failed
+	StateDescription string
+}
+
+// ResourceGrant is a resource whose policy has a statement, or a KMS grant, for a binding
+type ResourceGrant struct {
+	// Type is S3, SQS, SNS or KMS
+	Type string
+	// Resource is the bucket name, queue URL, topic ARN or key id
+	Resource string
 }
 
 // Match returns true if the other service binding has the same attributes.
@@ -29,5 +71,11 @@ func (b *ServiceBinding) Match(other *ServiceBinding) bool {
 	return b.ID == other.ID &&
 		b.InstanceID == other.InstanceID &&
 		b.RoleName == other.RoleName &&
-		b.Scope == other.Scope
+		b.Scope == other.Scope &&
+		b.CredentialsType == other.CredentialsType &&
+		b.ServiceAccount == other.ServiceAccount &&
+		b.PrincipalType == other.PrincipalType &&
+		b.PrincipalName == other.PrincipalName &&
+		b.PrincipalArn == other.PrincipalArn &&
+		b.PredecessorBindingID == other.PredecessorBindingID
 }